@@ -0,0 +1,471 @@
+package xmpp
+
+import (
+	"bufio"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultArchivePage is the page size of archive queries without <max/>
+	defaultArchivePage = 50
+	// maxArchivePage caps the page size a client can ask for
+	maxArchivePage = 250
+	// maxArchivedStanza caps the size of the stanzas FileArchiveStore keeps
+	maxArchivedStanza = 64 << 10
+	// maxArchiveRecord caps the lines FileArchiveStore reads back, which
+	// hold a JSON-escaped stanza
+	maxArchiveRecord = 1 << 20
+)
+
+// ErrArchiveItemNotFound is returned by ArchiveStore.Query when the after
+// or before id of a query is not in the archive
+var ErrArchiveItemNotFound = errors.New("archive: item not found")
+
+// ErrArchiveMessageTooLarge is returned by FileArchiveStore.Append for
+// stanzas over 64 KiB, which are not archived
+var ErrArchiveMessageTooLarge = errors.New("archive: message too large")
+
+// ArchivedMessage is a message stored in a user's archive
+type ArchivedMessage struct {
+	// ID is the archive id, also sent to clients as the stanza-id
+	ID string
+	// With is the other party of the conversation
+	With    JID
+	Time    time.Time
+	Message *ClientMessage
+}
+
+// ArchiveQuery selects messages from an archive. Zero fields do not filter.
+type ArchiveQuery struct {
+	// With matches the full JID, or any resource if it is a bare JID
+	With  JID
+	Start time.Time
+	End   time.Time
+
+	// XEP-0059 paging: After and Before are archive ids. With LastPage the
+	// query returns the last page, as an empty <before/> asks for.
+	After    string
+	Before   string
+	LastPage bool
+	Max      int
+}
+
+// ArchivePage is the result of an ArchiveQuery
+type ArchivePage struct {
+	Messages []ArchivedMessage
+	// Index is the position of the first message among all matches
+	Index int
+	// Count is the number of messages matching the filters
+	Count int
+	// Complete is set when the page reaches the end of the archive in the
+	// paging direction
+	Complete bool
+}
+
+// ArchivePrefs are the XEP-0313 archiving preferences of a user
+type ArchivePrefs struct {
+	// Default is "always", "never" or "roster"
+	Default string
+	Always  []JID
+	Never   []JID
+}
+
+// ArchiveStore keeps the message archives of users, identified by bare JID
+type ArchiveStore interface {
+	Append(owner JID, message ArchivedMessage) error
+	Query(owner JID, query ArchiveQuery) (ArchivePage, error)
+	Preferences(owner JID) (ArchivePrefs, error)
+	SetPreferences(owner JID, prefs ArchivePrefs) error
+	// DeleteArchive forgets the archive and the preferences of owner
+	DeleteArchive(owner JID) error
+}
+
+// defaultArchivePrefs apply to users who never set preferences
+var defaultArchivePrefs = ArchivePrefs{Default: "always"}
+
+// matches reports whether message passes the filters of query
+func (q *ArchiveQuery) matches(message *ArchivedMessage) bool {
+	if !q.With.IsZero() {
+		if q.With.IsBare() && message.With.Bare() != q.With {
+			return false
+		}
+		if !q.With.IsBare() && message.With != q.With {
+			return false
+		}
+	}
+	if !q.Start.IsZero() && message.Time.Before(q.Start) {
+		return false
+	}
+	if !q.End.IsZero() && message.Time.After(q.End) {
+		return false
+	}
+	return true
+}
+
+// pageArchive applies query to the messages of an archive, oldest first
+func pageArchive(messages []ArchivedMessage, query ArchiveQuery) (ArchivePage, error) {
+	var matching []ArchivedMessage
+	for i := range messages {
+		if query.matches(&messages[i]) {
+			matching = append(matching, messages[i])
+		}
+	}
+	max := query.Max
+	if max <= 0 {
+		max = defaultArchivePage
+	}
+	if max > maxArchivePage {
+		max = maxArchivePage
+	}
+
+	indexOf := func(id string) int {
+		for i := range matching {
+			if matching[i].ID == id {
+				return i
+			}
+		}
+		return -1
+	}
+	// the page is taken from [from, to) of the matching messages
+	from, to := 0, len(matching)
+	if query.After != "" {
+		if from = indexOf(query.After); from < 0 {
+			return ArchivePage{}, ErrArchiveItemNotFound
+		}
+		from++
+	}
+	if query.Before != "" {
+		if to = indexOf(query.Before); to < 0 {
+			return ArchivePage{}, ErrArchiveItemNotFound
+		}
+	}
+	if to < from {
+		to = from
+	}
+
+	page := ArchivePage{Count: len(matching)}
+	if query.Before != "" || query.LastPage {
+		if to-from > max {
+			from = to - max
+		}
+		page.Complete = from == 0
+	} else {
+		if to-from > max {
+			to = from + max
+		}
+		page.Complete = to == len(matching)
+	}
+	page.Index = from
+	page.Messages = matching[from:to]
+	return page, nil
+}
+
+// MemoryArchiveStore is an ArchiveStore that keeps everything in memory
+type MemoryArchiveStore struct {
+	lock     sync.Mutex
+	archives map[JID][]ArchivedMessage
+	prefs    map[JID]ArchivePrefs
+}
+
+// NewMemoryArchiveStore returns an empty in-memory archive store
+func NewMemoryArchiveStore() *MemoryArchiveStore {
+	return &MemoryArchiveStore{
+		archives: make(map[JID][]ArchivedMessage),
+		prefs:    make(map[JID]ArchivePrefs),
+	}
+}
+
+// Append adds message to the archive of owner
+func (m *MemoryArchiveStore) Append(owner JID, message ArchivedMessage) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.archives[owner] = append(m.archives[owner], message)
+	return nil
+}
+
+// Query returns a page of the archive of owner
+func (m *MemoryArchiveStore) Query(owner JID, query ArchiveQuery) (ArchivePage, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return pageArchive(m.archives[owner], query)
+}
+
+// Preferences returns the archiving preferences of owner
+func (m *MemoryArchiveStore) Preferences(owner JID) (ArchivePrefs, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if prefs, ok := m.prefs[owner]; ok {
+		return prefs, nil
+	}
+	return defaultArchivePrefs, nil
+}
+
+// SetPreferences stores the archiving preferences of owner
+func (m *MemoryArchiveStore) SetPreferences(owner JID, prefs ArchivePrefs) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.prefs[owner] = prefs
+	return nil
+}
+
+// DeleteArchive forgets the archive and the preferences of owner
+func (m *MemoryArchiveStore) DeleteArchive(owner JID) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.archives, owner)
+	delete(m.prefs, owner)
+	return nil
+}
+
+// FileArchiveStore is an ArchiveStore that keeps one append-only file of
+// JSON records per user in a directory. An index of each file read is
+// kept in memory, so queries only read the records of the page they
+// return.
+type FileArchiveStore struct {
+	lock    sync.Mutex
+	dir     string
+	indexes map[JID]*archiveIndex
+}
+
+// archiveIndex locates the records of an archive file
+type archiveIndex struct {
+	// size is how much of the file has been indexed
+	size int64
+	// messages are the indexed records without their Message
+	messages []ArchivedMessage
+	spans    map[string]archiveSpan
+}
+
+// archiveSpan is the position of a record in an archive file
+type archiveSpan struct {
+	offset int64
+	length int
+}
+
+// archiveRecord is the on-disk form of an ArchivedMessage
+type archiveRecord struct {
+	ID     string    `json:"id"`
+	With   JID       `json:"with"`
+	Time   time.Time `json:"time"`
+	Stanza string    `json:"stanza"`
+}
+
+// NewFileArchiveStore returns a store keeping its files in dir, which is
+// created if needed
+func NewFileArchiveStore(dir string) (*FileArchiveStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileArchiveStore{dir: dir, indexes: make(map[JID]*archiveIndex)}, nil
+}
+
+// path returns the file of owner with the given extension
+func (f *FileArchiveStore) path(owner JID, ext string) string {
+	return filepath.Join(f.dir, url.PathEscape(owner.String())+ext)
+}
+
+// Append adds message to the archive file of owner
+func (f *FileArchiveStore) Append(owner JID, message ArchivedMessage) error {
+	stanza, err := xml.Marshal(message.Message)
+	if err != nil {
+		return err
+	}
+	if len(stanza) > maxArchivedStanza {
+		return ErrArchiveMessageTooLarge
+	}
+	line, err := json.Marshal(archiveRecord{ID: message.ID, With: message.With, Time: message.Time, Stanza: string(stanza)})
+	if err != nil {
+		return err
+	}
+
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	file, err := os.OpenFile(f.path(owner, ".log"), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	// a record cut short by a crash must not swallow this one
+	info, err := file.Stat()
+	if err == nil && info.Size() > 0 {
+		last := make([]byte, 1)
+		if _, err = file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+			line = append([]byte{'\n'}, line...)
+		}
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if _, err = file.Write(append(line, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Query returns a page of the archive file of owner
+func (f *FileArchiveStore) Query(owner JID, query ArchiveQuery) (ArchivePage, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	file, err := os.Open(f.path(owner, ".log"))
+	if os.IsNotExist(err) {
+		delete(f.indexes, owner)
+		return pageArchive(nil, query)
+	}
+	if err != nil {
+		return ArchivePage{}, err
+	}
+	defer file.Close()
+
+	index, err := f.index(owner, file)
+	if err != nil {
+		return ArchivePage{}, err
+	}
+	page, err := pageArchive(index.messages, query)
+	if err != nil {
+		return page, err
+	}
+	// only the messages of the page are read back
+	messages := make([]ArchivedMessage, 0, len(page.Messages))
+	for _, message := range page.Messages {
+		span := index.spans[message.ID]
+		line := make([]byte, span.length)
+		if _, err := file.ReadAt(line, span.offset); err != nil {
+			return ArchivePage{}, err
+		}
+		record, err := parseArchiveRecord(line)
+		if err != nil {
+			log.Printf("Skipping unreadable archive record %v of %v: %v\n", message.ID, owner, err.Error())
+			continue
+		}
+		messages = append(messages, record)
+	}
+	page.Messages = messages
+	return page, nil
+}
+
+// index brings the index of the archive file of owner up to date with the
+// records appended since it was last read. Records that cannot be read,
+// like a line cut short by a crash, are skipped.
+func (f *FileArchiveStore) index(owner JID, file *os.File) (*archiveIndex, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if f.indexes == nil {
+		f.indexes = make(map[JID]*archiveIndex)
+	}
+	index := f.indexes[owner]
+	if index == nil || info.Size() < index.size {
+		index = &archiveIndex{spans: make(map[string]archiveSpan)}
+		f.indexes[owner] = index
+	}
+	if _, err := file.Seek(index.size, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReaderSize(file, maxArchiveRecord)
+	offset := index.size
+	for {
+		line, err := reader.ReadSlice('\n')
+		if err == bufio.ErrBufferFull {
+			// too long to be a record, skip to the end of the line
+			length := int64(len(line))
+			for err == bufio.ErrBufferFull {
+				line, err = reader.ReadSlice('\n')
+				length += int64(len(line))
+			}
+			if err == nil {
+				log.Printf("Skipping an archive record of %v over %v bytes\n", owner, maxArchiveRecord)
+				offset += length
+				index.size = offset
+				continue
+			}
+		}
+		if err == io.EOF {
+			// a last line without its newline is not complete yet
+			return index, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		record, err := parseArchiveRecord(line)
+		if err != nil {
+			log.Printf("Skipping an unreadable archive record of %v: %v\n", owner, err.Error())
+		} else if _, ok := index.spans[record.ID]; !ok {
+			index.spans[record.ID] = archiveSpan{offset: offset, length: len(line)}
+			record.Message = nil
+			index.messages = append(index.messages, record)
+		}
+		offset += int64(len(line))
+		index.size = offset
+	}
+}
+
+// parseArchiveRecord decodes a line of an archive file
+func parseArchiveRecord(line []byte) (ArchivedMessage, error) {
+	var record archiveRecord
+	if err := json.Unmarshal(line, &record); err != nil {
+		return ArchivedMessage{}, err
+	}
+	message := &ClientMessage{}
+	if err := xml.Unmarshal([]byte(record.Stanza), message); err != nil {
+		return ArchivedMessage{}, err
+	}
+	return ArchivedMessage{ID: record.ID, With: record.With, Time: record.Time, Message: message}, nil
+}
+
+// Preferences reads the archiving preferences of owner
+func (f *FileArchiveStore) Preferences(owner JID) (ArchivePrefs, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	data, err := os.ReadFile(f.path(owner, ".prefs"))
+	if os.IsNotExist(err) {
+		return defaultArchivePrefs, nil
+	}
+	if err != nil {
+		return ArchivePrefs{}, err
+	}
+	var prefs ArchivePrefs
+	err = json.Unmarshal(data, &prefs)
+	return prefs, err
+}
+
+// SetPreferences writes the archiving preferences of owner
+func (f *FileArchiveStore) SetPreferences(owner JID, prefs ArchivePrefs) error {
+	data, err := json.Marshal(prefs)
+	if err != nil {
+		return err
+	}
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	// write a new file and rename it over the old one so a crash never
+	// leaves half of the preferences behind
+	path := f.path(owner, ".prefs")
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// DeleteArchive removes the archive and preferences files of owner
+func (f *FileArchiveStore) DeleteArchive(owner JID) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	delete(f.indexes, owner)
+	for _, ext := range []string{".log", ".prefs"} {
+		if err := os.Remove(f.path(owner, ext)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
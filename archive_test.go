@@ -0,0 +1,139 @@
+package xmpp
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestPageArchive(t *testing.T) {
+	bob, err := ParseJID("bob@example.com/phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	carol, err := ParseJID("carol@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	messages := []ArchivedMessage{
+		{ID: "m1", With: bob},
+		{ID: "m2", With: carol},
+		{ID: "m3", With: bob},
+		{ID: "m4", With: carol},
+		{ID: "m5", With: bob},
+	}
+
+	tests := []struct {
+		name     string
+		query    ArchiveQuery
+		ids      []string
+		index    int
+		complete bool
+		err      error
+	}{
+		{"everything", ArchiveQuery{}, []string{"m1", "m2", "m3", "m4", "m5"}, 0, true, nil},
+		{"first page", ArchiveQuery{Max: 2}, []string{"m1", "m2"}, 0, false, nil},
+		{"after", ArchiveQuery{After: "m2", Max: 2}, []string{"m3", "m4"}, 2, false, nil},
+		{"after to the end", ArchiveQuery{After: "m3", Max: 2}, []string{"m4", "m5"}, 3, true, nil},
+		{"after the last", ArchiveQuery{After: "m5"}, nil, 5, true, nil},
+		{"before", ArchiveQuery{Before: "m4", Max: 2}, []string{"m2", "m3"}, 1, false, nil},
+		{"before to the start", ArchiveQuery{Before: "m3", Max: 5}, []string{"m1", "m2"}, 0, true, nil},
+		{"before the first", ArchiveQuery{Before: "m1"}, nil, 0, true, nil},
+		{"after and before", ArchiveQuery{After: "m1", Before: "m5"}, []string{"m2", "m3", "m4"}, 1, false, nil},
+		{"last page", ArchiveQuery{LastPage: true, Max: 2}, []string{"m4", "m5"}, 3, false, nil},
+		{"whole last page", ArchiveQuery{LastPage: true}, []string{"m1", "m2", "m3", "m4", "m5"}, 0, true, nil},
+		{"with bare JID", ArchiveQuery{With: bob.Bare(), After: "m1"}, []string{"m3", "m5"}, 1, true, nil},
+		{"with full JID", ArchiveQuery{With: bob, LastPage: true, Max: 1}, []string{"m5"}, 2, false, nil},
+		{"unknown after", ArchiveQuery{After: "m9"}, nil, 0, false, ErrArchiveItemNotFound},
+		{"unknown before", ArchiveQuery{Before: "m9"}, nil, 0, false, ErrArchiveItemNotFound},
+		{"after a filtered out id", ArchiveQuery{With: carol, After: "m1"}, nil, 0, false, ErrArchiveItemNotFound},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			page, err := pageArchive(messages, test.query)
+			if err != test.err {
+				t.Fatalf("error %v, want %v", err, test.err)
+			}
+			var ids []string
+			for _, message := range page.Messages {
+				ids = append(ids, message.ID)
+			}
+			if !reflect.DeepEqual(ids, test.ids) {
+				t.Errorf("messages %v, want %v", ids, test.ids)
+			}
+			if err == nil && (page.Index != test.index || page.Complete != test.complete) {
+				t.Errorf("index %v complete %v, want %v %v", page.Index, page.Complete, test.index, test.complete)
+			}
+		})
+	}
+}
+
+func TestFileArchiveStoreDamagedRecords(t *testing.T) {
+	store, err := NewFileArchiveStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	owner, err := ParseJID("alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	with, err := ParseJID("bob@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	appendMessage := func(id, body string) error {
+		return store.Append(owner, ArchivedMessage{ID: id, With: with, Message: &ClientMessage{Body: body}})
+	}
+	appendLine := func(line string) {
+		file, err := os.OpenFile(store.path(owner, ".log"), os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.Close()
+		if _, err := file.WriteString(line); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ids := func() []string {
+		t.Helper()
+		page, err := store.Query(owner, ArchiveQuery{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, message := range page.Messages {
+			ids = append(ids, message.ID)
+		}
+		return ids
+	}
+
+	if err := appendMessage("m1", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendMessage("big", strings.Repeat("x", maxArchivedStanza)); err != ErrArchiveMessageTooLarge {
+		t.Fatalf("appending a large stanza: %v", err)
+	}
+	appendLine("not json\n")
+	appendLine(`{"id":"bad","stanza":"<message"}` + "\n")
+	appendLine(`{"id":"long","stanza":"` + strings.Repeat("x", maxArchiveRecord) + `"}` + "\n")
+	if got, want := ids(), []string{"m1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("messages %v, want %v", got, want)
+	}
+
+	// a record cut short by a crash is skipped once the next one is added
+	appendLine(`{"id":"cut","stan`)
+	if got, want := ids(), []string{"m1"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("messages %v, want %v", got, want)
+	}
+	if err := appendMessage("m2", "second"); err != nil {
+		t.Fatal(err)
+	}
+	page, err := store.Query(owner, ArchiveQuery{After: "m1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(page.Messages) != 1 || page.Messages[0].ID != "m2" || page.Messages[0].Message.Body != "second" {
+		t.Fatalf("page %+v, want m2", page)
+	}
+}
@@ -0,0 +1,529 @@
+package xmpp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// NsHTTPBind XEP-0124 BOSH namespace
+	NsHTTPBind = "http://jabber.org/protocol/httpbind"
+	// NsXBOSH XEP-0206 XMPP over BOSH namespace
+	NsXBOSH = "urn:xmpp:xbosh"
+
+	// boshMaxWait caps how long a request is held without anything to send
+	boshMaxWait = 60 * time.Second
+	// boshMaxHold caps how many requests a client may have held at once
+	boshMaxHold = 2
+	// boshInactivity is how long a session lives without any request
+	boshInactivity = 60 * time.Second
+	// boshPolling is the shortest interval between polls we ask for
+	boshPolling = 2 * time.Second
+	// boshMaxBody bounds the size of a request
+	boshMaxBody = 1 << 20
+)
+
+// boshHandler is the BOSH connection manager of a Server
+type boshHandler struct {
+	server   *Server
+	lock     sync.Mutex
+	sessions map[string]*boshSession
+}
+
+// BOSHHandler returns an http.Handler serving XMPP over BOSH (XEP-0124,
+// XEP-0206), to be mounted on a path such as "/http-bind". The sessions go
+// through the same states and extensions as TCP ones, except STARTTLS:
+// serve the handler over https to get TLS. Plain http requests are refused
+// unless Server.SkipTLS is set.
+func (s *Server) BOSHHandler() http.Handler {
+	return &boshHandler{server: s, sessions: make(map[string]*boshSession)}
+}
+
+// boshBody holds the attributes of a request <body/>
+type boshBody struct {
+	rid       uint64
+	sid       string
+	to        string
+	lang      string
+	version   string
+	terminate bool
+	restart   bool
+	ack       bool
+	wait      time.Duration
+	hold      int
+	// payload is the XML inside <body/>
+	payload []byte
+}
+
+// readBOSHBody parses the <body/> wrapper of a request
+func readBOSHBody(r *http.Request) (*boshBody, error) {
+	data, err := io.ReadAll(io.LimitReader(r.Body, boshMaxBody+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > boshMaxBody {
+		return nil, errors.New("request too large")
+	}
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var se xml.StartElement
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return nil, err
+		}
+		var ok bool
+		if se, ok = token.(xml.StartElement); ok {
+			break
+		}
+	}
+	if se.Name != (xml.Name{Space: NsHTTPBind, Local: "body"}) {
+		return nil, fmt.Errorf("unexpected %v element", se.Name.Local)
+	}
+
+	// the payload lies between the end of the start tag and the closing tag
+	start := d.InputOffset()
+	if err := d.Skip(); err != nil {
+		return nil, err
+	}
+	body := &boshBody{hold: 1}
+	if end := d.InputOffset(); end > start {
+		body.payload = data[start:bytes.LastIndex(data[:end], []byte("</"))]
+	}
+	for _, attr := range se.Attr {
+		switch {
+		case attr.Name.Space == "" && attr.Name.Local == "rid":
+			if body.rid, err = strconv.ParseUint(attr.Value, 10, 64); err != nil {
+				return nil, errors.New("invalid rid")
+			}
+		case attr.Name.Space == "" && attr.Name.Local == "sid":
+			body.sid = attr.Value
+		case attr.Name.Space == "" && attr.Name.Local == "to":
+			body.to = attr.Value
+		case attr.Name.Space == "" && attr.Name.Local == "type":
+			body.terminate = attr.Value == "terminate"
+		case attr.Name.Space == "" && attr.Name.Local == "ack":
+			body.ack = attr.Value == "1"
+		case attr.Name.Space == "" && attr.Name.Local == "wait":
+			seconds, err := strconv.Atoi(attr.Value)
+			if err != nil {
+				return nil, errors.New("invalid wait")
+			}
+			body.wait = time.Duration(seconds) * time.Second
+		case attr.Name.Space == "" && attr.Name.Local == "hold":
+			if body.hold, err = strconv.Atoi(attr.Value); err != nil {
+				return nil, errors.New("invalid hold")
+			}
+		case attr.Name.Space == xmlNamespace && attr.Name.Local == "lang":
+			body.lang = attr.Value
+		case attr.Name.Space == NsXBOSH && attr.Name.Local == "version":
+			body.version = attr.Value
+		case attr.Name.Space == NsXBOSH && attr.Name.Local == "restart":
+			body.restart = attr.Value == "true" || attr.Value == "1"
+		}
+	}
+	return body, nil
+}
+
+// ServeHTTP answers one request of a BOSH session
+func (h *boshHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// browsers load BOSH clients from other origins
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+	w.Header().Set("Access-Control-Allow-Methods", "POST, OPTIONS")
+	switch r.Method {
+	case http.MethodOptions:
+		return
+	case http.MethodPost:
+	default:
+		w.Header().Set("Allow", "POST, OPTIONS")
+		http.Error(w, "BOSH requests are POSTed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.TLS == nil && !h.server.SkipTLS {
+		log.Printf("Refusing BOSH request without TLS from: %v\n", r.RemoteAddr)
+		writeBOSH(w, boshTerminate("policy-violation"))
+		return
+	}
+	body, err := readBOSHBody(r)
+	if err != nil {
+		log.Printf("Bad BOSH request from %v: %v\n", r.RemoteAddr, err.Error())
+		writeBOSH(w, boshTerminate("bad-request"))
+		return
+	}
+	if body.sid == "" {
+		h.create(w, r, body)
+		return
+	}
+	h.lock.Lock()
+	session := h.sessions[body.sid]
+	h.lock.Unlock()
+	if session == nil {
+		writeBOSH(w, boshTerminate("item-not-found"))
+		return
+	}
+	session.handle(w, r, body)
+}
+
+// create starts a new session and answers its first request
+func (h *boshHandler) create(w http.ResponseWriter, r *http.Request, body *boshBody) {
+	if body.rid == 0 {
+		writeBOSH(w, boshTerminate("bad-request"))
+		return
+	}
+	wait := body.wait
+	if wait <= 0 || wait > boshMaxWait {
+		wait = boshMaxWait
+	}
+	hold := body.hold
+	if hold < 0 {
+		hold = 0
+	}
+	if hold > boshMaxHold {
+		hold = boshMaxHold
+	}
+	session := &boshSession{
+		handler:   h,
+		sid:       fmt.Sprintf("%x", randomBytes(16)),
+		rid:       body.rid,
+		wait:      wait,
+		hold:      hold,
+		acks:      body.ack,
+		to:        body.to,
+		lang:      body.lang,
+		version:   body.version,
+		tls:       r.TLS,
+		notify:    make(chan struct{}),
+		early:     make(map[uint64]*boshBody),
+		responses: make(map[uint64][]byte),
+	}
+	session.readable = sync.NewCond(&session.lock)
+	session.inactivity = time.AfterFunc(boshInactivity, session.expire)
+	session.inactivity.Stop()
+	session.in = append(session.in, session.streamHeader()...)
+	session.in = append(session.in, body.payload...)
+
+	h.lock.Lock()
+	h.sessions[session.sid] = session
+	h.lock.Unlock()
+	log.Printf("Accepting BOSH session %v from: %v\n", session.sid, r.RemoteAddr)
+
+	go func() {
+		defer session.Close()
+		h.server.serveClient(session, r.RemoteAddr, func() (*Connection, State) {
+			return newTransportConn(nil, session, MessageTypes), newStateMachine(true, nil)
+		})
+	}()
+	session.respond(w, r, body.rid, true)
+}
+
+// boshSession is the transport of a BOSH session. It outlives the HTTP
+// requests carrying it and is what the state chain reads and writes.
+type boshSession struct {
+	handler *boshHandler
+	sid     string
+	wait    time.Duration
+	hold    int
+	acks    bool
+	// stream header attributes asked for by the client
+	to, lang, version string
+	tls               *tls.ConnectionState
+
+	lock sync.Mutex
+	// rid is the highest request id processed in order, early holds the
+	// requests that arrived ahead of a missing one
+	rid   uint64
+	early map[uint64]*boshBody
+	// in is the stream XML not read yet by the Connection
+	in       []byte
+	readable *sync.Cond
+	// out holds the elements to send with the next response, notify is
+	// closed when elements are added or the session ends
+	out    []string
+	notify chan struct{}
+	// held are the release channels of the requests being held
+	held []chan struct{}
+	// responses keeps the last responses by rid for retransmission
+	responses map[uint64][]byte
+	// from and authid are sent when the session is created
+	from, authid string
+	// terminated is set once the session ended, with condition if that
+	// was not a normal close
+	terminated bool
+	condition  string
+	closed     bool
+	inactivity *time.Timer
+}
+
+// streamHeader returns the stream header the state chain expects from the
+// client, built from what it asked for at session creation
+func (b *boshSession) streamHeader() []byte {
+	header := "<stream:stream xmlns='jabber:client' xmlns:stream='" + NsStream + "'"
+	if b.to != "" {
+		header += " to='" + xmlEscape(b.to) + "'"
+	}
+	if b.version != "" {
+		header += " version='" + xmlEscape(b.version) + "'"
+	}
+	if b.lang != "" {
+		header += " xml:lang='" + xmlEscape(b.lang) + "'"
+	}
+	return []byte(header + ">")
+}
+
+// handle processes a request for an existing session
+func (b *boshSession) handle(w http.ResponseWriter, r *http.Request, body *boshBody) {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		writeBOSH(w, boshTerminate("item-not-found"))
+		return
+	}
+	b.inactivity.Stop()
+	switch {
+	case body.rid <= b.rid:
+		// a retransmission of a request we already answered
+		response, ok := b.responses[body.rid]
+		b.lock.Unlock()
+		if !ok {
+			// still held, the client should not have resent it
+			response = boshResponse("", "")
+		}
+		writeBOSH(w, response)
+		return
+	case body.rid > b.rid+uint64(b.hold)+1:
+		// outside of the window of requests the client may have open
+		b.lock.Unlock()
+		log.Printf("BOSH session %v got rid %v out of its window\n", b.sid, body.rid)
+		writeBOSH(w, boshTerminate("item-not-found"))
+		b.Close()
+		return
+	}
+	b.early[body.rid] = body
+	for next := b.early[b.rid+1]; next != nil; next = b.early[b.rid+1] {
+		delete(b.early, b.rid+1)
+		b.rid++
+		b.receive(next)
+	}
+	b.lock.Unlock()
+	b.respond(w, r, body.rid, false)
+}
+
+// receive turns a request into stream XML for the Connection
+func (b *boshSession) receive(body *boshBody) {
+	b.in = append(b.in, body.payload...)
+	switch {
+	case body.terminate:
+		b.in = append(b.in, "</stream:stream>"...)
+	case body.restart:
+		if body.to != "" {
+			b.to = body.to
+		}
+		if body.lang != "" {
+			b.lang = body.lang
+		}
+		b.in = append(b.in, b.streamHeader()...)
+	}
+	b.readable.Broadcast()
+}
+
+// respond holds the request for rid until there is something to send, it
+// is pushed out by a newer request or the wait time passed
+func (b *boshSession) respond(w http.ResponseWriter, r *http.Request, rid uint64, creation bool) {
+	release := make(chan struct{})
+	b.lock.Lock()
+	// the creation request waits for the stream features whatever the
+	// client asked to hold
+	if !creation {
+		b.held = append(b.held, release)
+		for len(b.held) > b.hold {
+			close(b.held[0])
+			b.held = b.held[1:]
+		}
+	}
+	timer := time.NewTimer(b.wait)
+	defer timer.Stop()
+
+wait:
+	for len(b.out) == 0 && !b.terminated {
+		notify := b.notify
+		b.lock.Unlock()
+		select {
+		case <-notify:
+		case <-release:
+			b.lock.Lock()
+			break wait
+		case <-timer.C:
+			b.lock.Lock()
+			break wait
+		case <-r.Context().Done():
+			// the client gave up, what is queued goes with its next request
+			b.lock.Lock()
+			b.unhold(release)
+			if len(b.held) == 0 && !b.closed {
+				b.inactivity.Reset(boshInactivity)
+			}
+			b.lock.Unlock()
+			return
+		}
+		b.lock.Lock()
+	}
+	b.unhold(release)
+
+	var attrs string
+	if creation {
+		attrs = fmt.Sprintf(" sid='%s' wait='%d' hold='%d' requests='%d' inactivity='%d' polling='%d' ver='1.11' from='%s' authid='%s' xmpp:version='1.0' xmpp:restartlogic='true'",
+			b.sid, b.wait/time.Second, b.hold, b.hold+1, boshInactivity/time.Second, boshPolling/time.Second, xmlEscape(b.from), b.authid)
+		if b.acks {
+			attrs += fmt.Sprintf(" ack='%d'", rid)
+		}
+	} else if b.acks && rid < b.rid {
+		attrs = fmt.Sprintf(" ack='%d'", b.rid)
+	}
+	if b.terminated {
+		attrs += " type='terminate'"
+		if b.condition != "" {
+			attrs += " condition='" + b.condition + "'"
+		}
+	}
+	response := boshResponse(attrs, strings.Join(b.out, ""))
+	b.out = nil
+	b.responses[rid] = response
+	delete(b.responses, rid-uint64(b.hold)-1)
+	if len(b.held) == 0 && !b.closed {
+		b.inactivity.Reset(boshInactivity)
+	}
+	b.lock.Unlock()
+	writeBOSH(w, response)
+}
+
+// unhold removes release from the held requests
+func (b *boshSession) unhold(release chan struct{}) {
+	for i, held := range b.held {
+		if held == release {
+			b.held = append(b.held[:i], b.held[i+1:]...)
+			return
+		}
+	}
+}
+
+// wake tells the held requests that something changed
+func (b *boshSession) wake() {
+	close(b.notify)
+	b.notify = make(chan struct{})
+}
+
+// expire ends a session that saw no request for too long
+func (b *boshSession) expire() {
+	log.Printf("BOSH session %v timed out\n", b.sid)
+	b.Close()
+}
+
+// Read returns the stream XML received from the client
+func (b *boshSession) Read(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	for len(b.in) == 0 && !b.closed {
+		b.readable.Wait()
+	}
+	if len(b.in) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, b.in)
+	b.in = b.in[n:]
+	return n, nil
+}
+
+// Close ends the session and forgets it
+func (b *boshSession) Close() error {
+	b.lock.Lock()
+	if b.closed {
+		b.lock.Unlock()
+		return nil
+	}
+	b.closed = true
+	if !b.terminated {
+		b.terminated = true
+		b.condition = "remote-connection-failed"
+		if b.handler.server.isClosing() {
+			b.condition = "system-shutdown"
+		}
+	}
+	b.inactivity.Stop()
+	b.readable.Broadcast()
+	b.wake()
+	b.lock.Unlock()
+
+	b.handler.lock.Lock()
+	delete(b.handler.sessions, b.sid)
+	b.handler.lock.Unlock()
+	log.Printf("BOSH session %v closed\n", b.sid)
+	return nil
+}
+
+func (b *boshSession) openStream(from, id, lang, version string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	// the session creation response carries the first stream header,
+	// restarts get none
+	b.from, b.authid = from, id
+	return nil
+}
+
+func (b *boshSession) closeStream(final string) error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.out = append(b.out, splitElements([]byte(final))...)
+	if strings.Contains(final, "<stream:error>") {
+		b.condition = "remote-stream-error"
+	}
+	b.terminated = true
+	b.wake()
+	return nil
+}
+
+func (b *boshSession) write(data []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.terminated {
+		return 0, errors.New("bosh: session terminated")
+	}
+	b.out = append(b.out, splitElements(data)...)
+	b.wake()
+	return len(data), nil
+}
+
+func (b *boshSession) tlsState() *tls.ConnectionState {
+	return b.tls
+}
+
+// boshResponse builds a response <body/> with the given attributes
+func boshResponse(attrs, payload string) []byte {
+	return []byte("<body xmlns='" + NsHTTPBind + "' xmlns:xmpp='" + NsXBOSH + "' xmlns:stream='" + NsStream + "'" +
+		attrs + ">" + payload + "</body>")
+}
+
+// boshTerminate builds a response ending a session with condition
+func boshTerminate(condition string) []byte {
+	return boshResponse(" type='terminate' condition='"+condition+"'", "")
+}
+
+// writeBOSH sends a response body
+func writeBOSH(w http.ResponseWriter, response []byte) {
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	n, err := w.Write(response)
+	if err != nil {
+		log.Printf("BOSH Write err: %v\n", err.Error())
+	}
+	log.Printf("BOSH Write data(%v): %s\n", n, response)
+}
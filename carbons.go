@@ -0,0 +1,113 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"log"
+)
+
+const (
+	// NsCarbons XEP-0280 message carbons namespace
+	NsCarbons = "urn:xmpp:carbons:2"
+	// NsForward XEP-0297 stanza forwarding namespace
+	NsForward = "urn:xmpp:forward:0"
+	// NsHints XEP-0334 message processing hints namespace
+	NsHints = "urn:xmpp:hints"
+)
+
+// CarbonCopy is the <received/> or <sent/> envelope of a carbon copy
+type CarbonCopy struct {
+	Forwarded Forwarded
+}
+
+// carbonsQuery is the payload of a carbons enable or disable request
+type carbonsQuery struct {
+	XMLName xml.Name
+}
+
+// handleCarbons answers the requests enabling or disabling message carbons
+// for a session
+func (s *Server) handleCarbons(client *Client, iq *ClientIQ) bool {
+	if iq.Type != "set" || !client.addressesAccount(iq.To) {
+		return false
+	}
+	var query carbonsQuery
+	if err := xml.Unmarshal(iq.Query, &query); err != nil || query.XMLName.Space != NsCarbons {
+		return false
+	}
+	var enable bool
+	switch query.XMLName.Local {
+	case "enable":
+		enable = true
+	case "disable":
+	default:
+		return false
+	}
+
+	table := &s.sessions
+	table.lock.Lock()
+	client.carbons = enable
+	table.lock.Unlock()
+	log.Printf("Carbons for %v: %v\n", client.jid, enable)
+	client.send(&ClientIQ{From: iq.To, To: iq.From, ID: iq.ID, Type: "result"})
+	return true
+}
+
+// carbonEligible reports whether message is copied to the other resources
+// of its sender or recipient (XEP-0280 section 6)
+func carbonEligible(message *ClientMessage) bool {
+	if message.Private != nil || message.NoCopy != nil || message.Received != nil || message.Sent != nil {
+		return false
+	}
+	switch message.Type {
+	case "chat":
+		return true
+	case "", "normal":
+		return message.Body != ""
+	}
+	return false
+}
+
+// carbonSessions returns the sessions of client's account other than
+// client that enabled carbons
+func (s *Server) carbonSessions(client *Client) []*Client {
+	bare := client.jid.Bare()
+	table := &s.sessions
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	var clients []*Client
+	for jid, session := range table.sessions {
+		if session != client && session.carbons && jid.Bare() == bare {
+			clients = append(clients, session)
+		}
+	}
+	return clients
+}
+
+// sendCarbons copies a message sent by client to its other resources
+func (s *Server) sendCarbons(client *Client, message *ClientMessage) {
+	if !carbonEligible(message) {
+		return
+	}
+	for _, session := range s.carbonSessions(client) {
+		carbon := &ClientMessage{From: client.jid.Bare(), To: session.jid, Type: message.Type,
+			Sent: &CarbonCopy{Forwarded{Message: message}}}
+		// sessions copy to each other, so never block on one but keep
+		// the copies in order
+		session.push(carbon)
+	}
+}
+
+// receivedCarbons copies a message delivered to client to its other
+// resources. Only messages addressed to client's full JID are copied: the
+// router delivers those sent to the bare JID to every resource.
+func (s *Server) receivedCarbons(client *Client, stanza interface{}) {
+	message, ok := stanza.(*ClientMessage)
+	if !ok || message.To != client.jid || !carbonEligible(message) {
+		return
+	}
+	for _, session := range s.carbonSessions(client) {
+		carbon := &ClientMessage{From: client.jid.Bare(), To: session.jid, Type: message.Type,
+			Received: &CarbonCopy{Forwarded{Message: message}}}
+		session.push(carbon)
+	}
+}
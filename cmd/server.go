@@ -5,12 +5,20 @@ import (
 
 	"xmpp"
 
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
 	"crypto/tls"
+	"encoding/hex"
 	"flag"
 	"fmt"
-	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 )
 
 const selfXMppServerClient = "selfXmppClient"
@@ -26,7 +34,8 @@ type AdminUser struct {
 type AccountManager struct {
 	AdminUser AdminUser
 	Users     map[string]string
-	Online    map[string]chan<- interface{}
+	Scram     map[string]map[string]*xmpp.ScramKeys
+	Online    map[xmpp.JID]map[xmpp.JID]chan<- interface{} // by bare JID, then full JID
 	lock      *sync.Mutex
 	log       Logger
 }
@@ -38,25 +47,34 @@ func (a AccountManager) Authenticate(username, password string) (success bool, e
 	//a.log.Info(fmt.Sprintf("authenticate: %s", username))
 	log.Printf("[am] >>>> authenticate: %s\n", username)
 
-	if _, ok := a.Users[username]; ok {
-		//a.lock.Lock()
-		//defer a.lock.Unlock()
-		if a.AdminUser.Password == password {
-			//a.log.Debug("auth success")
-			log.Println("[am] >>>> auth success")
-			success = true
-		} else {
-			//a.log.Debug("auth fail")
-			log.Println("[am] >>>> auth fail")
-			success = false
-		}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if stored, ok := a.Users[username]; ok && stored == password {
+		//a.log.Debug("auth success")
+		log.Println("[am] >>>> auth success")
+		success = true
 	} else {
-		log.Println("[am] >>>> new username")
-		success, err = a.CreateAccount(username, password)
+		//a.log.Debug("auth fail")
+		log.Println("[am] >>>> auth fail")
+		success = false
 	}
 	return
 }
+func (a AccountManager) AuthenticateDigest(username, streamID, digest string) (success bool, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	log.Printf("[am] >>>> authenticate digest: %s\n", username)
 
+	password, ok := a.Users[username]
+	if !ok {
+		return false, nil
+	}
+	sum := sha1.Sum([]byte(streamID + password))
+	expected := hex.EncodeToString(sum[:])
+	return subtle.ConstantTimeCompare([]byte(expected), []byte(strings.ToLower(digest))) == 1, nil
+}
 func (a AccountManager) CreateAccount(username, password string) (success bool, err error) {
 	a.lock.Lock()
 	defer a.lock.Unlock()
@@ -68,11 +86,74 @@ func (a AccountManager) CreateAccount(username, password string) (success bool,
 		success = false
 	} else {
 		a.Users[username] = password
+		a.Scram[username] = make(map[string]*xmpp.ScramKeys)
+		for _, mechanism := range []string{"SCRAM-SHA-1", "SCRAM-SHA-256"} {
+			keys, err := xmpp.NewScramKeys(mechanism, password, nil, xmpp.ScramMinIterations)
+			if err != nil {
+				return false, err
+			}
+			a.Scram[username][mechanism] = keys
+		}
 		success = true
 	}
 	return
 }
 
+func (a AccountManager) ChangePassword(username, password string) (success bool, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	log.Printf("[am] >>>> change password: %v\n", username)
+
+	if _, ok := a.Users[username]; !ok {
+		return false, nil
+	}
+	a.Users[username] = password
+	for _, mechanism := range []string{"SCRAM-SHA-1", "SCRAM-SHA-256"} {
+		keys, err := xmpp.NewScramKeys(mechanism, password, nil, xmpp.ScramMinIterations)
+		if err != nil {
+			return false, err
+		}
+		a.Scram[username][mechanism] = keys
+	}
+	return true, nil
+}
+func (a AccountManager) DeleteAccount(username string) (success bool, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	log.Printf("[am] >>>> delete account: %v\n", username)
+
+	if _, ok := a.Users[username]; !ok || username == a.AdminUser.Name {
+		return false, nil
+	}
+	delete(a.Users, username)
+	delete(a.Scram, username)
+	return true, nil
+}
+func (a AccountManager) AccountExists(username string) (exists bool, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	_, exists = a.Users[username]
+	return exists || username == a.AdminUser.Name, nil
+}
+func (a AccountManager) ScramKeys(username, mechanism string) (keys *xmpp.ScramKeys, err error) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	log.Printf("[am] >>>> scram keys: %v %v\n", username, mechanism)
+
+	return a.Scram[username][mechanism], nil
+}
+
+// Authorize lets the admin user act on behalf of any device
+func (a AccountManager) Authorize(authcid, authzid string) (allowed bool, err error) {
+	log.Printf("[am] >>>> authorize: %v as %v\n", authcid, authzid)
+
+	return authcid == a.AdminUser.Name, nil
+}
+
 func (a AccountManager) OnlineRoster(jid string) (online []string, err error) {
 	a.lock.Lock()
 	defer a.lock.Unlock()
@@ -80,20 +161,28 @@ func (a AccountManager) OnlineRoster(jid string) (online []string, err error) {
 	//a.log.Info(fmt.Sprintf("retrieving roster: %s", jid))
 	log.Printf("[am] >>>> retrieving roster: %v\n", jid)
 
-	for person := range a.Online {
-		online = append(online, person)
+	for _, resources := range a.Online {
+		for person := range resources {
+			online = append(online, person.String())
+		}
 	}
 	return
 }
 
-// new WIP func for pressence messages
+// presenceRoutine delivers directed presence, the server itself sends
+// presence broadcasts to subscribed contacts only
 func (a AccountManager) presenceRoutine(bus <-chan xmpp.Message) {
 	for {
 		message := <-bus
 		a.lock.Lock()
 
-		for _, userChannel := range a.Online {
-			userChannel <- message.Data
+		resources := a.Online[message.To.Bare()]
+		if channel, ok := resources[message.To]; ok {
+			channel <- message.Data
+		} else if message.To.IsBare() {
+			for _, channel := range resources {
+				channel <- message.Data
+			}
 		}
 
 		a.lock.Unlock()
@@ -101,40 +190,68 @@ func (a AccountManager) presenceRoutine(bus <-chan xmpp.Message) {
 }
 
 func (a AccountManager) routeRoutine(bus <-chan xmpp.Message) {
-	var channel chan<- interface{}
-	var ok bool
-
 	for {
 		message := <-bus
 		a.lock.Lock()
 
-		if channel, ok = a.Online[message.To]; ok {
+		resources := a.Online[message.To.Bare()]
+		if channel, ok := resources[message.To]; ok {
 			channel <- message.Data
+		} else if message.To.IsBare() || isChat(message.Data) {
+			// messages to the bare JID, and chats to a resource that went
+			// away, go to every resource (RFC 6121 8.5)
+			for _, channel := range resources {
+				channel <- message.Data
+			}
 		}
 
 		a.lock.Unlock()
 	}
 }
 
+// isChat reports whether data is a message of type chat
+func isChat(data interface{}) bool {
+	message, ok := data.(*xmpp.ClientMessage)
+	return ok && message.Type == "chat"
+}
+
 func (a AccountManager) connectRoutine(bus <-chan xmpp.Connect) {
 	for {
 		message := <-bus
 		a.lock.Lock()
 		//a.log.Info(fmt.Sprintf("[am] %s connected", message.Jid))
 		log.Printf("[am] %v connected\n", message.Jid)
-		a.Online[message.Jid] = message.Receiver
+		bare := message.Jid.Bare()
+		if a.Online[bare] == nil {
+			a.Online[bare] = make(map[xmpp.JID]chan<- interface{})
+		}
+		a.Online[bare][message.Jid] = message.Receiver
 		a.lock.Unlock()
 	}
 }
 
-func (a AccountManager) disconnectRoutine(bus <-chan xmpp.Disconnect) {
+func (a AccountManager) disconnectRoutine(bus <-chan xmpp.Disconnect, muc *xmpp.MUCExtension) {
 	for {
 		message := <-bus
 		a.lock.Lock()
 		//a.log.Info(fmt.Sprintf("[am] %s disconnected", message.Jid))
 		log.Printf("[am] %v disconnected\n", message.Jid)
-		delete(a.Online, message.Jid)
+		bare := message.Jid.Bare()
+		delete(a.Online[bare], message.Jid)
+		if len(a.Online[bare]) == 0 {
+			delete(a.Online, bare)
+		}
+		if message.Anonymous {
+			// guests leave nothing behind, the server already dropped
+			// their roster and archive
+			username := message.Jid.Local()
+			delete(a.Users, username)
+			delete(a.Scram, username)
+		}
 		a.lock.Unlock()
+
+		// leave the chat rooms, which needs the router
+		muc.Disconnect(message.Jid)
 	}
 }
 
@@ -151,13 +268,25 @@ func main() {
 
 	portPtr := flag.Int("port", envPort, "port number to listen on")
 	logLevelPtr := flag.Int("loggerLevel", logLevel, "set level logging")
+	anonymousPtr := flag.Bool("anonymous", false, "allow anonymous guest logins")
+	registerPtr := flag.String("register", "closed", "in-band registration: off, closed, open or a comma separated list of localpart patterns")
+	legacyAuthPtr := flag.Bool("legacyauth", false, "allow legacy jabber:iq:auth logins on TLS streams")
+	insecureLegacyAuthPtr := flag.Bool("legacyauth-insecure", false, "also allow legacy jabber:iq:auth logins without TLS")
+	unixPtr := flag.String("unix", "", "also listen on this unix domain socket")
+	directTLSPortPtr := flag.Int("directtls", 0, "also serve direct TLS (XEP-0368) on this port, e.g. 5223")
+	websocketPortPtr := flag.Int("websocket", 0, "also serve XMPP over WebSocket (RFC 7395) on this port at /xmpp-websocket")
+	boshPortPtr := flag.Int("bosh", 0, "also serve XMPP over BOSH (XEP-0206) on this port at /http-bind, may be the -websocket port")
+	archivePtr := flag.String("archive", "", "keep message archives (XEP-0313) in this directory instead of in memory")
+	rostersPtr := flag.String("rosters", "", "keep rosters in this directory instead of in memory")
 	flag.Parse()
 
 	var adminUser = AdminUser{Name: envSelfXmppClient, Password: envSelfXmppClientPassword}
 
 	var registered = make(map[string]string)
 
-	var activeUsers = make(map[string]chan<- interface{})
+	var scramKeys = make(map[string]map[string]*xmpp.ScramKeys)
+
+	var activeUsers = make(map[xmpp.JID]map[xmpp.JID]chan<- interface{})
 
 	var l = Logger{level: logLevelPtr}
 
@@ -166,7 +295,43 @@ func main() {
 	var connectbus = make(chan xmpp.Connect)
 	var disconnectbus = make(chan xmpp.Disconnect)
 
-	var am = AccountManager{AdminUser: adminUser, Users: registered, Online: activeUsers, log: l, lock: &sync.Mutex{}}
+	var am = AccountManager{AdminUser: adminUser, Users: registered, Scram: scramKeys, Online: activeUsers, log: l, lock: &sync.Mutex{}}
+	if _, err := am.CreateAccount(adminUser.Name, adminUser.Password); err != nil {
+		l.Error(fmt.Sprintf("Could not create the admin account: %s", err.Error()))
+		os.Exit(1)
+	}
+
+	var registration xmpp.RegistrationPolicy
+	switch *registerPtr {
+	case "off":
+	case "closed":
+		registration = xmpp.RegistrationClosed
+	case "open":
+		registration = xmpp.RegistrationOpen
+	default:
+		registration = xmpp.RegistrationAllowlist(strings.Split(*registerPtr, ",")...)
+	}
+
+	var archive xmpp.ArchiveStore = xmpp.NewMemoryArchiveStore()
+	if *archivePtr != "" {
+		fileArchive, err := xmpp.NewFileArchiveStore(*archivePtr)
+		if err != nil {
+			l.Error(fmt.Sprintf("Could not open the message archive: %s", err.Error()))
+			os.Exit(1)
+		}
+		archive = fileArchive
+	}
+	var rosters xmpp.RosterStore = xmpp.NewMemoryRosterStore()
+	if *rostersPtr != "" {
+		fileRosters, err := xmpp.NewFileRosterStore(*rostersPtr)
+		if err != nil {
+			l.Error(fmt.Sprintf("Could not open the rosters: %s", err.Error()))
+			os.Exit(1)
+		}
+		rosters = fileRosters
+	}
+
+	muc := &xmpp.MUCExtension{Domain: "conference." + envDomian, MessageBus: messagebus}
 
 	var cert, _ = tls.LoadX509KeyPair("./cert.pem", "./key.pem")
 	var tlsConfig = tls.Config{
@@ -184,16 +349,23 @@ func main() {
 		SkipTLS:    envSkipTLS,
 		Log:        l,
 		Accounts:   am,
+		Rosters:    rosters,
 		ConnectBus: connectbus,
 		Extensions: []xmpp.Extension{
 			&xmpp.DebugExtension{Log: l},
+			&xmpp.MAMExtension{Store: archive},
+			muc,
 			&xmpp.NormalMessageExtension{MessageBus: messagebus},
 			&xmpp.RosterExtension{Accounts: am},
 			&xmpp.PresenceExtension{PresenceBus: presencebus},
 		},
-		DisconnectBus: disconnectbus,
-		Domain:        envDomian,
-		TLSConfig:     &tlsConfig,
+		DisconnectBus:           disconnectbus,
+		Domain:                  envDomian,
+		Registration:            registration,
+		AllowLegacyAuth:         *legacyAuthPtr || *insecureLegacyAuthPtr,
+		AllowInsecureLegacyAuth: *insecureLegacyAuthPtr,
+		Domains:                 map[string]xmpp.DomainConfig{envDomian: {AllowAnonymous: *anonymousPtr}},
+		TLSConfig:               &tlsConfig,
 	}
 
 	// l.Info("Starting server")
@@ -201,30 +373,77 @@ func main() {
 	// l.Info("Listening on localhost:" + fmt.Sprintf("%d", *portPtr))
 	log.Printf("Listening on localhost: %v\n", *portPtr)
 
-	// Listen for incoming connections.
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", *portPtr))
-	if err != nil {
-		l.Error(fmt.Sprintf("Could not listen for connections: %s", err.Error()))
-		os.Exit(1)
-	}
-	defer listener.Close()
-
 	go am.routeRoutine(messagebus)
 	go am.connectRoutine(connectbus)
-	go am.disconnectRoutine(disconnectbus)
+	go am.disconnectRoutine(disconnectbus, muc)
 	go am.presenceRoutine(presencebus)
 
-	// Handle each connection.
-	for {
-		conn, err := listener.Accept()
+	// WebSocket and BOSH share one HTTP server when they use the same port
+	httpServers := make(map[int]*http.Server)
+	mount := func(port int, path string, handler http.Handler) {
+		if port == 0 {
+			return
+		}
+		if httpServers[port] == nil {
+			httpServers[port] = &http.Server{Addr: fmt.Sprintf(":%d", port), Handler: http.NewServeMux()}
+		}
+		httpServers[port].Handler.(*http.ServeMux).Handle(path, handler)
+	}
+	mount(*websocketPortPtr, "/xmpp-websocket", xmppServer.WebSocketHandler())
+	mount(*boshPortPtr, "/http-bind", xmppServer.BOSHHandler())
+
+	// stop accepting and shut the sessions down on SIGINT/SIGTERM
+	stopped := make(chan struct{})
+	go func() {
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
+		log.Println("Shutting down")
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		for _, httpServer := range httpServers {
+			httpServer.Close()
+		}
+		if err := xmppServer.Shutdown(ctx); err != nil {
+			log.Printf("Shutdown: %v\n", err.Error())
+		}
+		close(stopped)
+	}()
 
-		if err != nil {
-			//l.Error(fmt.Sprintf("Could not accept connection: %s", err.Error()))
-			log.Printf("Could not accept connection: %v\n", err.Error())
+	// Listen for incoming connections.
+	addrs := []string{fmt.Sprintf(":%d", *portPtr)}
+	if *unixPtr != "" {
+		addrs = append(addrs, "unix:"+*unixPtr)
+	}
+	errs := make(chan error, len(addrs)+len(httpServers)+1)
+	for _, addr := range addrs {
+		go func(addr string) {
+			errs <- xmppServer.ListenAndServe(addr)
+		}(addr)
+	}
+	listeners := len(addrs)
+	if *directTLSPortPtr != 0 {
+		listeners++
+		go func() {
+			errs <- xmppServer.ListenAndServeWithOptions(fmt.Sprintf(":%d", *directTLSPortPtr), xmpp.ListenerOptions{DirectTLS: true})
+		}()
+	}
+	for _, httpServer := range httpServers {
+		listeners++
+		go func(httpServer *http.Server) {
+			log.Printf("Listening for HTTP connections on %v\n", httpServer.Addr)
+			err := httpServer.ListenAndServe()
+			if err == http.ErrServerClosed {
+				err = xmpp.ErrServerClosed
+			}
+			errs <- err
+		}(httpServer)
+	}
+	for i := 0; i < listeners; i++ {
+		if err := <-errs; err != xmpp.ErrServerClosed {
+			l.Error(fmt.Sprintf("Could not listen for connections: %s", err.Error()))
 			os.Exit(1)
 		}
-
-		//tcp go rountine
-		go xmppServer.TCPAnswer(conn)
 	}
+	<-stopped
 }
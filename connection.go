@@ -1,6 +1,9 @@
 package xmpp
 
 import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/xml"
 	"errors"
 	"fmt"
@@ -11,19 +14,44 @@ import (
 
 // Connection represents a connection to an XMPP server.
 type Connection struct {
+	// Raw is nil for transports spanning several connections, such as BOSH
 	Raw          net.Conn
 	MessageTypes map[xml.Name]reflect.Type
-	out          *xml.Encoder
 	in           *xml.Decoder
+	// transport frames what is sent on Raw and unframes what is read
+	transport transport
+	// certificate presented by the server during the TLS handshake
+	serverCert *x509.Certificate
+	// id of the stream we opened, and whether its header has been sent
+	streamID   string
+	streamOpen bool
+	// language the client asked for in its stream header
+	lang string
+	// preXMPP is set for a stream header without a version, from a client
+	// older than XMPP 1.0 (RFC 6120 4.7.5). Such a stream gets no stream
+	// features and only allows legacy authentication.
+	preXMPP bool
+	// resumed is the detached session the connection took over with
+	// XEP-0198, to be served in place of the client it started with
+	resumed *Client
 }
 
+// ErrStreamClosed is returned by Next when the peer closes its stream with
+// </stream:stream>
+var ErrStreamClosed = errors.New("xmpp: stream closed by peer")
+
 // NewConn creates a Connection struct for a given net.Conn and message system
 func NewConn(raw net.Conn, MessageTypes map[xml.Name]reflect.Type) *Connection {
+	return newTransportConn(raw, tcpTransport{raw}, MessageTypes)
+}
+
+// newTransportConn creates a Connection reading and writing through t
+func newTransportConn(raw net.Conn, t transport, MessageTypes map[xml.Name]reflect.Type) *Connection {
 	conn := &Connection{
 		Raw:          raw,
 		MessageTypes: MessageTypes,
-		in:           xml.NewDecoder(raw),
-		out:          xml.NewEncoder(raw),
+		in:           xml.NewDecoder(t),
+		transport:    t,
 	}
 	return conn
 }
@@ -39,6 +67,10 @@ func (c *Connection) Next() (xml.StartElement, error) {
 		switch token := nextToken.(type) {
 		case xml.StartElement:
 			return token, nil
+		case xml.EndElement:
+			// stanzas are consumed whole by Read, so this is the end of
+			// the stream itself
+			return xml.StartElement{}, ErrStreamClosed
 		}
 	}
 }
@@ -51,17 +83,53 @@ func (c *Connection) Read(se xml.StartElement) (xml.Name, interface{}, error) {
 	if messageType, present := c.MessageTypes[se.Name]; present {
 		messageInterface = reflect.New(messageType).Interface()
 	} else {
+		// skip the element so the stream stays in sync
+		c.in.Skip()
 		return xml.Name{}, nil, errors.New("Unknown XMPP message " + se.Name.Space + " <" + se.Name.Local + "/>")
 	}
 
-	// Unmarshal into that storage.
-	if err := c.in.DecodeElement(messageInterface, &se); err != nil {
+	// Read the whole element before unmarshalling it, so that one that
+	// does not decode, e.g. with a malformed address, is still consumed
+	// up to its end tag and the stream stays in sync.
+	var raw struct {
+		Inner []byte `xml:",innerxml"`
+	}
+	if err := c.in.DecodeElement(&raw, &se); err != nil {
 		return xml.Name{}, nil, err
 	}
+	if err := xml.Unmarshal(standaloneElement(se, raw.Inner), messageInterface); err != nil {
+		return se.Name, nil, err
+	}
 
 	return se.Name, messageInterface, nil
 }
 
+// standaloneElement rebuilds the element se with content inner as a
+// document of its own, declaring the namespaces it got from the stream
+func standaloneElement(se xml.StartElement, inner []byte) []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "<%s xmlns='%s'", se.Name.Local, xmlEscape(se.Name.Space))
+	for i, attr := range se.Attr {
+		value := xmlEscape(attr.Value)
+		switch attr.Name.Space {
+		case "":
+			if attr.Name.Local != "xmlns" {
+				fmt.Fprintf(&b, " %s='%s'", attr.Name.Local, value)
+			}
+		case "xmlns":
+			fmt.Fprintf(&b, " xmlns:%s='%s'", attr.Name.Local, value)
+		case xmlNamespace:
+			fmt.Fprintf(&b, " xml:%s='%s'", attr.Name.Local, value)
+		default:
+			fmt.Fprintf(&b, " xmlns:a%d='%s' a%d:%s='%s'", i, xmlEscape(attr.Name.Space), i, attr.Name.Local, value)
+		}
+	}
+	b.WriteString(">")
+	b.Write(inner)
+	fmt.Fprintf(&b, "</%s>", se.Name.Local)
+	return b.Bytes()
+}
+
 // SendStanza XML encodes the interface and sends it across the connection
 func (c *Connection) SendStanza(s interface{}) error {
 	data, err := xml.Marshal(s)
@@ -71,7 +139,7 @@ func (c *Connection) SendStanza(s interface{}) error {
 	}
 
 	var n int
-	n, err = c.Raw.Write(data)
+	n, err = c.transport.write(data)
 	if err != nil {
 		log.Printf("SendStanza Write err: %v\n", err.Error())
 	}
@@ -81,7 +149,7 @@ func (c *Connection) SendStanza(s interface{}) error {
 
 // SendRaw sends the string across the connection
 func (c *Connection) SendRaw(s string) error {
-	n, err := c.Raw.Write([]byte(s))
+	n, err := c.transport.write([]byte(s))
 	if err != nil {
 		log.Printf("SendRaw Write err: %v\n", err.Error())
 	}
@@ -91,10 +159,15 @@ func (c *Connection) SendRaw(s string) error {
 
 // SendRawf formats and sends a string across the connection
 func (c *Connection) SendRawf(format string, a ...interface{}) error {
-	n, err := fmt.Fprintf(c.Raw, format, a...)
+	n, err := c.transport.write([]byte(fmt.Sprintf(format, a...)))
 	if err != nil {
 		log.Printf("SendRawf Write err: %v\n", err.Error())
 	}
 	log.Printf("SendRawf Write data(%v): %v\n", n, a)
 	return err
 }
+
+// tlsState returns the TLS state of the connection, or nil without TLS
+func (c *Connection) tlsState() *tls.ConnectionState {
+	return c.transport.tlsState()
+}
@@ -4,7 +4,6 @@ import (
 	"encoding/xml"
 	"fmt"
 	"log"
-	"strings"
 )
 
 // Extension interface for processing normal messages
@@ -12,6 +11,20 @@ type Extension interface {
 	Process(message interface{}, from *Client)
 }
 
+// IQHandler can be implemented by an Extension that answers IQ requests.
+// HandleIQ is called for IQs instead of Process and reports whether the
+// extension answered iq; requests that no IQHandler answered get a
+// <service-unavailable/> error.
+type IQHandler interface {
+	HandleIQ(iq *ClientIQ, from *Client) bool
+}
+
+// accountExtension is an Extension that keeps data of its own for
+// accounts, which goes away with the account
+type accountExtension interface {
+	deleteAccount(owner JID)
+}
+
 // DebugExtension just dumps data
 type DebugExtension struct {
 	Log Logging
@@ -32,51 +45,44 @@ type NormalMessageExtension struct {
 func (e *NormalMessageExtension) Process(message interface{}, from *Client) {
 	parsed, ok := message.(*ClientMessage)
 	if ok {
+		// the server stamps the sender's address (RFC 6120 8.1.2.1)
+		parsed.From = from.jid
 		e.MessageBus <- Message{To: parsed.To, Data: message}
 	}
 }
 
-// RosterExtension handles ClientIQ presence requests and updates
+// RosterExtension answers session establishment and ping requests. Rosters
+// themselves are managed by the Server, see Server.Rosters.
 type RosterExtension struct {
 	Accounts AccountManager
 }
 
-// Process responds to Presence requests from a client
+// Process responds to session and ping requests from a client
 func (e *RosterExtension) Process(message interface{}, from *Client) {
 	parsed, ok := message.(*ClientIQ)
-
-	// handle things we need to handle
-	if ok {
-		log.Printf("query: %v", string(parsed.Query))
-	} else {
+	if !ok {
 		log.Println("no query")
 		return
 	}
+	e.HandleIQ(parsed, from)
+}
 
-	if string(parsed.Query) == "<query xmlns='jabber:iq:roster'/>" {
-		// respond with roster
-		roster, _ := e.Accounts.OnlineRoster(from.jid)
-		msg := "<iq id='" + parsed.ID + "' to='" + parsed.From + "' type='result'><query xmlns='jabber:iq:roster' ver='ver7'>"
-		for _, v := range roster {
-			msg = msg + "<item jid='" + v + "'/>"
-		}
-		msg = msg + "</query></iq>"
-
-		// respond to client
-		from.messages <- msg
-	}
+// HandleIQ answers session and ping requests
+func (e *RosterExtension) HandleIQ(parsed *ClientIQ, from *Client) bool {
+	log.Printf("query: %v", string(parsed.Query))
 
 	if parsed.Type == "set" && (string(parsed.Query) == "<session xmlns=\"urn:ietf:params:xml:ns:xmpp-session\"/>" ||
 		string(parsed.Query) == "<session xmlns='urn:ietf:params:xml:ns:xmpp-session'/>") {
 		//<iq xml:lang='en' to='00155d-stb-bsp123123126@xmpp-demo.kaonmedia.com/XMPPConn1' from='00155d-stb-bsp123123126@xmpp-demo.kaonmedia.com' type='result' id='_xmpp_session1'/>
-		ids := strings.Split(from.jid, "/")
-		msg := "<iq xml:lang='en' to='" + from.jid + "' from='" + ids[0] + "' type='result' id='_xmpp_session1'/>"
-		from.messages <- msg
+		msg := "<iq xml:lang='en' to='" + from.jid.String() + "' from='" + from.jid.Bare().String() + "' type='result' id='_xmpp_session1'/>"
+		from.send(msg)
+		return true
 	}
 
 	if parsed.Type == "get" && (string(parsed.Query) == "<ping xmlns=\"urn:xmpp:ping\"/>") {
-		msg := fmt.Sprintf("<iq from='%v' to='%v' id='c2s1' type='result'/>", parsed.To, parsed.From)
-		from.messages <- msg
+		msg := fmt.Sprintf("<iq from='%v' to='%v' id='%s' type='result'/>", parsed.To, from.jid, parsed.ID)
+		from.send(msg)
+		return true
 	}
 
 	if string(parsed.Query) == "<error type='wait'><resource-constraint/></error>" ||
@@ -92,40 +98,23 @@ func (e *RosterExtension) Process(message interface{}, from *Client) {
 		// 	}
 		// }()
 	}
+	return false
 }
 
-// PresenceExtension handles ClientIQ presence requests and updates
+// PresenceExtension puts directed presence on the PresenceBus, to be
+// delivered to its To address. Subscriptions and presence broadcasts are
+// handled by the Server itself (RFC 6121).
 type PresenceExtension struct {
 	PresenceBus chan<- Message
 }
 
-// Process responds to Presence message from a client
+// Process routes a directed presence from a client
 func (e *PresenceExtension) Process(message interface{}, from *Client) {
 	parsed, ok := message.(*ClientPresence)
 	if ok {
 		log.Printf("presence: %v", parsed)
 		log.Printf("delay: %v", parsed.Delay)
-		// this is how you reply to a message: from.messages <- message
-
-		// types:
-		// subscribe
-		// subscribed
-		// unsubscribed
-
-		// 1) check request and remove Resource
-
-		// 2) put request on the presence bus
-		// 3) put roster push on message bus
-		// or
-		// auto reply with 'subscribed' if invite in other direction
-
-		// compose the presence message (from) put on a channel that
-		// the server will then push to the message chan for all other clients
-		// difficult to - alert the 'to' field of the message
-
-		// if i receive a presense message from the client, put it on the presence
-		// bus for broadcasting to subscribers/peers
-		// server should alter message
+		parsed.From = from.jid
 		e.PresenceBus <- Message{To: parsed.To, Data: message}
 	} else {
 		log.Println("no presence")
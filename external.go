@@ -0,0 +1,145 @@
+package xmpp
+
+import (
+	"crypto/x509"
+	"encoding/asn1"
+	"errors"
+	"strings"
+)
+
+var (
+	oidSubjectAltName = asn1.ObjectIdentifier{2, 5, 29, 17}
+	// id-on-xmppAddr, RFC 6120 section 13.7.1.4
+	oidXMPPAddr = asn1.ObjectIdentifier{1, 3, 6, 1, 5, 5, 7, 8, 5}
+)
+
+// CertificateMapper maps a verified TLS client certificate to the localpart
+// of the account it authenticates with SASL EXTERNAL (XEP-0178). domain is
+// the domain the client is connecting to.
+type CertificateMapper interface {
+	MapCertificate(cert *x509.Certificate, domain string) (localpart string, err error)
+}
+
+// CertificateMapperFunc adapts a function to the CertificateMapper interface
+type CertificateMapperFunc func(cert *x509.Certificate, domain string) (string, error)
+
+// MapCertificate calls f(cert, domain)
+func (f CertificateMapperFunc) MapCertificate(cert *x509.Certificate, domain string) (string, error) {
+	return f(cert, domain)
+}
+
+var (
+	// MapCertificateXMPPAddr uses the localpart of the first subjectAltName
+	// xmppAddr whose domain matches
+	MapCertificateXMPPAddr = CertificateMapperFunc(func(cert *x509.Certificate, domain string) (string, error) {
+		addrs, err := certificateXMPPAddrs(cert)
+		if err != nil {
+			return "", err
+		}
+		for _, addr := range addrs {
+			at := strings.Index(addr, "@")
+			if at > 0 && strings.EqualFold(addr[at+1:], domain) {
+				return addr[:at], nil
+			}
+		}
+		return "", errors.New("no xmppAddr for " + domain)
+	})
+
+	// MapCertificateCommonName uses the subject common name as the localpart
+	MapCertificateCommonName = CertificateMapperFunc(func(cert *x509.Certificate, domain string) (string, error) {
+		if cert.Subject.CommonName == "" {
+			return "", errors.New("certificate has no common name")
+		}
+		return cert.Subject.CommonName, nil
+	})
+
+	// MapCertificateSerial uses the hex encoded serial number as the localpart
+	MapCertificateSerial = CertificateMapperFunc(func(cert *x509.Certificate, domain string) (string, error) {
+		if cert.SerialNumber == nil {
+			return "", errors.New("certificate has no serial number")
+		}
+		return cert.SerialNumber.Text(16), nil
+	})
+)
+
+// certificateXMPPAddrs returns the id-on-xmppAddr otherNames of cert
+func certificateXMPPAddrs(cert *x509.Certificate) ([]string, error) {
+	var addrs []string
+	for _, ext := range cert.Extensions {
+		if !ext.Id.Equal(oidSubjectAltName) {
+			continue
+		}
+		var names asn1.RawValue
+		if _, err := asn1.Unmarshal(ext.Value, &names); err != nil {
+			return nil, err
+		}
+		rest := names.Bytes
+		for len(rest) > 0 {
+			var name asn1.RawValue
+			var err error
+			if rest, err = asn1.Unmarshal(rest, &name); err != nil {
+				return nil, err
+			}
+			// otherName [0]
+			if name.Class != asn1.ClassContextSpecific || name.Tag != 0 {
+				continue
+			}
+			var other struct {
+				TypeID asn1.ObjectIdentifier
+				Value  string `asn1:"explicit,tag:0,utf8"`
+			}
+			if _, err := asn1.UnmarshalWithParams(name.FullBytes, &other, "tag:0"); err != nil {
+				continue
+			}
+			if other.TypeID.Equal(oidXMPPAddr) {
+				addrs = append(addrs, other.Value)
+			}
+		}
+	}
+	return addrs, nil
+}
+
+// clientCertificate returns the client certificate if one was presented and
+// verified during the TLS handshake
+func (c *Connection) clientCertificate() *x509.Certificate {
+	state := c.tlsState()
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
+}
+
+// externalMechanism implements SASL EXTERNAL with TLS client certificates
+type externalMechanism struct {
+	conn     *Connection
+	client   *Client
+	server   *Server
+	username string
+}
+
+// Next maps the certificate and checks the optional authorization identity
+func (m *externalMechanism) Next(response []byte) ([]byte, bool, error) {
+	cert := m.conn.clientCertificate()
+	if cert == nil {
+		return nil, false, errSASLNotAuthorized
+	}
+	mapped, err := m.server.CertificateMapper.MapCertificate(cert, m.client.jid.Domain())
+	if err != nil {
+		return nil, false, errSASLNotAuthorized
+	}
+	authcid, ok := saslLocalpart(mapped, m.client.jid.Domain())
+	if !ok {
+		return nil, false, errSASLNotAuthorized
+	}
+	username, err := saslAuthorize(m.server, m.client, authcid, string(response))
+	if err != nil {
+		return nil, false, err
+	}
+	m.username = username
+	return nil, true, nil
+}
+
+// Username returns the localpart the client acts as
+func (m *externalMechanism) Username() string {
+	return m.username
+}
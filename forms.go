@@ -0,0 +1,62 @@
+package xmpp
+
+import "encoding/xml"
+
+// NsDataForms XEP-0004 data forms namespace
+const NsDataForms = "jabber:x:data"
+
+// DataForm is a XEP-0004 data form
+type DataForm struct {
+	XMLName      xml.Name    `xml:"jabber:x:data x"`
+	Type         string      `xml:"type,attr"` // cancel, form, result, submit
+	Title        string      `xml:"title,omitempty"`
+	Instructions []string    `xml:"instructions,omitempty"`
+	Fields       []FormField `xml:"field"`
+}
+
+// FormField is a single field of a DataForm
+type FormField struct {
+	Var   string `xml:"var,attr,omitempty"`
+	Type  string `xml:"type,attr,omitempty"` // boolean, fixed, hidden, jid-multi, jid-single, list-multi, list-single, text-multi, text-private, text-single
+	Label string `xml:"label,attr,omitempty"`
+
+	Desc     string       `xml:"desc,omitempty"`
+	Required *struct{}    `xml:"required"`
+	Values   []string     `xml:"value"`
+	Options  []FormOption `xml:"option"`
+}
+
+// FormOption is one choice of a list field
+type FormOption struct {
+	Label string `xml:"label,attr,omitempty"`
+	Value string `xml:"value"`
+}
+
+// Field returns the field named name, or nil
+func (f *DataForm) Field(name string) *FormField {
+	for i := range f.Fields {
+		if f.Fields[i].Var == name {
+			return &f.Fields[i]
+		}
+	}
+	return nil
+}
+
+// Value returns the first value of the field named name
+func (f *DataForm) Value(name string) string {
+	field := f.Field(name)
+	if field == nil || len(field.Values) == 0 {
+		return ""
+	}
+	return field.Values[0]
+}
+
+// FormType returns the value of the hidden FORM_TYPE field (XEP-0068)
+func (f *DataForm) FormType() string {
+	return f.Value("FORM_TYPE")
+}
+
+// HiddenFormType returns the FORM_TYPE field for namespace
+func HiddenFormType(namespace string) FormField {
+	return FormField{Var: "FORM_TYPE", Type: "hidden", Values: []string{namespace}}
+}
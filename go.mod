@@ -1,3 +1,8 @@
 module xmpp
 
 go 1.19
+
+require (
+	golang.org/x/net v0.17.0
+	golang.org/x/text v0.14.0
+)
@@ -0,0 +1,223 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"net"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/idna"
+	"golang.org/x/text/secure/precis"
+)
+
+// maxJIDPart is the longest allowed localpart, domainpart or resourcepart in
+// bytes (RFC 7622 section 3)
+const maxJIDPart = 1023
+
+// idnaProfile converts domainparts to their normalized U-label form
+var idnaProfile = idna.New(idna.MapForLookup(), idna.BidiRule(), idna.Transitional(false))
+
+// JID is an XMPP address as defined in RFC 7622. JIDs are always stored in
+// normalized form, so two JIDs for the same entity compare equal with ==
+// and can be used as map keys. The zero value is the empty address.
+type JID struct {
+	local    string
+	domain   string
+	resource string
+}
+
+// ParseJID parses and normalizes a string of the form
+// [localpart@]domainpart[/resourcepart]
+func ParseJID(s string) (JID, error) {
+	var local, resource string
+	domain := s
+	if slash := strings.Index(domain, "/"); slash >= 0 {
+		resource = domain[slash+1:]
+		domain = domain[:slash]
+		if resource == "" {
+			return JID{}, errors.New("jid: empty resourcepart")
+		}
+	}
+	if at := strings.Index(domain, "@"); at >= 0 {
+		local = domain[:at]
+		domain = domain[at+1:]
+		if local == "" {
+			return JID{}, errors.New("jid: empty localpart")
+		}
+	}
+	return NewJID(local, domain, resource)
+}
+
+// NewJID builds a JID from its parts, validating and normalizing each of
+// them. local and resource may be empty.
+func NewJID(local, domain, resource string) (JID, error) {
+	var err error
+	if local != "" {
+		if local, err = normalizeLocalpart(local); err != nil {
+			return JID{}, err
+		}
+	}
+	if domain, err = normalizeDomainpart(domain); err != nil {
+		return JID{}, err
+	}
+	if resource != "" {
+		if resource, err = normalizeResourcepart(resource); err != nil {
+			return JID{}, err
+		}
+	}
+	return JID{local: local, domain: domain, resource: resource}, nil
+}
+
+// normalizeLocalpart applies the UsernameCaseMapped profile (RFC 7622 3.3)
+func normalizeLocalpart(local string) (string, error) {
+	if !utf8.ValidString(local) {
+		return "", errors.New("jid: localpart is not valid UTF-8")
+	}
+	local, err := precis.UsernameCaseMapped.String(local)
+	if err != nil {
+		return "", errors.New("jid: invalid localpart: " + err.Error())
+	}
+	if len(local) == 0 || len(local) > maxJIDPart {
+		return "", errors.New("jid: localpart has invalid length")
+	}
+	if strings.ContainsAny(local, "\"&'/:<>@") {
+		return "", errors.New("jid: localpart contains a disallowed character")
+	}
+	return local, nil
+}
+
+// normalizeDomainpart converts the domain to lowercase U-labels (RFC 7622
+// 3.2), keeping IP literals as they are
+func normalizeDomainpart(domain string) (string, error) {
+	domain = strings.TrimSuffix(domain, ".")
+	if domain == "" || len(domain) > maxJIDPart {
+		return "", errors.New("jid: domainpart has invalid length")
+	}
+	if strings.HasPrefix(domain, "[") && strings.HasSuffix(domain, "]") {
+		ip := net.ParseIP(domain[1 : len(domain)-1])
+		if ip == nil || ip.To4() != nil {
+			return "", errors.New("jid: invalid IPv6 literal")
+		}
+		return "[" + ip.String() + "]", nil
+	}
+	if ip := net.ParseIP(domain); ip != nil {
+		return ip.String(), nil
+	}
+	domain, err := idnaProfile.ToUnicode(domain)
+	if err != nil {
+		return "", errors.New("jid: invalid domainpart: " + err.Error())
+	}
+	return domain, nil
+}
+
+// normalizeResourcepart applies the OpaqueString profile (RFC 7622 3.4)
+func normalizeResourcepart(resource string) (string, error) {
+	if !utf8.ValidString(resource) {
+		return "", errors.New("jid: resourcepart is not valid UTF-8")
+	}
+	resource, err := precis.OpaqueString.String(resource)
+	if err != nil {
+		return "", errors.New("jid: invalid resourcepart: " + err.Error())
+	}
+	if len(resource) == 0 || len(resource) > maxJIDPart {
+		return "", errors.New("jid: resourcepart has invalid length")
+	}
+	return resource, nil
+}
+
+// Local returns the localpart
+func (j JID) Local() string {
+	return j.local
+}
+
+// Domain returns the domainpart
+func (j JID) Domain() string {
+	return j.domain
+}
+
+// Resource returns the resourcepart
+func (j JID) Resource() string {
+	return j.resource
+}
+
+// Bare returns the JID without its resourcepart
+func (j JID) Bare() JID {
+	return JID{local: j.local, domain: j.domain}
+}
+
+// IsBare reports whether the JID has no resourcepart
+func (j JID) IsBare() bool {
+	return j.resource == ""
+}
+
+// IsZero reports whether the JID is empty
+func (j JID) IsZero() bool {
+	return j == JID{}
+}
+
+// WithResource returns a full JID with the given resourcepart
+func (j JID) WithResource(resource string) (JID, error) {
+	if resource == "" {
+		return j.Bare(), nil
+	}
+	resource, err := normalizeResourcepart(resource)
+	if err != nil {
+		return JID{}, err
+	}
+	return JID{local: j.local, domain: j.domain, resource: resource}, nil
+}
+
+// String returns the JID in its [localpart@]domainpart[/resourcepart] form
+func (j JID) String() string {
+	s := j.domain
+	if j.local != "" {
+		s = j.local + "@" + s
+	}
+	if j.resource != "" {
+		s = s + "/" + j.resource
+	}
+	return s
+}
+
+// MarshalText encodes the JID for use as XML character data
+func (j JID) MarshalText() ([]byte, error) {
+	return []byte(j.String()), nil
+}
+
+// MalformedJIDError is returned when an address in XML is not a valid JID
+type MalformedJIDError struct {
+	JID string
+	Err error
+}
+
+func (e *MalformedJIDError) Error() string {
+	return e.Err.Error() + ": " + e.JID
+}
+
+// UnmarshalText parses XML character data into the JID
+func (j *JID) UnmarshalText(text []byte) error {
+	if len(text) == 0 {
+		*j = JID{}
+		return nil
+	}
+	jid, err := ParseJID(string(text))
+	if err != nil {
+		return &MalformedJIDError{JID: string(text), Err: err}
+	}
+	*j = jid
+	return nil
+}
+
+// MarshalXMLAttr encodes the JID as an attribute, omitting empty JIDs
+func (j JID) MarshalXMLAttr(name xml.Name) (xml.Attr, error) {
+	if j.IsZero() {
+		return xml.Attr{}, nil
+	}
+	return xml.Attr{Name: name, Value: j.String()}, nil
+}
+
+// UnmarshalXMLAttr parses an attribute into the JID
+func (j *JID) UnmarshalXMLAttr(attr xml.Attr) error {
+	return j.UnmarshalText([]byte(attr.Value))
+}
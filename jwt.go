@@ -0,0 +1,157 @@
+package xmpp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+)
+
+// JWTValidator is a TokenValidator for JSON Web Tokens (RFC 7519) signed
+// with HS256, RS256 or ES256 using locally configured keys.
+type JWTValidator struct {
+	// Keys maps a key id (the "kid" header) to its key. The key stored
+	// under "" is used for tokens without a kid. A []byte key verifies
+	// HS256, an *rsa.PublicKey RS256 and an *ecdsa.PublicKey ES256.
+	Keys map[string]interface{}
+
+	// Audience, if set, must appear in the token's "aud" claim
+	Audience string
+	// Issuer, if set, must equal the token's "iss" claim
+	Issuer string
+	// UsernameClaim names the claim holding the username, "sub" by default
+	UsernameClaim string
+	// Leeway allowed when checking "exp" and "nbf"
+	Leeway time.Duration
+}
+
+// ValidateToken verifies the signature and claims of a compact JWT
+func (v *JWTValidator) ValidateToken(token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return "", errors.New("jwt: malformed token")
+	}
+
+	var header struct {
+		Alg string `json:"alg"`
+		Kid string `json:"kid"`
+	}
+	if err := jwtDecodeSegment(parts[0], &header); err != nil {
+		return "", err
+	}
+	key, ok := v.Keys[header.Kid]
+	if !ok {
+		return "", errors.New("jwt: unknown key " + header.Kid)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.New("jwt: malformed signature")
+	}
+	if err := jwtVerify(header.Alg, key, []byte(parts[0]+"."+parts[1]), signature); err != nil {
+		return "", err
+	}
+
+	var claims map[string]interface{}
+	if err := jwtDecodeSegment(parts[1], &claims); err != nil {
+		return "", err
+	}
+	now := time.Now()
+	if exp, ok := claims["exp"].(float64); ok && now.After(time.Unix(int64(exp), 0).Add(v.Leeway)) {
+		return "", errors.New("jwt: token expired")
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.Leeway).Before(time.Unix(int64(nbf), 0)) {
+		return "", errors.New("jwt: token not valid yet")
+	}
+	if v.Issuer != "" && claims["iss"] != v.Issuer {
+		return "", errors.New("jwt: wrong issuer")
+	}
+	if v.Audience != "" && !jwtHasAudience(claims["aud"], v.Audience) {
+		return "", errors.New("jwt: wrong audience")
+	}
+
+	claim := v.UsernameClaim
+	if claim == "" {
+		claim = "sub"
+	}
+	username, _ := claims[claim].(string)
+	if username == "" {
+		return "", fmt.Errorf("jwt: missing %s claim", claim)
+	}
+	return username, nil
+}
+
+// jwtDecodeSegment decodes a base64url JSON segment into v
+func jwtDecodeSegment(segment string, v interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return errors.New("jwt: malformed segment")
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return errors.New("jwt: malformed segment")
+	}
+	return nil
+}
+
+// jwtVerify checks signature against the signing input. The algorithm has to
+// match the key type so a token cannot pick a weaker check.
+func jwtVerify(alg string, key interface{}, input, signature []byte) error {
+	digest := sha256.Sum256(input)
+	switch k := key.(type) {
+	case []byte:
+		if alg != "HS256" {
+			break
+		}
+		mac := hmac.New(sha256.New, k)
+		mac.Write(input)
+		if !hmac.Equal(mac.Sum(nil), signature) {
+			return errors.New("jwt: invalid signature")
+		}
+		return nil
+	case *rsa.PublicKey:
+		if alg != "RS256" {
+			break
+		}
+		if err := rsa.VerifyPKCS1v15(k, crypto.SHA256, digest[:], signature); err != nil {
+			return errors.New("jwt: invalid signature")
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		if alg != "ES256" {
+			break
+		}
+		if len(signature) != 64 {
+			return errors.New("jwt: invalid signature")
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(k, digest[:], r, s) {
+			return errors.New("jwt: invalid signature")
+		}
+		return nil
+	}
+	return errors.New("jwt: algorithm " + alg + " does not match key")
+}
+
+// jwtHasAudience reports whether the aud claim, a string or an array of
+// strings, contains audience
+func jwtHasAudience(aud interface{}, audience string) bool {
+	switch a := aud.(type) {
+	case string:
+		return a == audience
+	case []interface{}:
+		for _, v := range a {
+			if v == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,148 @@
+package xmpp
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"strings"
+	"testing"
+	"time"
+)
+
+// jwtTestToken encodes header and claims and signs them with sign
+func jwtTestToken(t *testing.T, header, claims map[string]interface{}, sign func(input []byte) []byte) string {
+	t.Helper()
+	var segments []string
+	for _, part := range []map[string]interface{}{header, claims} {
+		data, err := json.Marshal(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments = append(segments, base64.RawURLEncoding.EncodeToString(data))
+	}
+	input := segments[0] + "." + segments[1]
+	return input + "." + base64.RawURLEncoding.EncodeToString(sign([]byte(input)))
+}
+
+func TestJWTValidator(t *testing.T) {
+	secret := []byte("secret")
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v := &JWTValidator{
+		Keys: map[string]interface{}{
+			"":    secret,
+			"rsa": &rsaKey.PublicKey,
+			"ec":  &ecKey.PublicKey,
+		},
+		Audience: "xmpp",
+		Issuer:   "https://auth.example.com",
+		Leeway:   time.Minute,
+	}
+
+	hs256 := func(key []byte) func([]byte) []byte {
+		return func(input []byte) []byte {
+			mac := hmac.New(sha256.New, key)
+			mac.Write(input)
+			return mac.Sum(nil)
+		}
+	}
+	rs256 := func(input []byte) []byte {
+		digest := sha256.Sum256(input)
+		signature, err := rsa.SignPKCS1v15(rand.Reader, rsaKey, crypto.SHA256, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		return signature
+	}
+	es256 := func(input []byte) []byte {
+		digest := sha256.Sum256(input)
+		r, s, err := ecdsa.Sign(rand.Reader, ecKey, digest[:])
+		if err != nil {
+			t.Fatal(err)
+		}
+		signature := make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+		return signature
+	}
+	unsigned := func(input []byte) []byte { return nil }
+
+	now := time.Now().Unix()
+	claims := func(changes map[string]interface{}) map[string]interface{} {
+		c := map[string]interface{}{
+			"sub": "alice",
+			"iss": "https://auth.example.com",
+			"aud": "xmpp",
+			"exp": now + 3600,
+		}
+		for name, value := range changes {
+			if value == nil {
+				delete(c, name)
+			} else {
+				c[name] = value
+			}
+		}
+		return c
+	}
+	hs := map[string]interface{}{"alg": "HS256"}
+	// the claims of one token with the signature of another
+	signed := strings.Split(jwtTestToken(t, hs, claims(nil), hs256(secret)), ".")
+	changed := strings.Split(jwtTestToken(t, hs, claims(map[string]interface{}{"sub": "admin"}), unsigned), ".")
+	tampered := signed[0] + "." + changed[1] + "." + signed[2]
+
+	tests := []struct {
+		name     string
+		token    string
+		username string
+		err      string
+	}{
+		{"HS256", jwtTestToken(t, hs, claims(nil), hs256(secret)), "alice", ""},
+		{"RS256", jwtTestToken(t, map[string]interface{}{"alg": "RS256", "kid": "rsa"}, claims(nil), rs256), "alice", ""},
+		{"ES256", jwtTestToken(t, map[string]interface{}{"alg": "ES256", "kid": "ec"}, claims(nil), es256), "alice", ""},
+		{"audience in a list", jwtTestToken(t, hs, claims(map[string]interface{}{"aud": []string{"web", "xmpp"}}), hs256(secret)), "alice", ""},
+		{"expired within the leeway", jwtTestToken(t, hs, claims(map[string]interface{}{"exp": now - 30}), hs256(secret)), "alice", ""},
+		{"alg none", jwtTestToken(t, map[string]interface{}{"alg": "none"}, claims(nil), unsigned), "", "jwt: algorithm none does not match key"},
+		{"alg none with a kid", jwtTestToken(t, map[string]interface{}{"alg": "none", "kid": "rsa"}, claims(nil), unsigned), "", "jwt: algorithm none does not match key"},
+		{"HS256 with the RSA key", jwtTestToken(t, map[string]interface{}{"alg": "HS256", "kid": "rsa"}, claims(nil), hs256(rsaKey.PublicKey.N.Bytes())), "", "jwt: algorithm HS256 does not match key"},
+		{"changed claims", tampered, "", "jwt: invalid signature"},
+		{"wrong secret", jwtTestToken(t, hs, claims(nil), hs256([]byte("guess"))), "", "jwt: invalid signature"},
+		{"unknown key", jwtTestToken(t, map[string]interface{}{"alg": "HS256", "kid": "other"}, claims(nil), hs256(secret)), "", "jwt: unknown key other"},
+		{"expired", jwtTestToken(t, hs, claims(map[string]interface{}{"exp": now - 3600}), hs256(secret)), "", "jwt: token expired"},
+		{"not valid yet", jwtTestToken(t, hs, claims(map[string]interface{}{"nbf": now + 3600}), hs256(secret)), "", "jwt: token not valid yet"},
+		{"wrong issuer", jwtTestToken(t, hs, claims(map[string]interface{}{"iss": "https://evil.example.com"}), hs256(secret)), "", "jwt: wrong issuer"},
+		{"no issuer", jwtTestToken(t, hs, claims(map[string]interface{}{"iss": nil}), hs256(secret)), "", "jwt: wrong issuer"},
+		{"wrong audience", jwtTestToken(t, hs, claims(map[string]interface{}{"aud": "web"}), hs256(secret)), "", "jwt: wrong audience"},
+		{"audience not in the list", jwtTestToken(t, hs, claims(map[string]interface{}{"aud": []string{"web"}}), hs256(secret)), "", "jwt: wrong audience"},
+		{"no subject", jwtTestToken(t, hs, claims(map[string]interface{}{"sub": nil}), hs256(secret)), "", "jwt: missing sub claim"},
+		{"malformed", "header.claims", "", "jwt: malformed token"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			username, err := v.ValidateToken(test.token)
+			if test.err != "" {
+				if err == nil || err.Error() != test.err {
+					t.Fatalf("error %v, want %v", err, test.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if username != test.username {
+				t.Errorf("username %v, want %v", username, test.username)
+			}
+		})
+	}
+}
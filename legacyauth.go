@@ -0,0 +1,127 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"log"
+)
+
+// NsIQAuthFeature XEP-0078 stream feature namespace
+const NsIQAuthFeature = "http://jabber.org/features/iq-auth"
+
+// DigestAuthenticator can be implemented by an AccountManager to support
+// the digest method of legacy authentication, which needs the plaintext
+// password: digest is hex(SHA1(streamID + password)).
+type DigestAuthenticator interface {
+	AuthenticateDigest(username, streamID, digest string) (success bool, err error)
+}
+
+// legacyOutcome is the result of handling a jabber:iq:auth request
+type legacyOutcome int
+
+const (
+	// legacyIgnored means the IQ was not a legacy auth request
+	legacyIgnored legacyOutcome = iota
+	// legacyAnswered means a request was answered without logging in
+	legacyAnswered
+	// legacyFailed means the credentials were wrong
+	legacyFailed
+	// legacyBound means the client is authenticated and bound
+	legacyBound
+)
+
+// legacyAuthAllowed reports whether legacy authentication may be used on c
+func legacyAuthAllowed(c *Connection, s *Server) bool {
+	if !s.AllowLegacyAuth {
+		return false
+	}
+	if c.tlsState() != nil {
+		return true
+	}
+	return s.AllowInsecureLegacyAuth
+}
+
+// legacyAuthFeature returns the legacy auth stream feature, if offered
+func legacyAuthFeature(c *Connection, s *Server) string {
+	if !legacyAuthAllowed(c, s) {
+		return ""
+	}
+	return "<auth xmlns='" + NsIQAuthFeature + "'/>"
+}
+
+// legacyAuth answers a jabber:iq:auth request (XEP-0078). A successful set
+// authenticates the client and binds its resource in one step.
+func (s *Server) legacyAuth(c *Connection, client *Client, iq *ClientIQ) legacyOutcome {
+	var query IQQuery
+	if err := xml.Unmarshal(iq.Query, &query); err != nil {
+		return legacyIgnored
+	}
+	if !legacyAuthAllowed(c, s) {
+		c.SendStanza(ErrorReply(iq, StanzaServiceUnavailable("")))
+		return legacyAnswered
+	}
+	_, digestOK := s.Accounts.(DigestAuthenticator)
+
+	switch iq.Type {
+	case "get":
+		empty := ""
+		fields := IQQuery{Username: query.Username, Password: &empty, Resource: &empty}
+		if fields.Username == nil {
+			fields.Username = &empty
+		}
+		if digestOK {
+			fields.Digest = &empty
+		}
+		result := &ClientIQ{ID: iq.ID, Type: "result"}
+		result.Query, _ = xml.Marshal(fields)
+		c.SendStanza(result)
+		return legacyAnswered
+	case "set":
+	default:
+		return legacyIgnored
+	}
+
+	if query.Username == nil || query.Resource == nil || *query.Resource == "" ||
+		(query.Password == nil && query.Digest == nil) {
+		c.SendStanza(ErrorReply(iq, StanzaNotAcceptable("username, resource and password or digest are required")))
+		return legacyAnswered
+	}
+	localpart, ok := saslLocalpart(*query.Username, client.jid.Domain())
+	if !ok {
+		c.SendStanza(ErrorReply(iq, StanzaNotAuthorized("")))
+		return legacyFailed
+	}
+
+	var success bool
+	var err error
+	if query.Digest != nil && digestOK {
+		success, err = s.Accounts.(DigestAuthenticator).AuthenticateDigest(localpart, c.streamID, *query.Digest)
+	} else if query.Password != nil {
+		success, err = s.Accounts.Authenticate(localpart, *query.Password)
+	}
+	if err != nil || !success {
+		log.Printf("Legacy auth failed for %v\n", localpart)
+		c.SendStanza(ErrorReply(iq, StanzaNotAuthorized("")))
+		return legacyFailed
+	}
+
+	jid, err := NewJID(localpart, client.jid.Domain(), "")
+	if err != nil {
+		c.SendStanza(ErrorReply(iq, StanzaNotAuthorized("")))
+		return legacyFailed
+	}
+	client.jid = jid
+	err = s.bindResource(client, *query.Resource)
+	if err != nil {
+		client.jid = JID{domain: jid.domain}
+		if err == errResourceConflict {
+			c.SendStanza(ErrorReply(iq, StanzaConflict("")))
+		} else {
+			c.SendStanza(ErrorReply(iq, StanzaNotAcceptable(err.Error())))
+		}
+		return legacyAnswered
+	}
+	log.Printf("Legacy auth bound %v\n", client.jid)
+	c.SendStanza(&ClientIQ{ID: iq.ID, Type: "result"})
+	s.ConnectBus <- Connect{Jid: client.jid, Receiver: client.messages, Anonymous: client.anonymous}
+	return legacyBound
+}
@@ -0,0 +1,347 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"time"
+)
+
+const (
+	// NsMAM XEP-0313 message archive management namespace
+	NsMAM = "urn:xmpp:mam:2"
+	// NsRSM XEP-0059 result set management namespace
+	NsRSM = "http://jabber.org/protocol/rsm"
+	// NsStanzaID XEP-0359 unique and stable stanza ids namespace
+	NsStanzaID = "urn:xmpp:sid:0"
+)
+
+// StanzaID element
+type StanzaID struct {
+	XMLName xml.Name `xml:"urn:xmpp:sid:0 stanza-id"`
+	ID      string   `xml:"id,attr"`
+	By      JID      `xml:"by,attr"`
+}
+
+// rsmSet is a XEP-0059 result set request or response
+type rsmSet struct {
+	XMLName xml.Name  `xml:"http://jabber.org/protocol/rsm set"`
+	Max     *int      `xml:"max"`
+	After   *string   `xml:"after"`
+	Before  *string   `xml:"before"`
+	Count   *int      `xml:"count"`
+	First   *rsmFirst `xml:"first"`
+	Last    *string   `xml:"last"`
+}
+
+// rsmFirst is the first id of a result set
+type rsmFirst struct {
+	Index int    `xml:"index,attr"`
+	ID    string `xml:",chardata"`
+}
+
+// mamQuery is an archive query
+type mamQuery struct {
+	XMLName xml.Name  `xml:"urn:xmpp:mam:2 query"`
+	QueryID string    `xml:"queryid,attr,omitempty"`
+	Form    *DataForm `xml:"x"`
+	Set     *rsmSet   `xml:"set"`
+}
+
+// mamResult carries one archived message of a query
+type mamResult struct {
+	XMLName   xml.Name  `xml:"urn:xmpp:mam:2 result"`
+	QueryID   string    `xml:"queryid,attr,omitempty"`
+	ID        string    `xml:"id,attr"`
+	Forwarded Forwarded `xml:"forwarded"`
+}
+
+// mamFin ends the results of a query
+type mamFin struct {
+	XMLName  xml.Name `xml:"urn:xmpp:mam:2 fin"`
+	Complete bool     `xml:"complete,attr,omitempty"`
+	Set      rsmSet   `xml:"set"`
+}
+
+// mamPrefs are the archiving preferences of a user
+type mamPrefs struct {
+	XMLName xml.Name `xml:"urn:xmpp:mam:2 prefs"`
+	Default string   `xml:"default,attr"`
+	Always  jidList  `xml:"always"`
+	Never   jidList  `xml:"never"`
+}
+
+// jidList is a list of <jid/> elements
+type jidList struct {
+	JIDs []JID `xml:"jid"`
+}
+
+// mamResultMessage is the message wrapping a mamResult
+type mamResultMessage struct {
+	XMLName xml.Name  `xml:"jabber:client message"`
+	To      JID       `xml:"to,attr"`
+	ID      string    `xml:"id,attr"`
+	Result  mamResult `xml:"result"`
+}
+
+// MAMExtension archives the chat messages users send to each other and
+// answers XEP-0313 archive queries. It has to come before
+// NormalMessageExtension in Server.Extensions, so that messages are
+// stamped with their stanza-id before they are routed.
+type MAMExtension struct {
+	Store ArchiveStore
+}
+
+// Process archives messages and handles urn:xmpp:mam:2 requests
+func (e *MAMExtension) Process(message interface{}, from *Client) {
+	switch v := message.(type) {
+	case *ClientMessage:
+		e.archive(v, from)
+	case *ClientIQ:
+		e.HandleIQ(v, from)
+	}
+}
+
+// deleteAccount deletes the archive of an account that is going away
+func (e *MAMExtension) deleteAccount(owner JID) {
+	if err := e.Store.DeleteArchive(owner); err != nil {
+		log.Printf("Could not delete the archive of %v: %v\n", owner, err.Error())
+	}
+}
+
+// archivable reports whether message belongs in the archives
+func archivable(message *ClientMessage) bool {
+	if message.NoStore != nil || message.Body == "" {
+		return false
+	}
+	switch message.Type {
+	case "", "normal", "chat":
+		return true
+	}
+	return false
+}
+
+// archive stores message in the archives of its sender and, if the
+// recipient is on the same domain, of its recipient
+func (e *MAMExtension) archive(message *ClientMessage, from *Client) {
+	sender, recipient := from.jid.Bare(), message.To.Bare()
+	// stanza-ids from clients cannot be trusted (XEP-0359 section 4)
+	var ids []StanzaID
+	for _, id := range message.StanzaIDs {
+		if id.By != sender && id.By != recipient {
+			ids = append(ids, id)
+		}
+	}
+	message.StanzaIDs = ids
+	if !archivable(message) || message.To.IsZero() {
+		return
+	}
+
+	// archive a copy, the message itself is changed below and routed
+	stored := *message
+	id := fmt.Sprintf("%x", randomBytes(12))
+	now := time.Now().UTC()
+	if e.wants(from.server.rosters(), sender, recipient) {
+		entry := ArchivedMessage{ID: id, With: message.To, Time: now, Message: &stored}
+		if err := e.Store.Append(sender, entry); err != nil {
+			log.Printf("Could not archive message for %v: %v\n", sender, err.Error())
+		}
+	}
+	if recipient.Domain() == sender.Domain() && recipient.Local() != "" && e.wants(from.server.rosters(), recipient, sender) {
+		entry := ArchivedMessage{ID: id, With: from.jid, Time: now, Message: &stored}
+		if err := e.Store.Append(recipient, entry); err != nil {
+			log.Printf("Could not archive message for %v: %v\n", recipient, err.Error())
+			return
+		}
+		message.StanzaIDs = append(message.StanzaIDs, StanzaID{ID: id, By: recipient})
+	}
+}
+
+// wants reports whether owner's preferences archive messages with with,
+// looking up the "roster" default in rosters
+func (e *MAMExtension) wants(rosters RosterStore, owner, with JID) bool {
+	prefs, err := e.Store.Preferences(owner)
+	if err != nil {
+		log.Printf("Could not read archive preferences of %v: %v\n", owner, err.Error())
+		return false
+	}
+	with = with.Bare()
+	for _, jid := range prefs.Never {
+		if jid == with {
+			return false
+		}
+	}
+	for _, jid := range prefs.Always {
+		if jid == with {
+			return true
+		}
+	}
+	switch prefs.Default {
+	case "always":
+		return true
+	case "roster":
+		item, err := rosters.Item(owner, with)
+		return err == nil && item != nil && !item.Hidden
+	}
+	return false
+}
+
+// HandleIQ answers archive queries and preference requests
+func (e *MAMExtension) HandleIQ(iq *ClientIQ, from *Client) bool {
+	if (iq.Type != "get" && iq.Type != "set") || !from.addressesAccount(iq.To) {
+		return false
+	}
+	var payload struct {
+		XMLName xml.Name
+	}
+	if err := xml.Unmarshal(iq.Query, &payload); err != nil || payload.XMLName.Space != NsMAM {
+		return false
+	}
+	log.Printf("MAM request from %v: %v %v\n", from.jid, iq.Type, payload.XMLName.Local)
+
+	switch {
+	case payload.XMLName.Local == "prefs":
+		e.handlePrefs(iq, from)
+	case payload.XMLName.Local == "query" && iq.Type == "get":
+		from.send(mamReply(iq, &mamQuery{Form: mamForm()}))
+	case payload.XMLName.Local == "query":
+		e.handleQuery(iq, from)
+	default:
+		from.replyError(iq, StanzaFeatureNotImplemented(""))
+	}
+	return true
+}
+
+// mamForm describes the fields archive queries can filter on
+func mamForm() *DataForm {
+	return &DataForm{
+		Type: "form",
+		Fields: []FormField{
+			HiddenFormType(NsMAM),
+			{Var: "with", Type: "jid-single"},
+			{Var: "start", Type: "text-single"},
+			{Var: "end", Type: "text-single"},
+		},
+	}
+}
+
+// handleQuery sends a page of the user's archive followed by the result
+func (e *MAMExtension) handleQuery(iq *ClientIQ, from *Client) {
+	var request mamQuery
+	if err := xml.Unmarshal(iq.Query, &request); err != nil {
+		from.replyError(iq, StanzaBadRequest(""))
+		return
+	}
+	query, err := archiveQuery(&request)
+	if err != nil {
+		from.replyError(iq, StanzaBadRequest(err.Error()))
+		return
+	}
+	page, err := e.Store.Query(from.jid.Bare(), query)
+	if err == ErrArchiveItemNotFound {
+		from.replyError(iq, StanzaItemNotFound(""))
+		return
+	}
+	if err != nil {
+		log.Printf("Archive query for %v failed: %v\n", from.jid, err.Error())
+		from.replyError(iq, StanzaInternalServerError(""))
+		return
+	}
+
+	for _, archived := range page.Messages {
+		from.send(&mamResultMessage{To: from.jid, ID: fmt.Sprintf("%x", randomBytes(8)), Result: mamResult{
+			QueryID: request.QueryID,
+			ID:      archived.ID,
+			Forwarded: Forwarded{
+				Delay:   &Delay{Stamp: archived.Time.Format(time.RFC3339)},
+				Message: archived.Message,
+			},
+		}})
+	}
+	fin := &mamFin{Complete: page.Complete, Set: rsmSet{Count: &page.Count}}
+	if len(page.Messages) > 0 {
+		fin.Set.First = &rsmFirst{Index: page.Index, ID: page.Messages[0].ID}
+		fin.Set.Last = &page.Messages[len(page.Messages)-1].ID
+	}
+	from.send(mamReply(iq, fin))
+}
+
+// archiveQuery converts the form and result set of a request into an
+// ArchiveQuery
+func archiveQuery(request *mamQuery) (ArchiveQuery, error) {
+	var query ArchiveQuery
+	var err error
+	if form := request.Form; form != nil {
+		if with := form.Value("with"); with != "" {
+			if query.With, err = ParseJID(with); err != nil {
+				return query, fmt.Errorf("invalid with: %v", err)
+			}
+		}
+		if start := form.Value("start"); start != "" {
+			if query.Start, err = time.Parse(time.RFC3339, start); err != nil {
+				return query, fmt.Errorf("invalid start: %v", err)
+			}
+		}
+		if end := form.Value("end"); end != "" {
+			if query.End, err = time.Parse(time.RFC3339, end); err != nil {
+				return query, fmt.Errorf("invalid end: %v", err)
+			}
+		}
+	}
+	if set := request.Set; set != nil {
+		if set.Max != nil {
+			query.Max = *set.Max
+		}
+		if set.After != nil {
+			query.After = *set.After
+		}
+		if set.Before != nil {
+			query.Before = *set.Before
+			query.LastPage = *set.Before == ""
+		}
+	}
+	return query, nil
+}
+
+// handlePrefs returns or updates the user's archiving preferences
+func (e *MAMExtension) handlePrefs(iq *ClientIQ, from *Client) {
+	owner := from.jid.Bare()
+	if iq.Type == "set" {
+		var request mamPrefs
+		if err := xml.Unmarshal(iq.Query, &request); err != nil {
+			from.replyError(iq, StanzaBadRequest(""))
+			return
+		}
+		switch request.Default {
+		case "always", "never", "roster":
+		default:
+			from.replyError(iq, StanzaBadRequest("default must be always, never or roster"))
+			return
+		}
+		prefs := ArchivePrefs{Default: request.Default}
+		for _, jid := range request.Always.JIDs {
+			prefs.Always = append(prefs.Always, jid.Bare())
+		}
+		for _, jid := range request.Never.JIDs {
+			prefs.Never = append(prefs.Never, jid.Bare())
+		}
+		if err := e.Store.SetPreferences(owner, prefs); err != nil {
+			log.Printf("Could not store archive preferences of %v: %v\n", owner, err.Error())
+			from.replyError(iq, StanzaInternalServerError(""))
+			return
+		}
+	}
+	prefs, err := e.Store.Preferences(owner)
+	if err != nil {
+		from.replyError(iq, StanzaInternalServerError(""))
+		return
+	}
+	from.send(mamReply(iq, &mamPrefs{Default: prefs.Default, Always: jidList{prefs.Always}, Never: jidList{prefs.Never}}))
+}
+
+// mamReply builds the result to iq carrying payload
+func mamReply(iq *ClientIQ, payload interface{}) *ClientIQ {
+	result := &ClientIQ{From: iq.To, To: iq.From, ID: iq.ID, Type: "result"}
+	result.Query, _ = xml.Marshal(payload)
+	return result
+}
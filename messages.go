@@ -8,6 +8,10 @@ import (
 const (
 	// NsStream stream namesapce
 	NsStream = "http://etherx.jabber.org/streams"
+	// NsStreams stream error condition namespace
+	NsStreams = "urn:ietf:params:xml:ns:xmpp-streams"
+	// NsStanzas stanza error condition namespace
+	NsStanzas = "urn:ietf:params:xml:ns:xmpp-stanzas"
 	// NsTLS xmpp-tls xml namespace
 	NsTLS = "urn:ietf:params:xml:ns:xmpp-tls"
 	// NsSASL xmpp-sasl xml namespace
@@ -20,6 +24,10 @@ const (
 	NsClient = "jabber:client"
 	// NsAuth jabbet auth namespace
 	NsIQAuth = "jabber:iq:auth"
+	// NsSM XEP-0198 stream management namespace
+	NsSM = "urn:xmpp:sm:3"
+	// NsRoster roster management namespace
+	NsRoster = "jabber:iq:roster"
 )
 
 // RFC 3920  C.1  Streams name space
@@ -29,6 +37,8 @@ type StreamError struct {
 	XMLName xml.Name `xml:"http://etherx.jabber.org/streams error"`
 	Any     xml.Name `xml:",any"`
 	Text    string   `xml:"text"`
+	// Host is the alternate host of a see-other-host error
+	Host string `xml:"-"`
 }
 
 // RFC 3920  C.3  TLS name space
@@ -53,6 +63,85 @@ type saslAuth struct {
 	Body      string   `xml:",chardata"`
 }
 
+// saslChallenge element
+type saslChallenge struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl challenge"`
+	Body    string   `xml:",chardata"`
+}
+
+// saslResponse element
+type saslResponse struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl response"`
+	Body    string   `xml:",chardata"`
+}
+
+// saslAbort element
+type saslAbort struct {
+	XMLName xml.Name `xml:"urn:ietf:params:xml:ns:xmpp-sasl abort"`
+}
+
+// XEP-0440: SASL Channel-Binding Type Capability
+
+// saslChannelBinding element
+type saslChannelBinding struct {
+	XMLName        xml.Name                 `xml:"urn:xmpp:sasl-cb:0 sasl-channel-binding"`
+	ChannelBinding []saslChannelBindingType `xml:"channel-binding"`
+}
+
+// saslChannelBindingType element
+type saslChannelBindingType struct {
+	Type string `xml:"type,attr"`
+}
+
+// XEP-0198  Stream Management
+
+// smEnable element
+type smEnable struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 enable"`
+	Resume  bool     `xml:"resume,attr"`
+	Max     int      `xml:"max,attr"`
+}
+
+// smEnabled element
+type smEnabled struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 enabled"`
+	ID      string   `xml:"id,attr,omitempty"`
+	Resume  bool     `xml:"resume,attr,omitempty"`
+	Max     int      `xml:"max,attr,omitempty"`
+}
+
+// smRequest element
+type smRequest struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 r"`
+}
+
+// smAnswer element
+type smAnswer struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 a"`
+	H       uint32   `xml:"h,attr"`
+}
+
+// smResume element
+type smResume struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 resume"`
+	PrevID  string   `xml:"previd,attr"`
+	H       uint32   `xml:"h,attr"`
+}
+
+// smResumed element
+type smResumed struct {
+	XMLName xml.Name `xml:"urn:xmpp:sm:3 resumed"`
+	PrevID  string   `xml:"previd,attr"`
+	H       uint32   `xml:"h,attr"`
+}
+
+// smFailed element
+type smFailed struct {
+	XMLName   xml.Name `xml:"urn:xmpp:sm:3 failed"`
+	H         *uint32  `xml:"h,attr"`
+	Condition string   `xml:",innerxml"`
+}
+
 // RFC 3920  C.5  Resource binding name space
 
 // bindBind element
@@ -67,28 +156,52 @@ type bindBind struct {
 // Delay element
 type Delay struct {
 	XMLName xml.Name `xml:"urn:xmpp:delay delay"`
-	From    string   `xml:"from,attr,omitempty"`
+	From    JID      `xml:"from,attr,omitempty"`
 	Stamp   string   `xml:"stamp,attr"`
 
 	Body string `xml:",chardata"`
 }
 
+// XEP-0297: Stanza Forwarding
+
+// Forwarded element
+type Forwarded struct {
+	XMLName xml.Name       `xml:"urn:xmpp:forward:0 forwarded"`
+	Delay   *Delay         `xml:"delay,omitempty"`
+	Message *ClientMessage `xml:"message"`
+}
+
 // RFC 3921  B.1  jabber:client
 
 // ClientMessage element
 type ClientMessage struct {
 	XMLName xml.Name `xml:"jabber:client message"`
-	From    string   `xml:"from,attr"`
+	From    JID      `xml:"from,attr"`
 	ID      string   `xml:"id,attr"`
-	To      string   `xml:"to,attr"`
+	To      JID      `xml:"to,attr"`
 	Type    string   `xml:"type,attr"` // chat, error, groupchat, headline, or normal
 
 	// These should technically be []clientText,
 	// but string is much more convenient.
-	Subject string `xml:"subject"`
-	Body    string `xml:"body"`
-	Thread  string `xml:"thread"`
+	Subject string `xml:"subject,omitempty"`
+	Body    string `xml:"body,omitempty"`
+	Thread  string `xml:"thread,omitempty"`
 	Delay   *Delay `xml:"delay,omitempty"`
+
+	Error *ClientError `xml:"error"`
+
+	// XEP-0280 message carbons and XEP-0334 hints
+	Received *CarbonCopy `xml:"urn:xmpp:carbons:2 received"`
+	Sent     *CarbonCopy `xml:"urn:xmpp:carbons:2 sent"`
+	Private  *struct{}   `xml:"urn:xmpp:carbons:2 private"`
+	NoCopy   *struct{}   `xml:"urn:xmpp:hints no-copy"`
+	NoStore  *struct{}   `xml:"urn:xmpp:hints no-store"`
+
+	// XEP-0359 ids assigned by archives
+	StanzaIDs []StanzaID `xml:"stanza-id"`
+
+	// XEP-0045 invitations and status codes
+	MUCUser *MUCUser `xml:"http://jabber.org/protocol/muc#user x"`
 }
 
 // ClientText element
@@ -100,9 +213,9 @@ type ClientText struct {
 // ClientPresence element
 type ClientPresence struct {
 	XMLName xml.Name `xml:"jabber:client presence"`
-	From    string   `xml:"from,attr,omitempty"`
+	From    JID      `xml:"from,attr,omitempty"`
 	ID      string   `xml:"id,attr,omitempty"`
-	To      string   `xml:"to,attr,omitempty"`
+	To      JID      `xml:"to,attr,omitempty"`
 	Type    string   `xml:"type,attr,omitempty"` // error, probe, subscribe, subscribed, unavailable, unsubscribe, unsubscribed
 	Lang    string   `xml:"lang,attr,omitempty"`
 
@@ -111,7 +224,11 @@ type ClientPresence struct {
 	Priority string       `xml:"priority,omitempty"`
 	Caps     *ClientCaps  `xml:"c"`
 	Error    *ClientError `xml:"error"`
-	Delay    Delay        `xml:"delay"`
+	Delay    *Delay       `xml:"delay,omitempty"`
+
+	// XEP-0045 room join request and occupant information
+	MUC     *MUCJoin `xml:"http://jabber.org/protocol/muc x"`
+	MUCUser *MUCUser `xml:"http://jabber.org/protocol/muc#user x"`
 }
 
 // ClientCaps element
@@ -125,14 +242,14 @@ type ClientCaps struct {
 
 // ClientIQ element
 type ClientIQ struct { // info/query
-	XMLName xml.Name    `xml:"jabber:client iq"`
-	From    string      `xml:"from,attr"`
-	ID      string      `xml:"id,attr"`
-	To      string      `xml:"to,attr"`
-	Type    string      `xml:"type,attr"` // error, get, result, set
-	Error   ClientError `xml:"error"`
-	Bind    bindBind    `xml:"bind"`
-	Query   []byte      `xml:",innerxml"`
+	XMLName xml.Name     `xml:"jabber:client iq"`
+	From    JID          `xml:"from,attr"`
+	ID      string       `xml:"id,attr"`
+	To      JID          `xml:"to,attr"`
+	Type    string       `xml:"type,attr"` // error, get, result, set
+	Error   *ClientError `xml:"error"`
+	Bind    *bindBind    `xml:"bind"`
+	Query   []byte       `xml:",innerxml"`
 	// RosterRequest - better detection of iq's
 }
 
@@ -141,41 +258,51 @@ type ClientError struct {
 	XMLName xml.Name `xml:"jabber:client error"`
 	Code    string   `xml:"code,attr"`
 	Type    string   `xml:"type,attr"`
+	By      JID      `xml:"by,attr"`
 	Any     xml.Name `xml:",any"`
 	Text    string   `xml:"text"`
+	// URI is the new address carried by gone and redirect conditions
+	URI string `xml:"-"`
 }
 
 // Roster element
 type Roster struct {
 	XMLName xml.Name      `xml:"jabber:iq:roster query"`
+	Ver     string        `xml:"ver,attr,omitempty"`
 	Item    []RosterEntry `xml:"item"`
 }
 
 // RosterEntry element
 type RosterEntry struct {
-	Jid          string   `xml:"jid,attr"`
-	Subscription string   `xml:"subscription,attr"`
-	Name         string   `xml:"name,attr"`
+	Jid          JID      `xml:"jid,attr"`
+	Subscription string   `xml:"subscription,attr,omitempty"`
+	Ask          string   `xml:"ask,attr,omitempty"`
+	Name         string   `xml:"name,attr,omitempty"`
 	Group        []string `xml:"group"`
 }
 
 // RosterRequest is used to request that the server update the user's roster.
-// See RFC 6121, section 2.3.
+// See RFC 6121, section 2.3. A valid request has exactly one item.
 type RosterRequest struct {
-	XMLName xml.Name          `xml:"jabber:iq:roster query"`
-	Item    RosterRequestItem `xml:"item"`
+	XMLName xml.Name            `xml:"jabber:iq:roster query"`
+	Item    []RosterRequestItem `xml:"item"`
 }
 
 // RosterRequestItem element
 type RosterRequestItem struct {
-	Jid          string   `xml:"jid,attr"`
+	Jid          JID      `xml:"jid,attr"`
 	Subscription string   `xml:"subscription,attr"`
 	Name         string   `xml:"name,attr"`
 	Group        []string `xml:"group"`
 }
 
+// IQQuery is the XEP-0078 legacy authentication query
 type IQQuery struct {
-	XMLName xml.Name `xml:"jabber:iq:auth query"`
+	XMLName  xml.Name `xml:"jabber:iq:auth query"`
+	Username *string  `xml:"username"`
+	Password *string  `xml:"password"`
+	Digest   *string  `xml:"digest"`
+	Resource *string  `xml:"resource"`
 }
 
 // MessageTypes map of known message types
@@ -184,12 +311,17 @@ var MessageTypes = map[xml.Name]reflect.Type{
 	{Space: NsTLS, Local: "failure"}:     reflect.TypeOf(tlsFailure{}),
 	{Space: NsSASL, Local: "auth"}:       reflect.TypeOf(saslAuth{}),
 	{Space: NsSASL, Local: "mechanisms"}: reflect.TypeOf(saslMechanisms{}),
-	{Space: NsSASL, Local: "challenge"}:  reflect.TypeOf(""),
-	{Space: NsSASL, Local: "response"}:   reflect.TypeOf(""),
+	{Space: NsSASL, Local: "challenge"}:  reflect.TypeOf(saslChallenge{}),
+	{Space: NsSASL, Local: "response"}:   reflect.TypeOf(saslResponse{}),
+	{Space: NsSASL, Local: "abort"}:      reflect.TypeOf(saslAbort{}),
 	{Space: NsBind, Local: "bind"}:       reflect.TypeOf(bindBind{}),
 	{Space: NsClient, Local: "message"}:  reflect.TypeOf(ClientMessage{}),
 	{Space: NsClient, Local: "presence"}: reflect.TypeOf(ClientPresence{}),
 	{Space: NsClient, Local: "iq"}:       reflect.TypeOf(ClientIQ{}),
 	{Space: NsClient, Local: "error"}:    reflect.TypeOf(ClientError{}),
 	{Space: NsIQAuth, Local: "query"}:    reflect.TypeOf(IQQuery{}),
+	{Space: NsSM, Local: "enable"}:       reflect.TypeOf(smEnable{}),
+	{Space: NsSM, Local: "r"}:            reflect.TypeOf(smRequest{}),
+	{Space: NsSM, Local: "a"}:            reflect.TypeOf(smAnswer{}),
+	{Space: NsSM, Local: "resume"}:       reflect.TypeOf(smResume{}),
 }
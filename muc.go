@@ -0,0 +1,699 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// NsMUC XEP-0045 multi-user chat namespace
+	NsMUC = "http://jabber.org/protocol/muc"
+	// NsMUCUser XEP-0045 occupant namespace
+	NsMUCUser = "http://jabber.org/protocol/muc#user"
+	// NsMUCAdmin XEP-0045 moderation namespace
+	NsMUCAdmin = "http://jabber.org/protocol/muc#admin"
+	// NsMUCOwner XEP-0045 room owner namespace
+	NsMUCOwner = "http://jabber.org/protocol/muc#owner"
+	// NsMUCRoomConfig XEP-0045 room configuration form type
+	NsMUCRoomConfig = "http://jabber.org/protocol/muc#roomconfig"
+	// NsDiscoInfo XEP-0030 service discovery namespace
+	NsDiscoInfo = "http://jabber.org/protocol/disco#info"
+)
+
+// defaultMUCHistory is the number of messages a room keeps for new
+// occupants unless configured otherwise
+const defaultMUCHistory = 20
+
+// XEP-0045 status codes
+const (
+	mucStatusNonAnonymous = 100
+	mucStatusSelf         = 110
+	mucStatusCreated      = 201
+	mucStatusBanned       = 301
+	mucStatusNickChanged  = 303
+	mucStatusKicked       = 307
+	mucStatusNotMember    = 321
+)
+
+// affiliation and role ranks, higher is more privileged
+var (
+	mucAffiliations = map[string]int{"outcast": 0, "none": 1, "member": 2, "admin": 3, "owner": 4}
+	mucRoles        = map[string]int{"none": 0, "visitor": 1, "participant": 2, "moderator": 3}
+)
+
+// MUCJoin is the <x/> element of a presence joining a room
+type MUCJoin struct {
+	XMLName  xml.Name    `xml:"http://jabber.org/protocol/muc x"`
+	Password string      `xml:"password,omitempty"`
+	History  *MUCHistory `xml:"history"`
+}
+
+// MUCHistory limits the discussion history sent on join
+type MUCHistory struct {
+	MaxStanzas *int   `xml:"maxstanzas,attr"`
+	Seconds    *int   `xml:"seconds,attr"`
+	Since      string `xml:"since,attr,omitempty"`
+}
+
+// MUCUser carries occupant information, status codes and invitations
+type MUCUser struct {
+	XMLName  xml.Name    `xml:"http://jabber.org/protocol/muc#user x"`
+	Items    []MUCItem   `xml:"item"`
+	Statuses []MUCStatus `xml:"status"`
+	Invite   *MUCInvite  `xml:"invite"`
+	Destroy  *MUCDestroy `xml:"destroy"`
+	Password string      `xml:"password,omitempty"`
+}
+
+// MUCItem describes an occupant or an affiliated user
+type MUCItem struct {
+	Affiliation string `xml:"affiliation,attr,omitempty"`
+	Role        string `xml:"role,attr,omitempty"`
+	JID         JID    `xml:"jid,attr"`
+	Nick        string `xml:"nick,attr,omitempty"`
+	Reason      string `xml:"reason,omitempty"`
+}
+
+// MUCStatus is a XEP-0045 status code
+type MUCStatus struct {
+	Code int `xml:"code,attr"`
+}
+
+// MUCInvite is a mediated invitation
+type MUCInvite struct {
+	From   JID    `xml:"from,attr"`
+	To     JID    `xml:"to,attr"`
+	Reason string `xml:"reason,omitempty"`
+}
+
+// MUCDestroy tells occupants that a room was destroyed
+type MUCDestroy struct {
+	JID    JID    `xml:"jid,attr"`
+	Reason string `xml:"reason,omitempty"`
+}
+
+// mucSubject is the subject message, which is sent even when empty
+type mucSubject struct {
+	XMLName xml.Name `xml:"jabber:client message"`
+	From    JID      `xml:"from,attr"`
+	To      JID      `xml:"to,attr"`
+	Type    string   `xml:"type,attr"`
+	Subject string   `xml:"subject"`
+}
+
+// MUCExtension is a XEP-0045 multi-user chat service on its own domain,
+// e.g. conference.example.com. It delivers to occupants through
+// MessageBus. NormalMessageExtension and PresenceExtension also put the
+// stanzas for the service on their buses, which the router drops as no
+// session is on Domain. The router should call Disconnect when a session
+// ends.
+type MUCExtension struct {
+	Domain     string
+	MessageBus chan<- Message
+
+	lock  sync.Mutex
+	rooms map[JID]*mucRoom
+}
+
+// mucRoom is a chat room and its occupants
+type mucRoom struct {
+	jid    JID
+	config mucConfig
+	// locked is set until the owner configured a newly created room
+	locked       bool
+	affiliations map[JID]string // by bare JID, "none" is not stored
+	occupants    map[string]*mucOccupant
+	history      []mucHistoryEntry
+	subject      string
+	subjectFrom  JID
+}
+
+// mucConfig holds the configurable settings of a room
+type mucConfig struct {
+	name          string
+	description   string
+	persistent    bool
+	public        bool
+	membersOnly   bool
+	moderated     bool
+	password      string
+	whois         string // moderators or anyone
+	maxUsers      int
+	changeSubject bool
+	historyLength int
+}
+
+// mucOccupant is a user in a room
+type mucOccupant struct {
+	nick     string
+	jid      JID
+	role     string
+	presence *ClientPresence
+}
+
+// mucHistoryEntry is a groupchat message kept for new occupants
+type mucHistoryEntry struct {
+	message *ClientMessage
+	time    time.Time
+}
+
+// mucOutbox collects the stanzas to send once the service lock is released
+type mucOutbox []Message
+
+// send queues stanza for to
+func (o *mucOutbox) send(to JID, stanza interface{}) {
+	*o = append(*o, Message{To: to, Data: stanza})
+}
+
+// fail queues the error reply to stanza, which was sent by to
+func (o *mucOutbox) fail(to JID, stanza interface{}, err *ClientError) {
+	if reply := ErrorReply(stanza, err); reply != nil {
+		o.send(to, reply)
+	}
+}
+
+// Process handles the stanzas addressed to the service and its rooms
+func (e *MUCExtension) Process(message interface{}, from *Client) {
+	e.process(message, from)
+}
+
+// HandleIQ answers the requests addressed to the service and its rooms
+func (e *MUCExtension) HandleIQ(iq *ClientIQ, from *Client) bool {
+	return e.process(iq, from)
+}
+
+// process handles a stanza and reports whether it was addressed to the
+// service
+func (e *MUCExtension) process(message interface{}, from *Client) bool {
+	var out mucOutbox
+	e.lock.Lock()
+	if e.rooms == nil {
+		e.rooms = make(map[JID]*mucRoom)
+	}
+	switch v := message.(type) {
+	case *ClientPresence:
+		if v.To.Domain() != e.Domain {
+			e.lock.Unlock()
+			return false
+		}
+		v.From = from.jid
+		e.presence(v, &out)
+	case *ClientMessage:
+		if v.To.Domain() != e.Domain {
+			e.lock.Unlock()
+			return false
+		}
+		v.From = from.jid
+		e.message(v, &out)
+	case *ClientIQ:
+		if v.To.Domain() != e.Domain {
+			e.lock.Unlock()
+			return false
+		}
+		e.iq(v, &out)
+	default:
+		e.lock.Unlock()
+		return false
+	}
+	e.lock.Unlock()
+
+	for _, m := range out {
+		e.MessageBus <- m
+	}
+	return true
+}
+
+// Disconnect makes the session jid leave every room it is in
+func (e *MUCExtension) Disconnect(jid JID) {
+	var out mucOutbox
+	e.lock.Lock()
+	for _, room := range e.rooms {
+		if occupant := room.occupantByJID(jid); occupant != nil {
+			e.leave(room, occupant, "", &out)
+		}
+	}
+	e.lock.Unlock()
+
+	for _, m := range out {
+		e.MessageBus <- m
+	}
+}
+
+// occupantJID returns the room JID of the occupant with nick
+func (r *mucRoom) occupantJID(nick string) JID {
+	jid, _ := r.jid.WithResource(nick)
+	return jid
+}
+
+// occupantByJID returns the occupant whose real full JID is jid
+func (r *mucRoom) occupantByJID(jid JID) *mucOccupant {
+	for _, occupant := range r.occupants {
+		if occupant.jid == jid {
+			return occupant
+		}
+	}
+	return nil
+}
+
+// affiliation returns the affiliation of the user jid
+func (r *mucRoom) affiliation(jid JID) string {
+	if affiliation, ok := r.affiliations[jid.Bare()]; ok {
+		return affiliation
+	}
+	return "none"
+}
+
+// setAffiliation records the affiliation of the user jid
+func (r *mucRoom) setAffiliation(jid JID, affiliation string) {
+	if affiliation == "none" {
+		delete(r.affiliations, jid.Bare())
+	} else {
+		r.affiliations[jid.Bare()] = affiliation
+	}
+}
+
+// defaultRole returns the role an occupant gets for its affiliation
+func (r *mucRoom) defaultRole(affiliation string) string {
+	switch {
+	case mucAffiliations[affiliation] >= mucAffiliations["admin"]:
+		return "moderator"
+	case r.config.moderated && affiliation != "member":
+		return "visitor"
+	}
+	return "participant"
+}
+
+// showsJID reports whether viewer may see the real JIDs of occupants
+func (r *mucRoom) showsJID(viewer *mucOccupant) bool {
+	return r.config.whois == "anyone" || viewer.role == "moderator"
+}
+
+// occupantPresence builds the presence of occupant as seen by viewer
+func (r *mucRoom) occupantPresence(occupant, viewer *mucOccupant, statuses ...int) *ClientPresence {
+	presence := &ClientPresence{From: r.occupantJID(occupant.nick), To: viewer.jid}
+	if occupant.presence != nil {
+		presence.Show = occupant.presence.Show
+		presence.Status = occupant.presence.Status
+		presence.Priority = occupant.presence.Priority
+		presence.Caps = occupant.presence.Caps
+	}
+	if occupant.role == "none" {
+		presence.Type = "unavailable"
+	}
+	item := MUCItem{Affiliation: r.affiliation(occupant.jid), Role: occupant.role}
+	if r.showsJID(viewer) {
+		item.JID = occupant.jid
+	}
+	presence.MUCUser = &MUCUser{Items: []MUCItem{item}}
+	for _, code := range statuses {
+		presence.MUCUser.Statuses = append(presence.MUCUser.Statuses, MUCStatus{Code: code})
+	}
+	return presence
+}
+
+// broadcastPresence sends the presence of occupant to everyone in the room.
+// The occupant's own copy gets selfStatuses as well.
+func (r *mucRoom) broadcastPresence(occupant *mucOccupant, out *mucOutbox, statuses []int, selfStatuses []int, decorate func(*ClientPresence)) {
+	for _, viewer := range r.occupants {
+		codes := statuses
+		if viewer == occupant {
+			codes = append(append([]int{}, statuses...), selfStatuses...)
+		}
+		presence := r.occupantPresence(occupant, viewer, codes...)
+		if decorate != nil {
+			decorate(presence)
+		}
+		out.send(viewer.jid, presence)
+	}
+	if _, inRoom := r.occupants[occupant.nick]; !inRoom {
+		// an occupant that just left still needs its own unavailable
+		codes := append(append([]int{}, statuses...), selfStatuses...)
+		presence := r.occupantPresence(occupant, occupant, codes...)
+		if decorate != nil {
+			decorate(presence)
+		}
+		out.send(occupant.jid, presence)
+	}
+}
+
+// presence handles a presence addressed to a room
+func (e *MUCExtension) presence(presence *ClientPresence, out *mucOutbox) {
+	if presence.To.Local() == "" {
+		// the service itself is not a room
+		if presence.Type == "" {
+			out.fail(presence.From, presence, StanzaJIDMalformed("a room name is required"))
+		}
+		return
+	}
+	room := e.rooms[presence.To.Bare()]
+	var occupant *mucOccupant
+	if room != nil {
+		occupant = room.occupantByJID(presence.From)
+	}
+
+	switch presence.Type {
+	case "":
+	case "unavailable":
+		if occupant != nil {
+			e.leave(room, occupant, presence.Status, out)
+		}
+		return
+	case "error":
+		// the occupant's client is gone
+		if occupant != nil {
+			e.leave(room, occupant, "", out)
+		}
+		return
+	default:
+		return
+	}
+
+	nick := presence.To.Resource()
+	if nick == "" {
+		out.fail(presence.From, presence, StanzaJIDMalformed("a nickname is required"))
+		return
+	}
+	switch {
+	case occupant == nil:
+		e.join(room, presence, out)
+	case occupant.nick != nick:
+		e.changeNick(room, occupant, presence, out)
+	default:
+		occupant.presence = presence
+		room.broadcastPresence(occupant, out, nil, nil, nil)
+	}
+}
+
+// join adds the sender of presence to the room, creating it if needed
+func (e *MUCExtension) join(room *mucRoom, presence *ClientPresence, out *mucOutbox) {
+	nick := presence.To.Resource()
+	created := false
+	if room == nil {
+		room = &mucRoom{
+			jid:          presence.To.Bare(),
+			config:       mucConfig{whois: "moderators", historyLength: defaultMUCHistory},
+			locked:       true,
+			affiliations: map[JID]string{presence.From.Bare(): "owner"},
+			occupants:    make(map[string]*mucOccupant),
+		}
+		e.rooms[room.jid] = room
+		created = true
+		log.Printf("MUC room %v created by %v\n", room.jid, presence.From)
+	}
+
+	affiliation := room.affiliation(presence.From)
+	var password string
+	if presence.MUC != nil {
+		password = presence.MUC.Password
+	}
+	var err *ClientError
+	switch _, taken := room.occupants[nick]; {
+	case room.locked && affiliation != "owner":
+		err = StanzaItemNotFound("the room is not configured yet")
+	case affiliation == "outcast":
+		err = StanzaForbidden("you are banned from this room")
+	case room.config.membersOnly && mucAffiliations[affiliation] < mucAffiliations["member"]:
+		err = StanzaRegistrationRequired("the room is members-only")
+	case room.config.password != "" && password != room.config.password:
+		err = StanzaNotAuthorized("a password is required")
+	case taken:
+		err = StanzaConflict("the nickname is in use")
+	case room.config.maxUsers > 0 && len(room.occupants) >= room.config.maxUsers &&
+		mucAffiliations[affiliation] < mucAffiliations["admin"]:
+		err = StanzaServiceUnavailable("the room is full")
+	}
+	if err != nil {
+		out.fail(presence.From, presence, err)
+		return
+	}
+
+	occupant := &mucOccupant{nick: nick, jid: presence.From, role: room.defaultRole(affiliation), presence: presence}
+	// existing occupants first, then the new one to everybody
+	for _, other := range room.occupants {
+		out.send(occupant.jid, room.occupantPresence(other, occupant))
+	}
+	room.occupants[nick] = occupant
+	selfStatuses := []int{mucStatusSelf}
+	if room.config.whois == "anyone" {
+		selfStatuses = append(selfStatuses, mucStatusNonAnonymous)
+	}
+	if created {
+		selfStatuses = append(selfStatuses, mucStatusCreated)
+	}
+	room.broadcastPresence(occupant, out, nil, selfStatuses, nil)
+	log.Printf("MUC %v joined %v as %v\n", occupant.jid, room.jid, nick)
+
+	for _, entry := range room.recentHistory(presence.MUC) {
+		message := *entry.message
+		message.To = occupant.jid
+		message.Delay = &Delay{From: room.jid, Stamp: entry.time.Format(time.RFC3339)}
+		out.send(occupant.jid, &message)
+	}
+	out.send(occupant.jid, &mucSubject{From: room.subjectJID(), To: occupant.jid, Type: "groupchat", Subject: room.subject})
+}
+
+// subjectJID returns who set the subject, or the room
+func (r *mucRoom) subjectJID() JID {
+	if r.subjectFrom.IsZero() {
+		return r.jid
+	}
+	return r.subjectFrom
+}
+
+// recentHistory returns the history a joining occupant asked for
+func (r *mucRoom) recentHistory(join *MUCJoin) []mucHistoryEntry {
+	history := r.history
+	if join == nil || join.History == nil {
+		return history
+	}
+	limits := join.History
+	if limits.MaxStanzas != nil && *limits.MaxStanzas < len(history) {
+		if *limits.MaxStanzas <= 0 {
+			return nil
+		}
+		history = history[len(history)-*limits.MaxStanzas:]
+	}
+	var since time.Time
+	if limits.Seconds != nil {
+		since = time.Now().Add(-time.Duration(*limits.Seconds) * time.Second)
+	}
+	if limits.Since != "" {
+		if t, err := time.Parse(time.RFC3339, limits.Since); err == nil && t.After(since) {
+			since = t
+		}
+	}
+	for len(history) > 0 && history[0].time.Before(since) {
+		history = history[1:]
+	}
+	return history
+}
+
+// changeNick moves occupant to the nickname presence is addressed to
+func (e *MUCExtension) changeNick(room *mucRoom, occupant *mucOccupant, presence *ClientPresence, out *mucOutbox) {
+	nick := presence.To.Resource()
+	if _, taken := room.occupants[nick]; taken {
+		out.fail(presence.From, presence, StanzaConflict("the nickname is in use"))
+		return
+	}
+	// the old nickname goes unavailable with the new one attached
+	role := occupant.role
+	delete(room.occupants, occupant.nick)
+	occupant.role = "none"
+	room.broadcastPresence(occupant, out, []int{mucStatusNickChanged}, []int{mucStatusSelf}, func(p *ClientPresence) {
+		p.MUCUser.Items[0].Nick = nick
+	})
+
+	occupant.nick, occupant.role, occupant.presence = nick, role, presence
+	room.occupants[nick] = occupant
+	room.broadcastPresence(occupant, out, nil, []int{mucStatusSelf}, nil)
+}
+
+// leave removes occupant from the room. Temporary rooms disappear with
+// their last occupant.
+func (e *MUCExtension) leave(room *mucRoom, occupant *mucOccupant, status string, out *mucOutbox) {
+	e.remove(room, occupant, out, nil, func(p *ClientPresence) { p.Status = status })
+	log.Printf("MUC %v left %v\n", occupant.jid, room.jid)
+}
+
+// remove takes occupant out of the room and tells everyone, with
+// statuses explaining why
+func (e *MUCExtension) remove(room *mucRoom, occupant *mucOccupant, out *mucOutbox, statuses []int, decorate func(*ClientPresence)) {
+	delete(room.occupants, occupant.nick)
+	occupant.role = "none"
+	room.broadcastPresence(occupant, out, statuses, []int{mucStatusSelf}, decorate)
+	if len(room.occupants) == 0 && !room.config.persistent {
+		delete(e.rooms, room.jid)
+		log.Printf("MUC room %v removed\n", room.jid)
+	}
+}
+
+// message handles a message addressed to a room or an occupant
+func (e *MUCExtension) message(message *ClientMessage, out *mucOutbox) {
+	room := e.rooms[message.To.Bare()]
+	if room == nil || message.To.Local() == "" {
+		out.fail(message.From, message, StanzaItemNotFound(""))
+		return
+	}
+	sender := room.occupantByJID(message.From)
+
+	if message.To.IsBare() && message.MUCUser != nil && message.MUCUser.Invite != nil {
+		e.invite(room, message, out)
+		return
+	}
+	if sender == nil {
+		out.fail(message.From, message, StanzaNotAcceptable("you are not in the room"))
+		return
+	}
+
+	if !message.To.IsBare() {
+		// a private message to another occupant
+		target, ok := room.occupants[message.To.Resource()]
+		if !ok || message.Type == "groupchat" {
+			out.fail(message.From, message, StanzaItemNotFound(""))
+			return
+		}
+		private := *message
+		private.From = room.occupantJID(sender.nick)
+		private.To = target.jid
+		private.MUCUser = &MUCUser{}
+		out.send(target.jid, &private)
+		return
+	}
+
+	if message.Type != "groupchat" {
+		out.fail(message.From, message, StanzaBadRequest("messages to the room must be of type groupchat"))
+		return
+	}
+	if sender.role == "visitor" {
+		out.fail(message.From, message, StanzaForbidden("visitors cannot speak in this room"))
+		return
+	}
+	if message.Subject != "" && message.Body == "" {
+		if sender.role != "moderator" && !room.config.changeSubject {
+			out.fail(message.From, message, StanzaForbidden("only moderators can change the subject"))
+			return
+		}
+		room.subject = message.Subject
+		room.subjectFrom = room.occupantJID(sender.nick)
+		for _, occupant := range room.occupants {
+			out.send(occupant.jid, &mucSubject{From: room.subjectFrom, To: occupant.jid, Type: "groupchat", Subject: room.subject})
+		}
+		return
+	}
+
+	// one copy for the history and for each occupant
+	groupchat := &ClientMessage{From: room.occupantJID(sender.nick), ID: message.ID, Type: "groupchat",
+		Body: message.Body, Thread: message.Thread}
+	if room.config.historyLength > 0 {
+		room.history = append(room.history, mucHistoryEntry{message: groupchat, time: time.Now().UTC()})
+		if len(room.history) > room.config.historyLength {
+			room.history = room.history[len(room.history)-room.config.historyLength:]
+		}
+	}
+	for _, occupant := range room.occupants {
+		copy := *groupchat
+		copy.To = occupant.jid
+		out.send(occupant.jid, &copy)
+	}
+}
+
+// invite forwards a mediated invitation (XEP-0045 section 7.8.2). In
+// members-only rooms invitations by admins make the invitee a member.
+func (e *MUCExtension) invite(room *mucRoom, message *ClientMessage, out *mucOutbox) {
+	invite := message.MUCUser.Invite
+	sender := room.occupantByJID(message.From)
+	if sender == nil || invite.To.IsZero() {
+		out.fail(message.From, message, StanzaNotAcceptable(""))
+		return
+	}
+	if room.config.membersOnly {
+		if mucAffiliations[room.affiliation(message.From)] < mucAffiliations["admin"] {
+			out.fail(message.From, message, StanzaForbidden("only admins can invite to this room"))
+			return
+		}
+		if room.affiliation(invite.To) == "none" {
+			room.setAffiliation(invite.To, "member")
+		}
+	}
+	out.send(invite.To, &ClientMessage{From: room.jid, To: invite.To, MUCUser: &MUCUser{
+		Invite:   &MUCInvite{From: message.From.Bare(), Reason: invite.Reason},
+		Password: room.config.password,
+	}})
+}
+
+// discoInfo is a XEP-0030 disco#info result
+type discoInfo struct {
+	XMLName    xml.Name        `xml:"http://jabber.org/protocol/disco#info query"`
+	Identities []discoIdentity `xml:"identity"`
+	Features   []discoFeature  `xml:"feature"`
+}
+
+// discoIdentity element
+type discoIdentity struct {
+	Category string `xml:"category,attr"`
+	Type     string `xml:"type,attr"`
+	Name     string `xml:"name,attr,omitempty"`
+}
+
+// discoFeature element
+type discoFeature struct {
+	Var string `xml:"var,attr"`
+}
+
+// iq handles requests to the service and its rooms
+func (e *MUCExtension) iq(iq *ClientIQ, out *mucOutbox) {
+	if iq.Type != "get" && iq.Type != "set" {
+		return
+	}
+	var payload struct {
+		XMLName xml.Name
+	}
+	xml.Unmarshal(iq.Query, &payload)
+
+	room := e.rooms[iq.To.Bare()]
+	switch {
+	case payload.XMLName.Space == NsDiscoInfo && iq.Type == "get":
+		e.discoInfo(iq, room, out)
+	case room == nil || iq.To.Local() == "" || !iq.To.IsBare():
+		out.fail(iq.From, iq, StanzaItemNotFound(""))
+	case payload.XMLName.Space == NsMUCAdmin:
+		e.admin(room, iq, out)
+	case payload.XMLName.Space == NsMUCOwner:
+		e.owner(room, iq, out)
+	default:
+		out.fail(iq.From, iq, StanzaServiceUnavailable(""))
+	}
+}
+
+// discoInfo describes the service or a room
+func (e *MUCExtension) discoInfo(iq *ClientIQ, room *mucRoom, out *mucOutbox) {
+	info := discoInfo{Features: []discoFeature{{NsDiscoInfo}, {NsMUC}}}
+	switch {
+	case iq.To.Local() == "":
+		info.Identities = []discoIdentity{{Category: "conference", Type: "text", Name: "Chatrooms"}}
+	case room != nil && iq.To.IsBare():
+		info.Identities = []discoIdentity{{Category: "conference", Type: "text", Name: room.config.name}}
+		for _, feature := range []struct {
+			on  bool
+			Var string
+		}{
+			{room.config.membersOnly, "muc_membersonly"},
+			{room.config.password != "", "muc_passwordprotected"},
+			{room.config.persistent, "muc_persistent"},
+			{room.config.moderated, "muc_moderated"},
+			{room.config.whois == "anyone", "muc_nonanonymous"},
+		} {
+			if feature.on {
+				info.Features = append(info.Features, discoFeature{feature.Var})
+			}
+		}
+	default:
+		out.fail(iq.From, iq, StanzaItemNotFound(""))
+		return
+	}
+	result := &ClientIQ{From: iq.To, To: iq.From, ID: iq.ID, Type: "result"}
+	result.Query, _ = xml.Marshal(info)
+	out.send(iq.From, result)
+}
@@ -0,0 +1,371 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"log"
+	"strconv"
+)
+
+// mucAdminQuery is a muc#admin request
+type mucAdminQuery struct {
+	XMLName xml.Name  `xml:"http://jabber.org/protocol/muc#admin query"`
+	Items   []MUCItem `xml:"item"`
+}
+
+// mucOwnerQuery is a muc#owner request
+type mucOwnerQuery struct {
+	XMLName xml.Name    `xml:"http://jabber.org/protocol/muc#owner query"`
+	Form    *DataForm   `xml:"x"`
+	Destroy *MUCDestroy `xml:"destroy"`
+}
+
+// mucResult builds the result to iq, carrying payload if it is not nil
+func mucResult(iq *ClientIQ, payload interface{}) *ClientIQ {
+	result := &ClientIQ{From: iq.To, To: iq.From, ID: iq.ID, Type: "result"}
+	if payload != nil {
+		result.Query, _ = xml.Marshal(payload)
+	}
+	return result
+}
+
+// admin handles the moderation requests of XEP-0045 sections 8 and 9:
+// changing roles by nickname and affiliations by JID, and listing them
+func (e *MUCExtension) admin(room *mucRoom, iq *ClientIQ, out *mucOutbox) {
+	var query mucAdminQuery
+	if err := xml.Unmarshal(iq.Query, &query); err != nil || len(query.Items) == 0 {
+		out.fail(iq.From, iq, StanzaBadRequest(""))
+		return
+	}
+	if iq.Type == "get" {
+		e.adminList(room, iq, query.Items[0], out)
+		return
+	}
+
+	// check every item before changing anything, and resolve the occupant
+	// of each role change while they are all still in the room
+	targets := make([]*mucOccupant, len(query.Items))
+	roles := make(map[*mucOccupant]bool)
+	affiliations := make(map[JID]bool)
+	for i := range query.Items {
+		target, err := room.checkAdminItem(iq.From, &query.Items[i])
+		if err != nil {
+			out.fail(iq.From, iq, err)
+			return
+		}
+		if target != nil {
+			if roles[target] {
+				out.fail(iq.From, iq, StanzaBadRequest("more than one role change for "+target.nick))
+				return
+			}
+			roles[target] = true
+		} else {
+			jid := query.Items[i].JID
+			if affiliations[jid] {
+				out.fail(iq.From, iq, StanzaBadRequest("more than one affiliation change for "+jid.String()))
+				return
+			}
+			affiliations[jid] = true
+		}
+		targets[i] = target
+	}
+	for i, item := range query.Items {
+		if item.Role != "" {
+			e.setRole(room, targets[i], item.Role, item.Reason, out)
+		} else {
+			e.changeAffiliation(room, item.JID, item.Affiliation, item.Reason, out)
+		}
+	}
+	log.Printf("MUC %v changed %v items in %v\n", iq.From, len(query.Items), room.jid)
+	out.send(iq.From, mucResult(iq, nil))
+}
+
+// checkAdminItem checks that actor may make the change item asks for. It
+// returns the occupant of a role change and resolves the JID of
+// affiliation changes given by nickname.
+func (r *mucRoom) checkAdminItem(actor JID, item *MUCItem) (*mucOccupant, *ClientError) {
+	actorAffiliation := mucAffiliations[r.affiliation(actor)]
+	if item.Role != "" {
+		newRole, valid := mucRoles[item.Role]
+		occupant := r.occupantByJID(actor)
+		target, found := r.occupants[item.Nick]
+		switch {
+		case !valid:
+			return nil, StanzaBadRequest("unknown role")
+		case occupant == nil || occupant.role != "moderator":
+			return nil, StanzaForbidden("")
+		case !found:
+			return nil, StanzaItemNotFound("no occupant with that nickname")
+		case (newRole == mucRoles["moderator"] || target.role == "moderator") && actorAffiliation < mucAffiliations["admin"]:
+			return nil, StanzaNotAllowed("only admins can change moderators")
+		case mucAffiliations[r.affiliation(target.jid)] >= mucAffiliations["admin"] && newRole < mucRoles["moderator"]:
+			return nil, StanzaNotAllowed("admins and owners cannot lose their role")
+		}
+		return target, nil
+	}
+
+	newAffiliation, valid := mucAffiliations[item.Affiliation]
+	if !valid {
+		return nil, StanzaBadRequest("an item needs a valid role or affiliation")
+	}
+	if item.JID.IsZero() && item.Nick != "" {
+		if target, found := r.occupants[item.Nick]; found {
+			item.JID = target.jid
+		}
+	}
+	if item.JID.IsZero() {
+		return nil, StanzaBadRequest("an affiliation change needs a jid")
+	}
+	item.JID = item.JID.Bare()
+	current := mucAffiliations[r.affiliation(item.JID)]
+	switch {
+	case actorAffiliation < mucAffiliations["admin"]:
+		return nil, StanzaForbidden("")
+	case actorAffiliation == mucAffiliations["admin"] &&
+		(current >= mucAffiliations["admin"] || newAffiliation >= mucAffiliations["admin"]):
+		return nil, StanzaNotAllowed("only owners can change admins and owners")
+	case current == mucAffiliations["owner"] && newAffiliation != current && r.owners() == 1:
+		return nil, StanzaConflict("the room needs an owner")
+	}
+	return nil, nil
+}
+
+// owners counts the owners of the room
+func (r *mucRoom) owners() int {
+	n := 0
+	for _, affiliation := range r.affiliations {
+		if affiliation == "owner" {
+			n++
+		}
+	}
+	return n
+}
+
+// adminList returns the users with the affiliation or the occupants with
+// the role item asks for
+func (e *MUCExtension) adminList(room *mucRoom, iq *ClientIQ, item MUCItem, out *mucOutbox) {
+	var list mucAdminQuery
+	switch {
+	case item.Affiliation != "":
+		if mucAffiliations[room.affiliation(iq.From)] < mucAffiliations["admin"] {
+			out.fail(iq.From, iq, StanzaForbidden(""))
+			return
+		}
+		for jid, affiliation := range room.affiliations {
+			if affiliation == item.Affiliation {
+				list.Items = append(list.Items, MUCItem{Affiliation: affiliation, JID: jid})
+			}
+		}
+	case item.Role != "":
+		if actor := room.occupantByJID(iq.From); actor == nil || actor.role != "moderator" {
+			out.fail(iq.From, iq, StanzaForbidden(""))
+			return
+		}
+		for _, occupant := range room.occupants {
+			if occupant.role == item.Role {
+				list.Items = append(list.Items, MUCItem{Affiliation: room.affiliation(occupant.jid),
+					Role: occupant.role, JID: occupant.jid, Nick: occupant.nick})
+			}
+		}
+	default:
+		out.fail(iq.From, iq, StanzaBadRequest(""))
+		return
+	}
+	out.send(iq.From, mucResult(iq, &list))
+}
+
+// setRole changes the role of occupant; the role "none" kicks it. An
+// occupant that left in the meantime, e.g. banned by an earlier item of
+// the same request, is left alone.
+func (e *MUCExtension) setRole(room *mucRoom, occupant *mucOccupant, role, reason string, out *mucOutbox) {
+	if occupant == nil || room.occupants[occupant.nick] != occupant {
+		return
+	}
+	if role == "none" {
+		log.Printf("MUC %v kicked from %v\n", occupant.jid, room.jid)
+		e.remove(room, occupant, out, []int{mucStatusKicked}, func(p *ClientPresence) {
+			p.MUCUser.Items[0].Reason = reason
+		})
+		return
+	}
+	occupant.role = role
+	room.broadcastPresence(occupant, out, nil, nil, func(p *ClientPresence) {
+		p.MUCUser.Items[0].Reason = reason
+	})
+}
+
+// changeAffiliation sets the affiliation of the user jid and updates or
+// removes its occupants: outcasts are banned and non-members leave
+// members-only rooms
+func (e *MUCExtension) changeAffiliation(room *mucRoom, jid JID, affiliation, reason string, out *mucOutbox) {
+	room.setAffiliation(jid, affiliation)
+	decorate := func(p *ClientPresence) { p.MUCUser.Items[0].Reason = reason }
+	var affected []*mucOccupant
+	for _, occupant := range room.occupants {
+		if occupant.jid.Bare() == jid {
+			affected = append(affected, occupant)
+		}
+	}
+	for _, occupant := range affected {
+		if room.occupants[occupant.nick] != occupant {
+			// gone already
+			continue
+		}
+		switch {
+		case affiliation == "outcast":
+			log.Printf("MUC %v banned from %v\n", occupant.jid, room.jid)
+			e.remove(room, occupant, out, []int{mucStatusBanned}, decorate)
+		case affiliation == "none" && room.config.membersOnly:
+			e.remove(room, occupant, out, []int{mucStatusNotMember}, decorate)
+		default:
+			occupant.role = room.defaultRole(affiliation)
+			room.broadcastPresence(occupant, out, nil, nil, decorate)
+		}
+	}
+}
+
+// owner handles room configuration and destruction (XEP-0045 section 10)
+func (e *MUCExtension) owner(room *mucRoom, iq *ClientIQ, out *mucOutbox) {
+	if room.affiliation(iq.From) != "owner" {
+		out.fail(iq.From, iq, StanzaForbidden(""))
+		return
+	}
+	var query mucOwnerQuery
+	if err := xml.Unmarshal(iq.Query, &query); err != nil {
+		out.fail(iq.From, iq, StanzaBadRequest(""))
+		return
+	}
+
+	switch {
+	case iq.Type == "get":
+		out.send(iq.From, mucResult(iq, &mucOwnerQuery{Form: room.configForm()}))
+	case query.Destroy != nil:
+		e.destroy(room, query.Destroy, out)
+		out.send(iq.From, mucResult(iq, nil))
+	case query.Form != nil && query.Form.Type == "cancel":
+		// cancelling the configuration of a new room destroys it
+		if room.locked {
+			e.destroy(room, &MUCDestroy{}, out)
+		}
+		out.send(iq.From, mucResult(iq, nil))
+	case query.Form != nil && query.Form.Type == "submit":
+		if err := room.configure(query.Form); err != nil {
+			out.fail(iq.From, iq, err)
+			return
+		}
+		room.locked = false
+		log.Printf("MUC room %v configured by %v\n", room.jid, iq.From)
+		out.send(iq.From, mucResult(iq, nil))
+	default:
+		out.fail(iq.From, iq, StanzaBadRequest(""))
+	}
+}
+
+// destroy removes the room, telling its occupants why
+func (e *MUCExtension) destroy(room *mucRoom, destroy *MUCDestroy, out *mucOutbox) {
+	log.Printf("MUC room %v destroyed\n", room.jid)
+	for _, occupant := range room.occupants {
+		delete(room.occupants, occupant.nick)
+		occupant.role = "none"
+		room.broadcastPresence(occupant, out, nil, []int{mucStatusSelf}, func(p *ClientPresence) {
+			p.MUCUser.Destroy = destroy
+		})
+	}
+	delete(e.rooms, room.jid)
+}
+
+// configForm returns the room configuration form with the current values
+func (r *mucRoom) configForm() *DataForm {
+	boolean := func(on bool) []string {
+		if on {
+			return []string{"1"}
+		}
+		return []string{"0"}
+	}
+	return &DataForm{
+		Type:  "form",
+		Title: "Configuration for " + r.jid.String(),
+		Fields: []FormField{
+			HiddenFormType(NsMUCRoomConfig),
+			{Var: "muc#roomconfig_roomname", Type: "text-single", Label: "Room name", Values: []string{r.config.name}},
+			{Var: "muc#roomconfig_roomdesc", Type: "text-single", Label: "Description", Values: []string{r.config.description}},
+			{Var: "muc#roomconfig_persistentroom", Type: "boolean", Label: "Keep the room when it is empty", Values: boolean(r.config.persistent)},
+			{Var: "muc#roomconfig_publicroom", Type: "boolean", Label: "List the room publicly", Values: boolean(r.config.public)},
+			{Var: "muc#roomconfig_membersonly", Type: "boolean", Label: "Only members can join", Values: boolean(r.config.membersOnly)},
+			{Var: "muc#roomconfig_moderatedroom", Type: "boolean", Label: "Only participants with voice can speak", Values: boolean(r.config.moderated)},
+			{Var: "muc#roomconfig_passwordprotectedroom", Type: "boolean", Label: "A password is required to join", Values: boolean(r.config.password != "")},
+			{Var: "muc#roomconfig_roomsecret", Type: "text-private", Label: "Password", Values: []string{r.config.password}},
+			{Var: "muc#roomconfig_whois", Type: "list-single", Label: "Who can see real JIDs", Values: []string{r.config.whois},
+				Options: []FormOption{{Label: "Moderators", Value: "moderators"}, {Label: "Anyone", Value: "anyone"}}},
+			{Var: "muc#roomconfig_maxusers", Type: "text-single", Label: "Maximum number of occupants (0 for no limit)", Values: []string{strconv.Itoa(r.config.maxUsers)}},
+			{Var: "muc#roomconfig_changesubject", Type: "boolean", Label: "Participants can change the subject", Values: boolean(r.config.changeSubject)},
+			{Var: "muc#maxhistoryfetch", Type: "text-single", Label: "Messages kept for new occupants", Values: []string{strconv.Itoa(r.config.historyLength)}},
+		},
+	}
+}
+
+// configure applies a submitted configuration form. Fields left out keep
+// their value, so an empty form creates an instant room.
+func (r *mucRoom) configure(form *DataForm) *ClientError {
+	if form.FormType() != "" && form.FormType() != NsMUCRoomConfig {
+		return StanzaBadRequest("unknown form type")
+	}
+	config := r.config
+	boolean := func(name string, value *bool) {
+		if field := form.Field(name); field != nil && len(field.Values) > 0 {
+			*value = field.Values[0] == "1" || field.Values[0] == "true"
+		}
+	}
+	number := func(name string, value *int) *ClientError {
+		if field := form.Field(name); field != nil && len(field.Values) > 0 {
+			n, err := strconv.Atoi(field.Values[0])
+			if err != nil || n < 0 {
+				return StanzaNotAcceptable(name + " must be a number")
+			}
+			*value = n
+		}
+		return nil
+	}
+
+	if field := form.Field("muc#roomconfig_roomname"); field != nil {
+		config.name = form.Value("muc#roomconfig_roomname")
+	}
+	if field := form.Field("muc#roomconfig_roomdesc"); field != nil {
+		config.description = form.Value("muc#roomconfig_roomdesc")
+	}
+	boolean("muc#roomconfig_persistentroom", &config.persistent)
+	boolean("muc#roomconfig_publicroom", &config.public)
+	boolean("muc#roomconfig_membersonly", &config.membersOnly)
+	boolean("muc#roomconfig_moderatedroom", &config.moderated)
+	boolean("muc#roomconfig_changesubject", &config.changeSubject)
+
+	protected := config.password != ""
+	boolean("muc#roomconfig_passwordprotectedroom", &protected)
+	if field := form.Field("muc#roomconfig_roomsecret"); field != nil {
+		config.password = form.Value("muc#roomconfig_roomsecret")
+	}
+	if !protected {
+		config.password = ""
+	} else if config.password == "" {
+		return StanzaNotAcceptable("a password protected room needs a password")
+	}
+
+	switch whois := form.Value("muc#roomconfig_whois"); whois {
+	case "":
+	case "moderators", "anyone":
+		config.whois = whois
+	default:
+		return StanzaNotAcceptable("muc#roomconfig_whois must be moderators or anyone")
+	}
+	if err := number("muc#roomconfig_maxusers", &config.maxUsers); err != nil {
+		return err
+	}
+	if err := number("muc#maxhistoryfetch", &config.historyLength); err != nil {
+		return err
+	}
+
+	r.config = config
+	if len(r.history) > config.historyLength {
+		r.history = r.history[len(r.history)-config.historyLength:]
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package xmpp
+
+import (
+	"bytes"
+	"strings"
+)
+
+// TokenValidator checks OAuth 2.0 bearer tokens presented with the X-OAUTH2
+// and OAUTHBEARER (RFC 7628) SASL mechanisms.
+type TokenValidator interface {
+	// ValidateToken returns the user the token was issued to, either a
+	// localpart or a bare JID.
+	ValidateToken(token string) (username string, err error)
+}
+
+// saslLocalpart returns the normalized localpart of identity, which is
+// either a localpart or a bare JID at domain
+func saslLocalpart(identity, domain string) (string, bool) {
+	if !strings.Contains(identity, "@") {
+		identity += "@" + domain
+	}
+	jid, err := ParseJID(identity)
+	if err != nil || jid.Local() == "" || !jid.IsBare() || jid.Domain() != domain {
+		return "", false
+	}
+	return jid.Local(), true
+}
+
+// validateBearer checks token and returns the localpart it was issued to
+func validateBearer(s *Server, client *Client, token string) (string, error) {
+	subject, err := s.TokenValidator.ValidateToken(token)
+	if err != nil {
+		return "", errSASLNotAuthorized
+	}
+	authcid, ok := saslLocalpart(subject, client.jid.Domain())
+	if !ok {
+		return "", errSASLNotAuthorized
+	}
+	return authcid, nil
+}
+
+// xOAuth2Mechanism implements the X-OAUTH2 mechanism, which carries the
+// token in a PLAIN style message: authzid NUL username NUL token
+type xOAuth2Mechanism struct {
+	client   *Client
+	server   *Server
+	username string
+}
+
+// Next validates the token
+func (m *xOAuth2Mechanism) Next(response []byte) ([]byte, bool, error) {
+	info := bytes.Split(response, []byte{0})
+	if len(info) != 3 || len(info[2]) == 0 {
+		return nil, false, errSASLMalformedRequest
+	}
+	authzid, claimed, token := string(info[0]), string(info[1]), string(info[2])
+	authcid, err := validateBearer(m.server, m.client, token)
+	if err != nil {
+		return nil, false, err
+	}
+	if claimedUser, ok := saslLocalpart(claimed, m.client.jid.Domain()); !ok || claimedUser != authcid {
+		// the token was issued to someone else
+		return nil, false, errSASLNotAuthorized
+	}
+	username, err := saslAuthorize(m.server, m.client, authcid, authzid)
+	if err != nil {
+		return nil, false, err
+	}
+	m.username = username
+	return nil, true, nil
+}
+
+// Username returns the localpart the client acts as
+func (m *xOAuth2Mechanism) Username() string {
+	return m.username
+}
+
+// oauthBearerMechanism implements OAUTHBEARER (RFC 7628)
+type oauthBearerMechanism struct {
+	client   *Client
+	server   *Server
+	failed   bool
+	username string
+}
+
+// Next validates the token. A failed validation is answered with an error
+// challenge that the client must acknowledge before the exchange fails.
+func (m *oauthBearerMechanism) Next(response []byte) ([]byte, bool, error) {
+	if m.failed {
+		// the client acknowledges the error challenge with a single %x01
+		return nil, false, errSASLNotAuthorized
+	}
+
+	// gs2-header kvsep *(kvpair) kvsep
+	parts := strings.SplitN(string(response), ",", 3)
+	if len(parts) != 3 {
+		return nil, false, errSASLMalformedRequest
+	}
+	if parts[0] != "n" && parts[0] != "y" {
+		// channel binding is not supported with OAUTHBEARER
+		return nil, false, errSASLMalformedRequest
+	}
+	authzid := ""
+	if parts[1] != "" {
+		if !strings.HasPrefix(parts[1], "a=") {
+			return nil, false, errSASLMalformedRequest
+		}
+		var err error
+		if authzid, err = scramUnescape(parts[1][2:]); err != nil {
+			return nil, false, err
+		}
+	}
+	if !strings.HasPrefix(parts[2], "\x01") || !strings.HasSuffix(parts[2], "\x01\x01") {
+		return nil, false, errSASLMalformedRequest
+	}
+
+	token := ""
+	for _, kv := range strings.Split(strings.Trim(parts[2], "\x01"), "\x01") {
+		if strings.HasPrefix(kv, "auth=") {
+			scheme := strings.SplitN(kv[len("auth="):], " ", 2)
+			if len(scheme) != 2 || !strings.EqualFold(scheme[0], "Bearer") {
+				return nil, false, errSASLMalformedRequest
+			}
+			token = strings.TrimSpace(scheme[1])
+		}
+	}
+	if token == "" {
+		return nil, false, errSASLMalformedRequest
+	}
+
+	authcid, err := validateBearer(m.server, m.client, token)
+	if err != nil {
+		m.failed = true
+		return []byte(`{"status":"invalid_token"}`), false, nil
+	}
+	username, err := saslAuthorize(m.server, m.client, authcid, authzid)
+	if err != nil {
+		return nil, false, err
+	}
+	m.username = username
+	return nil, true, nil
+}
+
+// Username returns the localpart the client acts as
+func (m *oauthBearerMechanism) Username() string {
+	return m.username
+}
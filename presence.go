@@ -0,0 +1,382 @@
+package xmpp
+
+import (
+	"log"
+)
+
+// handlePresence processes the presence stanzas the server is responsible
+// for: subscriptions between local accounts (RFC 6121 section 3) and the
+// broadcast of a session's availability. Directed presence is left to the
+// extensions.
+func (s *Server) handlePresence(client *Client, presence *ClientPresence) bool {
+	switch presence.Type {
+	case "subscribe", "subscribed", "unsubscribe", "unsubscribed":
+		contact := presence.To.Bare()
+		if contact.Local() == "" || !s.servesDomain(contact.Domain()) {
+			return false
+		}
+		owner := client.jid.Bare()
+		if contact == owner {
+			// nothing to subscribe to, the account sees itself anyway
+			return true
+		}
+		s.rosterLock.Lock()
+		defer s.rosterLock.Unlock()
+		s.outboundSubscription(owner, contact, presence.Type)
+		return true
+	case "", "unavailable":
+		if presence.To.IsZero() {
+			s.broadcastPresence(client, presence)
+			return true
+		}
+		s.trackDirected(client, presence)
+	}
+	return false
+}
+
+// subscriptionItem returns the item of contact in the roster of owner, or
+// a new hidden one. The caller holds the roster lock.
+func (s *Server) subscriptionItem(owner, contact JID) (*RosterItem, error) {
+	item, err := s.rosters().Item(owner, contact)
+	if err != nil || item != nil {
+		return item, err
+	}
+	return &RosterItem{JID: contact, Subscription: "none", Hidden: true}, nil
+}
+
+// saveSubscription stores item if its subscription changed and pushes it
+// to the owner if the owner can see the change. Hidden items left with
+// nothing pending are dropped.
+func (s *Server) saveSubscription(owner JID, before, item RosterItem) {
+	if before.Subscription == item.Subscription && before.Ask == item.Ask &&
+		before.PendingIn == item.PendingIn && before.Hidden == item.Hidden {
+		return
+	}
+	store := s.rosters()
+	var version uint64
+	var err error
+	if item.Hidden && item.Subscription == "none" && !item.Ask && !item.PendingIn {
+		_, err = store.RemoveItem(owner, item.JID)
+	} else {
+		version, err = store.SetItem(owner, item)
+	}
+	if err != nil {
+		log.Printf("Could not update the roster of %v: %v\n", owner, err.Error())
+		return
+	}
+	// pending-in is not part of the roster the owner sees
+	if !item.Hidden && (before.Hidden || before.Subscription != item.Subscription || before.Ask != item.Ask) {
+		s.pushRoster(owner, item.entry(), version)
+	}
+}
+
+// outboundSubscription processes a subscription stanza of kind sent by
+// owner to contact, then delivers it to contact (RFC 6121 3.1.2, 3.2.2,
+// 3.3.2 and 3.4). The caller holds the roster lock.
+func (s *Server) outboundSubscription(owner, contact JID, kind string) {
+	log.Printf("Subscription %v from %v to %v\n", kind, owner, contact)
+	item, err := s.subscriptionItem(owner, contact)
+	if err != nil {
+		log.Printf("Could not read the roster of %v: %v\n", owner, err.Error())
+		return
+	}
+	before := *item
+	switch kind {
+	case "subscribe":
+		// asking puts the contact in the roster
+		item.Hidden = false
+		if !item.hasTo() {
+			item.Ask = true
+		}
+	case "subscribed":
+		if !item.PendingIn {
+			// approving ahead of a request (pre-approval, RFC 6121 3.4)
+			// is not supported
+			return
+		}
+		item.PendingIn = false
+		item.Hidden = false
+		item.setSubscription(item.hasTo(), true)
+	case "unsubscribe":
+		item.Ask = false
+		item.setSubscription(false, item.hasFrom())
+	case "unsubscribed":
+		item.PendingIn = false
+		item.setSubscription(item.hasTo(), false)
+	}
+	s.saveSubscription(owner, before, *item)
+	if !s.accountExists(contact) {
+		// there is nobody to deliver to: a request is refused and the
+		// rest is dropped (RFC 6121 3.1.3)
+		if kind == "subscribe" {
+			s.inboundSubscription(owner, contact, "unsubscribed")
+		}
+		return
+	}
+	s.inboundSubscription(contact, owner, kind)
+}
+
+// AccountChecker can be implemented by an AccountManager so that
+// subscriptions reach accounts that are offline. AccountExists reports
+// whether username is a registered account.
+type AccountChecker interface {
+	AccountExists(username string) (exists bool, err error)
+}
+
+// accountExists reports whether the bare JID contact on a served domain is
+// a registered account or a guest with a session. Without an
+// AccountChecker only accounts with a session exist.
+func (s *Server) accountExists(contact JID) bool {
+	if len(s.accountSessions(contact)) > 0 {
+		return true
+	}
+	checker, ok := s.Accounts.(AccountChecker)
+	if !ok {
+		return false
+	}
+	exists, err := checker.AccountExists(contact.Local())
+	if err != nil {
+		log.Printf("Could not look up the account %v: %v\n", contact, err.Error())
+		return false
+	}
+	return exists
+}
+
+// inboundSubscription processes a subscription stanza of kind sent to
+// owner by contact, delivering it to the sessions of owner when it changes
+// something (RFC 6121 3.1.3, 3.1.6, 3.2.3 and 3.3.3). The caller holds the
+// roster lock.
+func (s *Server) inboundSubscription(owner, contact JID, kind string) {
+	item, err := s.subscriptionItem(owner, contact)
+	if err != nil {
+		log.Printf("Could not read the roster of %v: %v\n", owner, err.Error())
+		return
+	}
+	before := *item
+	switch kind {
+	case "subscribe":
+		if item.hasFrom() {
+			// already approved, answer for the owner
+			s.inboundSubscription(contact, owner, "subscribed")
+			return
+		}
+		if item.PendingIn {
+			// the owner has been asked already
+			return
+		}
+		item.PendingIn = true
+	case "subscribed":
+		if !item.Ask {
+			return
+		}
+		item.Ask = false
+		item.setSubscription(true, item.hasFrom())
+	case "unsubscribe":
+		if !item.PendingIn && !item.hasFrom() {
+			return
+		}
+		item.PendingIn = false
+		item.setSubscription(item.hasTo(), false)
+	case "unsubscribed":
+		if !item.Ask && !item.hasTo() {
+			return
+		}
+		item.Ask = false
+		item.setSubscription(false, item.hasFrom())
+	}
+	s.saveSubscription(owner, before, *item)
+
+	presence := &ClientPresence{From: contact, To: owner, Type: kind}
+	for _, session := range s.accountSessions(owner) {
+		session.push(presence)
+	}
+
+	// presence follows the subscription (RFC 6121 3.1.5, 3.2.2 and 3.3.3)
+	switch kind {
+	case "subscribed":
+		s.sendPresence(contact, owner, true)
+	case "unsubscribe":
+		s.sendPresence(owner, contact, false)
+	case "unsubscribed":
+		s.sendPresence(contact, owner, false)
+	}
+}
+
+// cancelSubscriptions ends the subscriptions of a contact removed from the
+// roster of owner (RFC 6121 2.5.2). The caller holds the roster lock.
+func (s *Server) cancelSubscriptions(owner JID, removed *RosterItem) {
+	contact := removed.JID.Bare()
+	if !s.servesDomain(contact.Domain()) || contact == owner {
+		return
+	}
+	if removed.hasFrom() || removed.PendingIn {
+		s.inboundSubscription(contact, owner, "unsubscribed")
+	}
+	if removed.hasTo() || removed.Ask {
+		s.inboundSubscription(contact, owner, "unsubscribe")
+	}
+}
+
+// dropRoster ends the subscriptions of an account that is going away and
+// deletes its roster (RFC 6121 2.5.2, XEP-0077 3.2)
+func (s *Server) dropRoster(owner JID) {
+	s.rosterLock.Lock()
+	defer s.rosterLock.Unlock()
+	store := s.rosters()
+	items, _, err := store.Roster(owner)
+	if err != nil {
+		log.Printf("Could not read the roster of %v: %v\n", owner, err.Error())
+		return
+	}
+	for i := range items {
+		s.cancelSubscriptions(owner, &items[i])
+	}
+	if err := store.DeleteRoster(owner); err != nil {
+		log.Printf("Could not delete the roster of %v: %v\n", owner, err.Error())
+	}
+}
+
+// broadcastPresence sends the availability of client to the available
+// sessions of its account and of the contacts subscribed to it, and its
+// unavailability to where it sent directed presence too (RFC 6121 4.2 and
+// 4.5). Initial presence also probes the contacts of client.
+func (s *Server) broadcastPresence(client *Client, presence *ClientPresence) {
+	owner := client.jid.Bare()
+	items, _, err := s.rosters().Roster(owner)
+	if err != nil {
+		log.Printf("Could not read the roster of %v: %v\n", owner, err.Error())
+	}
+	watchers := map[JID]bool{owner: true}
+	for i := range items {
+		if items[i].hasFrom() {
+			watchers[items[i].JID.Bare()] = true
+		}
+	}
+
+	var recipients []*Client
+	table := &s.sessions
+	table.lock.Lock()
+	initial := presence.Type == "" && client.presence == nil
+	var directed map[JID]bool
+	if presence.Type == "" {
+		current := *presence
+		client.presence = &current
+	} else {
+		client.presence = nil
+		directed, client.directed = client.directed, nil
+	}
+	for jid, session := range table.sessions {
+		if (session.presence != nil && watchers[jid.Bare()]) || directed[jid] || directed[jid.Bare()] {
+			recipients = append(recipients, session)
+		}
+	}
+	table.lock.Unlock()
+
+	log.Printf("Presence of %v to %v sessions\n", client.jid, len(recipients))
+	for _, session := range recipients {
+		broadcast := *presence
+		broadcast.To = session.jid
+		session.push(&broadcast)
+	}
+	if initial {
+		s.probe(client, items)
+	}
+}
+
+// probe sends a session that just became available the presence of the
+// other sessions of its account and of the contacts it is subscribed to
+// (RFC 6121 4.3), then the subscription requests that waited for it
+func (s *Server) probe(client *Client, items []RosterItem) {
+	owner := client.jid.Bare()
+	watched := map[JID]bool{owner: true}
+	var requests []*ClientPresence
+	for i := range items {
+		if items[i].hasTo() {
+			watched[items[i].JID.Bare()] = true
+		}
+		if items[i].PendingIn {
+			requests = append(requests, &ClientPresence{From: items[i].JID.Bare(), To: owner, Type: "subscribe"})
+		}
+	}
+
+	var answers []*ClientPresence
+	table := &s.sessions
+	table.lock.Lock()
+	for jid, session := range table.sessions {
+		if session != client && session.presence != nil && watched[jid.Bare()] {
+			answer := *session.presence
+			answer.To = client.jid
+			answers = append(answers, &answer)
+		}
+	}
+	table.lock.Unlock()
+
+	for _, answer := range answers {
+		client.send(answer)
+	}
+	for _, request := range requests {
+		client.send(request)
+	}
+}
+
+// sendPresence sends the available sessions of the account from to those
+// of the account to, with their current presence or as unavailable
+func (s *Server) sendPresence(from, to JID, available bool) {
+	var senders, recipients []*Client
+	var current []*ClientPresence
+	table := &s.sessions
+	table.lock.Lock()
+	for jid, session := range table.sessions {
+		if session.presence == nil {
+			continue
+		}
+		switch jid.Bare() {
+		case from:
+			senders = append(senders, session)
+			current = append(current, session.presence)
+		case to:
+			recipients = append(recipients, session)
+		}
+	}
+	table.lock.Unlock()
+
+	for i, sender := range senders {
+		for _, recipient := range recipients {
+			presence := &ClientPresence{From: sender.jid, To: recipient.jid, Type: "unavailable"}
+			if available {
+				*presence = *current[i]
+				presence.To = recipient.jid
+			}
+			recipient.push(presence)
+		}
+	}
+}
+
+// trackDirected remembers the addresses client sends directed presence to,
+// which are told when it becomes unavailable (RFC 6121 4.6)
+func (s *Server) trackDirected(client *Client, presence *ClientPresence) {
+	table := &s.sessions
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	if presence.Type == "unavailable" {
+		delete(client.directed, presence.To)
+		return
+	}
+	if client.directed == nil {
+		client.directed = make(map[JID]bool)
+	}
+	client.directed[presence.To] = true
+}
+
+// endPresence broadcasts the unavailability of a session that ended
+// without saying so, by disconnecting or by a stream error (RFC 6121
+// 4.5.3)
+func (s *Server) endPresence(client *Client) {
+	table := &s.sessions
+	table.lock.Lock()
+	available := client.presence != nil || len(client.directed) > 0
+	table.lock.Unlock()
+	if available {
+		s.broadcastPresence(client, &ClientPresence{From: client.jid, Type: "unavailable"})
+	}
+}
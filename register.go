@@ -0,0 +1,262 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"log"
+	"path"
+)
+
+const (
+	// NsRegister XEP-0077 in-band registration namespace
+	NsRegister = "jabber:iq:register"
+	// NsRegisterFeature XEP-0077 stream feature namespace
+	NsRegisterFeature = "http://jabber.org/features/iq-register"
+)
+
+// RegistrationPolicy decides who may create an account with in-band
+// registration (XEP-0077). A Server without a policy does not offer
+// registration.
+type RegistrationPolicy interface {
+	AllowRegistration(localpart, domain string) bool
+}
+
+// RegistrationPolicyFunc adapts a function to the RegistrationPolicy
+// interface
+type RegistrationPolicyFunc func(localpart, domain string) bool
+
+// AllowRegistration calls f(localpart, domain)
+func (f RegistrationPolicyFunc) AllowRegistration(localpart, domain string) bool {
+	return f(localpart, domain)
+}
+
+var (
+	// RegistrationOpen lets anyone register any free localpart
+	RegistrationOpen = RegistrationPolicyFunc(func(localpart, domain string) bool {
+		return true
+	})
+
+	// RegistrationClosed advertises registration but refuses every request,
+	// so existing users can still change their password or cancel
+	RegistrationClosed = RegistrationPolicyFunc(func(localpart, domain string) bool {
+		return false
+	})
+)
+
+// RegistrationAllowlist only allows localparts matching one of patterns,
+// which use path.Match syntax (e.g. "device-*")
+func RegistrationAllowlist(patterns ...string) RegistrationPolicy {
+	return RegistrationPolicyFunc(func(localpart, domain string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, localpart); ok {
+				return true
+			}
+		}
+		return false
+	})
+}
+
+// AccountEditor can be implemented by an AccountManager to let users
+// change their password and cancel their account with in-band
+// registration. ChangePassword sets a new password for an existing account
+// and DeleteAccount removes an account and everything stored for it.
+type AccountEditor interface {
+	ChangePassword(username, password string) (success bool, err error)
+	DeleteAccount(username string) (success bool, err error)
+}
+
+// registerQuery is the jabber:iq:register payload
+type registerQuery struct {
+	XMLName      xml.Name  `xml:"jabber:iq:register query"`
+	Instructions string    `xml:"instructions,omitempty"`
+	Registered   *struct{} `xml:"registered"`
+	Username     *string   `xml:"username"`
+	Password     *string   `xml:"password"`
+	Remove       *struct{} `xml:"remove"`
+	Form         *DataForm `xml:"x"`
+}
+
+// registerFeature returns the registration stream feature, if offered
+func registerFeature(s *Server) string {
+	if s.Registration == nil {
+		return ""
+	}
+	return "<register xmlns='" + NsRegisterFeature + "'/>"
+}
+
+// registerForm is sent to clients asking how to register
+func registerForm() *registerQuery {
+	empty := ""
+	return &registerQuery{
+		Instructions: "Choose a username and password.",
+		Username:     &empty,
+		Password:     &empty,
+		Form: &DataForm{
+			Type:         "form",
+			Title:        "Account registration",
+			Instructions: []string{"Choose a username and password."},
+			Fields: []FormField{
+				HiddenFormType(NsRegister),
+				{Var: "username", Type: "text-single", Label: "Username", Required: &struct{}{}},
+				{Var: "password", Type: "text-private", Label: "Password", Required: &struct{}{}},
+			},
+		},
+	}
+}
+
+// credentials returns the username and password of a registration request,
+// from the data form if one was submitted
+func (q *registerQuery) credentials() (string, string) {
+	if q.Form != nil && q.Form.Type == "submit" && q.Form.FormType() == NsRegister {
+		return q.Form.Value("username"), q.Form.Value("password")
+	}
+	var username, password string
+	if q.Username != nil {
+		username = *q.Username
+	}
+	if q.Password != nil {
+		password = *q.Password
+	}
+	return username, password
+}
+
+// handleRegistration answers iq if it is a jabber:iq:register request
+// addressed to the server, sending replies with reply. Before
+// authentication it registers new accounts, afterwards it changes the
+// password or cancels the account.
+func (s *Server) handleRegistration(client *Client, iq *ClientIQ, reply func(interface{})) bool {
+	if iq.Type != "get" && iq.Type != "set" {
+		return false
+	}
+	if !client.addressesAccount(iq.To) {
+		return false
+	}
+	var query registerQuery
+	if err := xml.Unmarshal(iq.Query, &query); err != nil {
+		return false
+	}
+	log.Printf("Registration request from %v: %v\n", client.jid, iq.Type)
+
+	if s.Registration == nil {
+		reply(ErrorReply(iq, StanzaServiceUnavailable("")))
+		return true
+	}
+	authenticated := client.jid.Local() != ""
+	if authenticated && client.anonymous {
+		reply(ErrorReply(iq, StanzaNotAllowed("guest accounts cannot be changed")))
+		return true
+	}
+
+	switch {
+	case iq.Type == "get" && !authenticated:
+		reply(registerResult(iq, registerForm()))
+	case iq.Type == "get":
+		username := client.jid.Local()
+		reply(registerResult(iq, &registerQuery{Registered: &struct{}{}, Username: &username}))
+	case !authenticated && query.Remove != nil:
+		reply(ErrorReply(iq, StanzaNotAuthorized("")))
+	case !authenticated:
+		s.registerAccount(client, iq, &query, reply)
+	case query.Remove != nil:
+		s.cancelAccount(client, iq, reply)
+	default:
+		s.changePassword(client, iq, &query, reply)
+	}
+	return true
+}
+
+// registerAccount creates a new account if the policy allows it
+func (s *Server) registerAccount(client *Client, iq *ClientIQ, query *registerQuery, reply func(interface{})) {
+	username, password := query.credentials()
+	if username == "" || password == "" {
+		reply(ErrorReply(iq, StanzaNotAcceptable("username and password are required")))
+		return
+	}
+	domain := client.jid.Domain()
+	localpart, ok := saslLocalpart(username, domain)
+	if !ok {
+		reply(ErrorReply(iq, StanzaJIDMalformed("")))
+		return
+	}
+	if !s.Registration.AllowRegistration(localpart, domain) {
+		reply(ErrorReply(iq, StanzaNotAllowed("")))
+		return
+	}
+	created, err := s.Accounts.CreateAccount(localpart, password)
+	if err != nil {
+		log.Printf("Registration of %v failed: %v\n", localpart, err.Error())
+		reply(ErrorReply(iq, StanzaInternalServerError("")))
+		return
+	}
+	if !created {
+		reply(ErrorReply(iq, StanzaConflict("")))
+		return
+	}
+	log.Printf("Registered %v@%v\n", localpart, domain)
+	reply(registerResult(iq, nil))
+}
+
+// changePassword sets a new password for the authenticated account
+func (s *Server) changePassword(client *Client, iq *ClientIQ, query *registerQuery, reply func(interface{})) {
+	username, password := query.credentials()
+	if password == "" {
+		reply(ErrorReply(iq, StanzaNotAcceptable("password is required")))
+		return
+	}
+	if localpart, ok := saslLocalpart(username, client.jid.Domain()); !ok || localpart != client.jid.Local() {
+		reply(ErrorReply(iq, StanzaBadRequest("username does not match the account")))
+		return
+	}
+	editor, ok := s.Accounts.(AccountEditor)
+	if !ok {
+		reply(ErrorReply(iq, StanzaFeatureNotImplemented("")))
+		return
+	}
+	changed, err := editor.ChangePassword(client.jid.Local(), password)
+	if err != nil || !changed {
+		reply(ErrorReply(iq, StanzaNotAuthorized("")))
+		return
+	}
+	log.Printf("Password changed for %v\n", client.jid.Bare())
+	reply(registerResult(iq, nil))
+}
+
+// cancelAccount deletes the authenticated account with its data and ends
+// all of its sessions
+func (s *Server) cancelAccount(client *Client, iq *ClientIQ, reply func(interface{})) {
+	editor, ok := s.Accounts.(AccountEditor)
+	if !ok {
+		reply(ErrorReply(iq, StanzaFeatureNotImplemented("")))
+		return
+	}
+	deleted, err := editor.DeleteAccount(client.jid.Local())
+	if err != nil || !deleted {
+		reply(ErrorReply(iq, StanzaNotAllowed("")))
+		return
+	}
+	log.Printf("Account %v cancelled\n", client.jid.Bare())
+	reply(registerResult(iq, nil))
+	s.dropAccount(client.jid.Bare())
+	for _, session := range s.accountSessions(client.jid.Bare()) {
+		session.send(StreamNotAuthorized("account removed"))
+	}
+}
+
+// dropAccount deletes what the server and its extensions keep for an
+// account that is going away (XEP-0077 3.2)
+func (s *Server) dropAccount(owner JID) {
+	s.dropRoster(owner)
+	for _, extension := range s.Extensions {
+		if e, ok := extension.(accountExtension); ok {
+			e.deleteAccount(owner)
+		}
+	}
+}
+
+// registerResult builds the result reply to iq
+func registerResult(iq *ClientIQ, query *registerQuery) *ClientIQ {
+	result := &ClientIQ{From: iq.To, To: iq.From, ID: iq.ID, Type: "result"}
+	if query != nil {
+		result.Query, _ = xml.Marshal(query)
+	}
+	return result
+}
@@ -0,0 +1,578 @@
+package xmpp
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+const (
+	// NsRosterVer roster versioning stream feature namespace
+	NsRosterVer = "urn:xmpp:features:rosterver"
+
+	// rosterMaxRemoved is how many removals a roster remembers for
+	// incremental updates
+	rosterMaxRemoved = 100
+)
+
+// RosterItem is a contact in a user's roster
+type RosterItem struct {
+	JID    JID
+	Name   string
+	Groups []string
+	// Subscription is "none", "to", "from" or "both", or "remove" for
+	// the removals returned by RosterStore.Changes
+	Subscription string
+	// Ask is set while the owner's subscription request to the contact is
+	// pending (pending-out), PendingIn while the contact's request to the
+	// owner is (RFC 6121 section 3)
+	Ask       bool
+	PendingIn bool
+	// Hidden items only record a pending inbound request from someone the
+	// owner has not added, they are not part of the roster the owner sees
+	// (RFC 6121 3.1.3)
+	Hidden bool
+	// Version is the roster version of the last change to the item, set
+	// by the store
+	Version uint64
+}
+
+// RosterStore keeps the rosters of users, identified by bare JID. Every
+// change increments the version of the roster (RFC 6121 section 2.6).
+type RosterStore interface {
+	// Roster returns the items of the roster of owner and its version
+	Roster(owner JID) ([]RosterItem, uint64, error)
+	// Item returns the item of contact in the roster of owner, or nil
+	Item(owner, contact JID) (*RosterItem, error)
+	// SetItem adds or replaces an item in the roster of owner and returns
+	// the new version
+	SetItem(owner JID, item RosterItem) (uint64, error)
+	// RemoveItem deletes contact from the roster of owner and returns the
+	// new version
+	RemoveItem(owner, contact JID) (uint64, error)
+	// Changes returns the items changed after version, oldest first, with
+	// removed items as "remove" subscriptions. ok is false if the store
+	// cannot tell all changes since version.
+	Changes(owner JID, version uint64) (changes []RosterItem, ok bool, err error)
+	// DeleteRoster forgets the roster of owner
+	DeleteRoster(owner JID) error
+}
+
+// entry returns the <item/> element of the item
+func (item *RosterItem) entry() RosterEntry {
+	entry := RosterEntry{Jid: item.JID, Subscription: item.Subscription, Name: item.Name, Group: item.Groups}
+	if item.Ask {
+		entry.Ask = "subscribe"
+	}
+	return entry
+}
+
+// hasTo reports whether the owner is subscribed to the contact's presence
+func (item *RosterItem) hasTo() bool {
+	return item.Subscription == "to" || item.Subscription == "both"
+}
+
+// hasFrom reports whether the contact is subscribed to the owner's presence
+func (item *RosterItem) hasFrom() bool {
+	return item.Subscription == "from" || item.Subscription == "both"
+}
+
+// setSubscription sets the subscription from its two directions
+func (item *RosterItem) setSubscription(to, from bool) {
+	switch {
+	case to && from:
+		item.Subscription = "both"
+	case to:
+		item.Subscription = "to"
+	case from:
+		item.Subscription = "from"
+	default:
+		item.Subscription = "none"
+	}
+}
+
+// rosters returns the roster store of the server, an in-memory one unless
+// Server.Rosters is set
+func (s *Server) rosters() RosterStore {
+	if s.Rosters != nil {
+		return s.Rosters
+	}
+	s.defaultRostersOnce.Do(func() {
+		s.defaultRosters = NewMemoryRosterStore()
+	})
+	return s.defaultRosters
+}
+
+// handleRoster answers jabber:iq:roster requests (RFC 6121 section 2)
+func (s *Server) handleRoster(client *Client, iq *ClientIQ) bool {
+	if iq.Type != "get" && iq.Type != "set" {
+		return false
+	}
+	var payload struct {
+		XMLName xml.Name
+	}
+	if err := xml.Unmarshal(iq.Query, &payload); err != nil || payload.XMLName != (xml.Name{Space: NsRoster, Local: "query"}) {
+		return false
+	}
+	if !client.addressesAccount(iq.To) {
+		// nobody may touch the roster of someone else (RFC 6121 2.1.5)
+		client.replyError(iq, StanzaForbidden(""))
+		return true
+	}
+	log.Printf("Roster request from %v: %v\n", client.jid, iq.Type)
+
+	if iq.Type == "get" {
+		s.sendRoster(client, iq)
+	} else {
+		s.updateRoster(client, iq)
+	}
+	return true
+}
+
+// sendRoster answers a roster get. The session gets roster pushes from now
+// on (RFC 6121 2.1.6).
+func (s *Server) sendRoster(client *Client, iq *ClientIQ) {
+	var request Roster
+	xml.Unmarshal(iq.Query, &request)
+	owner := client.jid.Bare()
+	store := s.rosters()
+	items, version, err := store.Roster(owner)
+	if err != nil {
+		log.Printf("Could not read the roster of %v: %v\n", client.jid, err.Error())
+		client.replyError(iq, StanzaInternalServerError(""))
+		return
+	}
+	items = visibleRosterItems(items)
+
+	table := &s.sessions
+	table.lock.Lock()
+	client.interested = true
+	table.lock.Unlock()
+
+	// a client with a cached roster only gets what changed since, as
+	// pushes after an empty result, unless the whole roster is smaller
+	// (RFC 6121 2.6.3)
+	if since, err := strconv.ParseUint(request.Ver, 10, 64); err == nil {
+		changes, ok, err := store.Changes(owner, since)
+		changes = visibleRosterItems(changes)
+		if err == nil && ok && len(changes) < len(items) {
+			log.Printf("Roster of %v: %v changes since version %v\n", client.jid, len(changes), since)
+			client.send(rosterResult(iq, nil))
+			for i := range changes {
+				client.send(rosterPush(client.jid, changes[i].entry(), changes[i].Version))
+			}
+			return
+		}
+	}
+
+	roster := &Roster{Ver: strconv.FormatUint(version, 10), Item: []RosterEntry{}}
+	for i := range items {
+		roster.Item = append(roster.Item, items[i].entry())
+	}
+	client.send(rosterResult(iq, roster))
+}
+
+// visibleRosterItems filters out the hidden items
+func visibleRosterItems(items []RosterItem) []RosterItem {
+	var visible []RosterItem
+	for _, item := range items {
+		if !item.Hidden {
+			visible = append(visible, item)
+		}
+	}
+	return visible
+}
+
+// updateRoster adds, updates or removes the item of a roster set
+func (s *Server) updateRoster(client *Client, iq *ClientIQ) {
+	var request RosterRequest
+	if err := xml.Unmarshal(iq.Query, &request); err != nil || len(request.Item) != 1 {
+		client.replyError(iq, StanzaBadRequest("a roster set has exactly one item"))
+		return
+	}
+	requested := request.Item[0]
+	if requested.Jid.IsZero() {
+		client.replyError(iq, StanzaBadRequest("missing jid"))
+		return
+	}
+	if stanzaErr := checkRosterGroups(requested.Group); stanzaErr != nil {
+		client.replyError(iq, stanzaErr)
+		return
+	}
+
+	owner := client.jid.Bare()
+	store := s.rosters()
+	s.rosterLock.Lock()
+	defer s.rosterLock.Unlock()
+	existing, err := store.Item(owner, requested.Jid)
+	if err != nil {
+		log.Printf("Could not read the roster of %v: %v\n", owner, err.Error())
+		client.replyError(iq, StanzaInternalServerError(""))
+		return
+	}
+
+	if requested.Subscription == "remove" {
+		if existing == nil || existing.Hidden {
+			client.replyError(iq, StanzaItemNotFound(""))
+			return
+		}
+		version, err := store.RemoveItem(owner, requested.Jid)
+		if err != nil {
+			log.Printf("Could not update the roster of %v: %v\n", owner, err.Error())
+			client.replyError(iq, StanzaInternalServerError(""))
+			return
+		}
+		client.send(rosterResult(iq, nil))
+		s.pushRoster(owner, RosterEntry{Jid: requested.Jid, Subscription: "remove"}, version)
+		s.cancelSubscriptions(owner, existing)
+		return
+	}
+
+	// clients only choose the name and groups, the subscription is the
+	// server's business (RFC 6121 2.1.2.5)
+	item := RosterItem{Subscription: "none"}
+	if existing != nil {
+		item = *existing
+	}
+	item.JID = requested.Jid
+	item.Name = requested.Name
+	item.Groups = requested.Group
+	item.Hidden = false
+	version, err := store.SetItem(owner, item)
+	if err != nil {
+		log.Printf("Could not update the roster of %v: %v\n", owner, err.Error())
+		client.replyError(iq, StanzaInternalServerError(""))
+		return
+	}
+	client.send(rosterResult(iq, nil))
+	s.pushRoster(owner, item.entry(), version)
+}
+
+// checkRosterGroups validates the groups of a roster set (RFC 6121 2.1.2.2)
+func checkRosterGroups(groups []string) *ClientError {
+	seen := make(map[string]bool)
+	for _, group := range groups {
+		if group == "" {
+			return StanzaNotAcceptable("empty group name")
+		}
+		if seen[group] {
+			return StanzaBadRequest("duplicate group " + group)
+		}
+		seen[group] = true
+	}
+	return nil
+}
+
+// pushRoster sends an item changed in the given roster version to the
+// sessions of owner that requested the roster (RFC 6121 2.1.6)
+func (s *Server) pushRoster(owner JID, entry RosterEntry, version uint64) {
+	var interested []*Client
+	table := &s.sessions
+	table.lock.Lock()
+	for jid, session := range table.sessions {
+		if jid.Bare() == owner && session.interested {
+			interested = append(interested, session)
+		}
+	}
+	table.lock.Unlock()
+
+	for _, session := range interested {
+		session.push(rosterPush(session.jid, entry, version))
+	}
+}
+
+// rosterPush builds a roster push of entry to the session to
+func rosterPush(to JID, entry RosterEntry, version uint64) *ClientIQ {
+	push := &ClientIQ{To: to, ID: fmt.Sprintf("push%x", randomBytes(8)), Type: "set"}
+	push.Query, _ = xml.Marshal(&Roster{Ver: strconv.FormatUint(version, 10), Item: []RosterEntry{entry}})
+	return push
+}
+
+// rosterResult builds the result to iq, carrying roster if not nil
+func rosterResult(iq *ClientIQ, roster *Roster) *ClientIQ {
+	result := &ClientIQ{From: iq.To, To: iq.From, ID: iq.ID, Type: "result"}
+	if roster != nil {
+		result.Query, _ = xml.Marshal(roster)
+	}
+	return result
+}
+
+// rosterData is a roster with the history needed for versioning
+type rosterData struct {
+	Version uint64
+	Items   []RosterItem
+	// Removed holds the latest removals, the ones up to version Horizon
+	// are forgotten
+	Removed []RosterItem
+	Horizon uint64
+}
+
+// set adds or replaces item and returns the new version
+func (r *rosterData) set(item RosterItem) uint64 {
+	r.Version++
+	item.Version = r.Version
+	r.Items = setRosterItem(r.Items, item)
+	r.Removed = removeRosterItem(r.Removed, item.JID)
+	return r.Version
+}
+
+// remove deletes contact and returns the new version
+func (r *rosterData) remove(contact JID) uint64 {
+	if findRosterItem(r.Items, contact) == nil {
+		return r.Version
+	}
+	r.Version++
+	r.Items = removeRosterItem(r.Items, contact)
+	r.Removed = append(removeRosterItem(r.Removed, contact), RosterItem{JID: contact, Subscription: "remove", Version: r.Version})
+	if len(r.Removed) > rosterMaxRemoved {
+		r.Horizon = r.Removed[0].Version
+		r.Removed = r.Removed[1:]
+	}
+	return r.Version
+}
+
+// changes returns the items changed after version, oldest first
+func (r *rosterData) changes(version uint64) ([]RosterItem, bool) {
+	if version < r.Horizon || version > r.Version {
+		return nil, false
+	}
+	var changes []RosterItem
+	for _, items := range [][]RosterItem{r.Items, r.Removed} {
+		for _, item := range items {
+			if item.Version > version {
+				changes = append(changes, item)
+			}
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Version < changes[j].Version })
+	return changes, true
+}
+
+// MemoryRosterStore is a RosterStore that keeps everything in memory
+type MemoryRosterStore struct {
+	lock    sync.Mutex
+	rosters map[JID]*rosterData
+}
+
+// NewMemoryRosterStore returns an empty in-memory roster store
+func NewMemoryRosterStore() *MemoryRosterStore {
+	return &MemoryRosterStore{rosters: make(map[JID]*rosterData)}
+}
+
+// roster returns the roster of owner, or an empty one that is not kept if
+// owner has none
+func (m *MemoryRosterStore) roster(owner JID) *rosterData {
+	if roster := m.rosters[owner]; roster != nil {
+		return roster
+	}
+	return &rosterData{}
+}
+
+// Roster returns the items of the roster of owner and its version
+func (m *MemoryRosterStore) Roster(owner JID) ([]RosterItem, uint64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	roster := m.roster(owner)
+	return append([]RosterItem(nil), roster.Items...), roster.Version, nil
+}
+
+// Item returns the item of contact in the roster of owner, or nil
+func (m *MemoryRosterStore) Item(owner, contact JID) (*RosterItem, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return findRosterItem(m.roster(owner).Items, contact), nil
+}
+
+// SetItem adds or replaces an item in the roster of owner
+func (m *MemoryRosterStore) SetItem(owner JID, item RosterItem) (uint64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	roster := m.roster(owner)
+	m.rosters[owner] = roster
+	return roster.set(item), nil
+}
+
+// RemoveItem deletes contact from the roster of owner
+func (m *MemoryRosterStore) RemoveItem(owner, contact JID) (uint64, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	return m.roster(owner).remove(contact), nil
+}
+
+// Changes returns the items changed in the roster of owner after version
+func (m *MemoryRosterStore) Changes(owner JID, version uint64) ([]RosterItem, bool, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	changes, ok := m.roster(owner).changes(version)
+	return changes, ok, nil
+}
+
+// DeleteRoster forgets the roster of owner
+func (m *MemoryRosterStore) DeleteRoster(owner JID) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	delete(m.rosters, owner)
+	return nil
+}
+
+// findRosterItem returns a copy of the item of contact in items, or nil
+func findRosterItem(items []RosterItem, contact JID) *RosterItem {
+	for i := range items {
+		if items[i].JID == contact {
+			item := items[i]
+			return &item
+		}
+	}
+	return nil
+}
+
+// setRosterItem replaces the item with the same JID in items or appends it
+func setRosterItem(items []RosterItem, item RosterItem) []RosterItem {
+	for i := range items {
+		if items[i].JID == item.JID {
+			items[i] = item
+			return items
+		}
+	}
+	return append(items, item)
+}
+
+// removeRosterItem deletes the item of contact from items
+func removeRosterItem(items []RosterItem, contact JID) []RosterItem {
+	for i := range items {
+		if items[i].JID == contact {
+			return append(items[:i], items[i+1:]...)
+		}
+	}
+	return items
+}
+
+// FileRosterStore is a RosterStore that keeps one JSON file per user in a
+// directory
+type FileRosterStore struct {
+	lock sync.Mutex
+	dir  string
+}
+
+// NewFileRosterStore returns a store keeping its files in dir, which is
+// created if needed
+func NewFileRosterStore(dir string) (*FileRosterStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &FileRosterStore{dir: dir}, nil
+}
+
+// path returns the roster file of owner
+func (f *FileRosterStore) path(owner JID) string {
+	return filepath.Join(f.dir, url.PathEscape(owner.String())+".roster")
+}
+
+// load reads the roster file of owner
+func (f *FileRosterStore) load(owner JID) (*rosterData, error) {
+	data, err := os.ReadFile(f.path(owner))
+	if os.IsNotExist(err) {
+		return &rosterData{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	roster := &rosterData{}
+	err = json.Unmarshal(data, roster)
+	return roster, err
+}
+
+// save writes the roster file of owner
+func (f *FileRosterStore) save(owner JID, roster *rosterData) error {
+	data, err := json.Marshal(roster)
+	if err != nil {
+		return err
+	}
+	// write a new file and rename it over the old one so a crash never
+	// leaves half of the roster behind
+	path := f.path(owner)
+	if err := os.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// Roster returns the items of the roster of owner and its version
+func (f *FileRosterStore) Roster(owner JID) ([]RosterItem, uint64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	roster, err := f.load(owner)
+	if err != nil {
+		return nil, 0, err
+	}
+	return roster.Items, roster.Version, nil
+}
+
+// Item returns the item of contact in the roster of owner, or nil
+func (f *FileRosterStore) Item(owner, contact JID) (*RosterItem, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	roster, err := f.load(owner)
+	if err != nil {
+		return nil, err
+	}
+	return findRosterItem(roster.Items, contact), nil
+}
+
+// SetItem adds or replaces an item in the roster of owner
+func (f *FileRosterStore) SetItem(owner JID, item RosterItem) (uint64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	roster, err := f.load(owner)
+	if err != nil {
+		return 0, err
+	}
+	version := roster.set(item)
+	return version, f.save(owner, roster)
+}
+
+// RemoveItem deletes contact from the roster of owner
+func (f *FileRosterStore) RemoveItem(owner, contact JID) (uint64, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	roster, err := f.load(owner)
+	if err != nil {
+		return 0, err
+	}
+	if findRosterItem(roster.Items, contact) == nil {
+		// nothing to write, and no file for rosters that never existed
+		return roster.Version, nil
+	}
+	version := roster.remove(contact)
+	return version, f.save(owner, roster)
+}
+
+// Changes returns the items changed in the roster of owner after version
+func (f *FileRosterStore) Changes(owner JID, version uint64) ([]RosterItem, bool, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	roster, err := f.load(owner)
+	if err != nil {
+		return nil, false, err
+	}
+	changes, ok := roster.changes(version)
+	return changes, ok, nil
+}
+
+// DeleteRoster removes the roster file of owner
+func (f *FileRosterStore) DeleteRoster(owner JID) error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	err := os.Remove(f.path(owner))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,123 @@
+package xmpp
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// rosterTestJID returns the JID of a contact in the roster tests
+func rosterTestJID(t *testing.T, local string) JID {
+	t.Helper()
+	jid, err := ParseJID(local + "@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return jid
+}
+
+// describeChanges lists changes as jid:subscription@version
+func describeChanges(changes []RosterItem) []string {
+	var described []string
+	for _, item := range changes {
+		described = append(described, fmt.Sprintf("%v:%v@%v", item.JID.Local(), item.Subscription, item.Version))
+	}
+	return described
+}
+
+func TestRosterDataChanges(t *testing.T) {
+	roster := rosterData{
+		Version: 6,
+		Items: []RosterItem{
+			{JID: rosterTestJID(t, "bob"), Subscription: "both", Version: 5},
+			{JID: rosterTestJID(t, "carol"), Subscription: "to", Version: 4},
+		},
+		Removed: []RosterItem{
+			{JID: rosterTestJID(t, "alice"), Subscription: "remove", Version: 3},
+			{JID: rosterTestJID(t, "dave"), Subscription: "remove", Version: 6},
+		},
+		Horizon: 2,
+	}
+
+	tests := []struct {
+		name    string
+		version uint64
+		changes []string
+		ok      bool
+	}{
+		{"before the horizon", 1, nil, false},
+		{"at the horizon", 2, []string{"alice:remove@3", "carol:to@4", "bob:both@5", "dave:remove@6"}, true},
+		{"some changes", 4, []string{"bob:both@5", "dave:remove@6"}, true},
+		{"up to date", 6, nil, true},
+		{"from the future", 7, nil, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			changes, ok := roster.changes(test.version)
+			if ok != test.ok {
+				t.Fatalf("ok %v, want %v", ok, test.ok)
+			}
+			if described := describeChanges(changes); !reflect.DeepEqual(described, test.changes) {
+				t.Errorf("changes %v, want %v", described, test.changes)
+			}
+		})
+	}
+}
+
+func TestRosterDataRemovals(t *testing.T) {
+	tests := []struct {
+		name       string
+		removals   int
+		remembered int
+		horizon    uint64
+	}{
+		{"all remembered", rosterMaxRemoved, rosterMaxRemoved, 0},
+		{"oldest forgotten", rosterMaxRemoved + 1, rosterMaxRemoved, 2},
+		{"several forgotten", rosterMaxRemoved + 3, rosterMaxRemoved, 6},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			// every contact is added then removed, the removals get the
+			// even versions
+			var roster rosterData
+			for i := 0; i < test.removals; i++ {
+				contact := rosterTestJID(t, fmt.Sprintf("contact%d", i))
+				roster.set(RosterItem{JID: contact, Subscription: "none"})
+				roster.remove(contact)
+			}
+			if roster.Horizon != test.horizon || len(roster.Removed) != test.remembered {
+				t.Fatalf("horizon %v with %v removals, want %v with %v", roster.Horizon, len(roster.Removed), test.horizon, test.remembered)
+			}
+			if test.horizon > 0 {
+				if _, ok := roster.changes(test.horizon - 1); ok {
+					t.Error("changes from before the horizon")
+				}
+			}
+			changes, ok := roster.changes(test.horizon)
+			if !ok || len(changes) != test.remembered {
+				t.Fatalf("%v changes from the horizon, want %v", len(changes), test.remembered)
+			}
+			for _, item := range changes {
+				if item.Subscription != "remove" {
+					t.Errorf("change %v is not a removal", item.JID)
+				}
+			}
+		})
+	}
+}
+
+func TestRosterDataReadd(t *testing.T) {
+	var roster rosterData
+	bob := rosterTestJID(t, "bob")
+	roster.set(RosterItem{JID: bob, Subscription: "none"})
+	roster.remove(bob)
+	roster.set(RosterItem{JID: bob, Subscription: "to"})
+
+	changes, ok := roster.changes(0)
+	if described := describeChanges(changes); !ok || !reflect.DeepEqual(described, []string{"bob:to@3"}) {
+		t.Errorf("changes %v, want only the new item", described)
+	}
+	if version := roster.remove(rosterTestJID(t, "carol")); version != 3 {
+		t.Errorf("removing a missing contact changed the version to %v", version)
+	}
+}
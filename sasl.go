@@ -0,0 +1,359 @@
+package xmpp
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"unicode/utf8"
+)
+
+// maxAuthAttempts is the number of failed SASL exchanges allowed on a
+// stream before it is closed.
+const maxAuthAttempts = 3
+
+// saslMechanism performs the server side of a single SASL exchange.
+type saslMechanism interface {
+	// Next consumes the client's decoded response and returns the next
+	// challenge. When done is true the exchange completed successfully and
+	// challenge holds the additional data to send with <success/>.
+	Next(response []byte) (challenge []byte, done bool, err error)
+	// Username returns the authenticated localpart once the exchange is done
+	Username() string
+}
+
+// saslError is a SASL failure condition (RFC 6120 6.5)
+type saslError struct {
+	Condition string
+}
+
+func (e *saslError) Error() string {
+	return "sasl: " + e.Condition
+}
+
+var (
+	errSASLAborted              = &saslError{Condition: "aborted"}
+	errSASLIncorrectEncoding    = &saslError{Condition: "incorrect-encoding"}
+	errSASLInvalidAuthzid       = &saslError{Condition: "invalid-authzid"}
+	errSASLInvalidMechanism     = &saslError{Condition: "invalid-mechanism"}
+	errSASLMalformedRequest     = &saslError{Condition: "malformed-request"}
+	errSASLNotAuthorized        = &saslError{Condition: "not-authorized"}
+	errSASLTemporaryAuthFailure = &saslError{Condition: "temporary-auth-failure"}
+)
+
+// saslMechanismInfo describes a mechanism the server can offer
+type saslMechanismInfo struct {
+	Name string
+	// Available reports whether the mechanism may be offered on the stream
+	Available func(c *Connection, client *Client, s *Server) bool
+	// Start begins a new exchange
+	Start func(c *Connection, client *Client, s *Server) saslMechanism
+}
+
+// saslMechanismList holds every supported mechanism in order of preference
+var saslMechanismList = []saslMechanismInfo{
+	{
+		Name: "EXTERNAL",
+		Available: func(c *Connection, client *Client, s *Server) bool {
+			return s.CertificateMapper != nil && c.clientCertificate() != nil
+		},
+		Start: func(c *Connection, client *Client, s *Server) saslMechanism {
+			return &externalMechanism{conn: c, client: client, server: s}
+		},
+	},
+	{
+		Name:      "SCRAM-SHA-256-PLUS",
+		Available: func(c *Connection, client *Client, s *Server) bool { return len(c.channelBindingTypes()) > 0 },
+		Start: func(c *Connection, client *Client, s *Server) saslMechanism {
+			return newScramMechanism("SCRAM-SHA-256-PLUS", c, client, s)
+		},
+	},
+	{
+		Name:      "SCRAM-SHA-1-PLUS",
+		Available: func(c *Connection, client *Client, s *Server) bool { return len(c.channelBindingTypes()) > 0 },
+		Start: func(c *Connection, client *Client, s *Server) saslMechanism {
+			return newScramMechanism("SCRAM-SHA-1-PLUS", c, client, s)
+		},
+	},
+	{
+		Name:      "SCRAM-SHA-256",
+		Available: func(c *Connection, client *Client, s *Server) bool { return true },
+		Start: func(c *Connection, client *Client, s *Server) saslMechanism {
+			return newScramMechanism("SCRAM-SHA-256", c, client, s)
+		},
+	},
+	{
+		Name:      "SCRAM-SHA-1",
+		Available: func(c *Connection, client *Client, s *Server) bool { return true },
+		Start: func(c *Connection, client *Client, s *Server) saslMechanism {
+			return newScramMechanism("SCRAM-SHA-1", c, client, s)
+		},
+	},
+	{
+		Name:      "PLAIN",
+		Available: func(c *Connection, client *Client, s *Server) bool { return true },
+		Start: func(c *Connection, client *Client, s *Server) saslMechanism {
+			return &plainMechanism{client: client, server: s}
+		},
+	},
+	{
+		Name: "ANONYMOUS",
+		Available: func(c *Connection, client *Client, s *Server) bool {
+			return s.domainConfig(client.jid.Domain()).AllowAnonymous
+		},
+		Start: func(c *Connection, client *Client, s *Server) saslMechanism {
+			return &anonymousMechanism{client: client}
+		},
+	},
+	{
+		Name:      "OAUTHBEARER",
+		Available: func(c *Connection, client *Client, s *Server) bool { return s.TokenValidator != nil },
+		Start: func(c *Connection, client *Client, s *Server) saslMechanism {
+			return &oauthBearerMechanism{client: client, server: s}
+		},
+	},
+	{
+		Name:      "X-OAUTH2",
+		Available: func(c *Connection, client *Client, s *Server) bool { return s.TokenValidator != nil },
+		Start: func(c *Connection, client *Client, s *Server) saslMechanism {
+			return &xOAuth2Mechanism{client: client, server: s}
+		},
+	},
+}
+
+// saslAvailable returns the names of the mechanisms available on the stream
+func saslAvailable(c *Connection, client *Client, s *Server) []string {
+	var names []string
+	for _, info := range saslMechanismList {
+		if info.Available(c, client, s) {
+			names = append(names, info.Name)
+		}
+	}
+	return names
+}
+
+// saslFeature renders the <mechanisms/> stream feature along with the
+// channel binding types supported on the stream (XEP-0440)
+func saslFeature(c *Connection, client *Client, s *Server) string {
+	data, _ := xml.Marshal(saslMechanisms{Mechanism: saslAvailable(c, client, s)})
+	feature := string(data)
+	if types := c.channelBindingTypes(); len(types) > 0 {
+		cb := saslChannelBinding{}
+		for _, t := range types {
+			cb.ChannelBinding = append(cb.ChannelBinding, saslChannelBindingType{Type: t})
+		}
+		data, _ = xml.Marshal(cb)
+		feature += string(data)
+	}
+	return feature
+}
+
+// saslDecode decodes the base64 payload of an <auth/> or <response/>
+func saslDecode(body string) ([]byte, error) {
+	body = string(bytes.TrimSpace([]byte(body)))
+	if body == "=" || body == "" {
+		return []byte{}, nil
+	}
+	data, err := base64.StdEncoding.DecodeString(body)
+	if err != nil {
+		return nil, errSASLIncorrectEncoding
+	}
+	return data, nil
+}
+
+// saslEncode encodes data for a <challenge/> or <success/>
+func saslEncode(data []byte) string {
+	if len(data) == 0 {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(data)
+}
+
+// saslAuthenticate runs a complete SASL exchange starting from the <auth/>
+// element. It returns true when the client has authenticated. Failures the
+// client may recover from are reported with a <failure/> and false.
+func saslAuthenticate(c *Connection, client *Client, s *Server, auth *saslAuth) (bool, error) {
+	log.Printf("SASL mechanism: %v\n", auth.Mechanism)
+
+	var info *saslMechanismInfo
+	for i := range saslMechanismList {
+		if saslMechanismList[i].Name == auth.Mechanism && saslMechanismList[i].Available(c, client, s) {
+			info = &saslMechanismList[i]
+			break
+		}
+	}
+	if info == nil {
+		return false, saslFailure(c, errSASLInvalidMechanism)
+	}
+	mechanism := info.Start(c, client, s)
+
+	data, err := saslDecode(auth.Body)
+	if err != nil {
+		return false, saslFailure(c, err)
+	}
+	if auth.Body == "" {
+		// no initial response, ask for one with an empty challenge
+		data, err = saslChallengeResponse(c, nil)
+		if err != nil {
+			return false, saslFailure(c, err)
+		}
+	}
+
+	for {
+		challenge, done, err := mechanism.Next(data)
+		if err != nil {
+			return false, saslFailure(c, err)
+		}
+		if done {
+			jid, err := NewJID(mechanism.Username(), client.jid.Domain(), "")
+			if err != nil {
+				return false, saslFailure(c, errSASLNotAuthorized)
+			}
+			client.jid = jid
+			if len(challenge) > 0 {
+				c.SendRawf("<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'>%s</success>", saslEncode(challenge))
+			} else {
+				c.SendRaw("<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>")
+			}
+			return true, nil
+		}
+		data, err = saslChallengeResponse(c, challenge)
+		if err != nil {
+			return false, saslFailure(c, err)
+		}
+	}
+}
+
+// saslChallengeResponse sends a challenge and reads the client's response
+func saslChallengeResponse(c *Connection, challenge []byte) ([]byte, error) {
+	c.SendRawf("<challenge xmlns='urn:ietf:params:xml:ns:xmpp-sasl'>%s</challenge>", saslEncode(challenge))
+	se, err := c.Next()
+	if err != nil {
+		return nil, err
+	}
+	_, val, err := c.Read(se)
+	if err != nil {
+		return nil, err
+	}
+	switch v := val.(type) {
+	case *saslResponse:
+		return saslDecode(v.Body)
+	case *saslAbort:
+		return nil, errSASLAborted
+	default:
+		return nil, errSASLMalformedRequest
+	}
+}
+
+// saslFailure reports a SASL error condition to the client. Errors that are
+// not SASL conditions are stream level problems and are returned unchanged.
+func saslFailure(c *Connection, err error) error {
+	var saslErr *saslError
+	if !errors.As(err, &saslErr) {
+		return err
+	}
+	log.Printf("SASL failure: %v\n", saslErr.Condition)
+	return c.SendRawf("<failure xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><%s/></failure>", saslErr.Condition)
+}
+
+// Authorizer can be implemented by an AccountManager to let an account act
+// as another one. Authorize reports whether authcid may act as the account
+// authzid (the SASL authorization identity).
+type Authorizer interface {
+	Authorize(authcid, authzid string) (allowed bool, err error)
+}
+
+// saslAuthorize decides which localpart a client authenticated as authcid
+// acts as. An empty authzid means authcid itself; acting as anyone else has
+// to be allowed by an AccountManager that is an Authorizer.
+func saslAuthorize(s *Server, client *Client, authcid, authzid string) (string, error) {
+	if authzid == "" {
+		return authcid, nil
+	}
+	localpart, ok := saslLocalpart(authzid, client.jid.Domain())
+	if !ok {
+		return "", errSASLInvalidAuthzid
+	}
+	if localpart == authcid {
+		return authcid, nil
+	}
+	authorizer, ok := s.Accounts.(Authorizer)
+	if !ok {
+		return "", errSASLInvalidAuthzid
+	}
+	allowed, err := authorizer.Authorize(authcid, localpart)
+	if err != nil {
+		return "", errSASLTemporaryAuthFailure
+	}
+	if !allowed {
+		return "", errSASLInvalidAuthzid
+	}
+	log.Printf("SASL %v acting as %v\n", authcid, localpart)
+	return localpart, nil
+}
+
+// plainMechanism implements SASL PLAIN (RFC 4616)
+type plainMechanism struct {
+	client   *Client
+	server   *Server
+	username string
+}
+
+// Next parses [authzid] NUL authcid NUL passwd and verifies the password
+func (m *plainMechanism) Next(response []byte) ([]byte, bool, error) {
+	if !utf8.Valid(response) {
+		return nil, false, errSASLMalformedRequest
+	}
+	info := bytes.Split(response, []byte{0})
+	if len(info) != 3 {
+		return nil, false, errSASLMalformedRequest
+	}
+	authzid, authcid, password := string(info[0]), string(info[1]), string(info[2])
+	if authcid == "" || password == "" || len(authzid) > 255 || len(authcid) > 255 || len(password) > 255 {
+		return nil, false, errSASLMalformedRequest
+	}
+	authcid, ok := saslLocalpart(authcid, m.client.jid.Domain())
+	if !ok {
+		return nil, false, errSASLNotAuthorized
+	}
+
+	success, err := m.server.Accounts.Authenticate(authcid, password)
+	if err != nil {
+		return nil, false, fmt.Errorf("authenticate %s: %w", authcid, err)
+	}
+	if !success {
+		return nil, false, errSASLNotAuthorized
+	}
+	username, err := saslAuthorize(m.server, m.client, authcid, authzid)
+	if err != nil {
+		return nil, false, err
+	}
+	m.username = username
+	return nil, true, nil
+}
+
+// Username returns the localpart the client acts as
+func (m *plainMechanism) Username() string {
+	return m.username
+}
+
+// anonymousMechanism implements SASL ANONYMOUS (RFC 4505). The client is
+// given a random temporary localpart.
+type anonymousMechanism struct {
+	client   *Client
+	username string
+}
+
+// Next ignores the optional trace information and creates a guest
+func (m *anonymousMechanism) Next(response []byte) ([]byte, bool, error) {
+	m.username = makeResource()
+	m.client.anonymous = true
+	return nil, true, nil
+}
+
+// Username returns the generated guest localpart
+func (m *anonymousMechanism) Username() string {
+	return m.username
+}
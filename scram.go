@@ -0,0 +1,342 @@
+package xmpp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+)
+
+// ScramMinIterations is the lowest iteration count accepted for stored keys
+const ScramMinIterations = 4096
+
+// ScramKeys are the credentials a server stores for SCRAM authentication
+// (RFC 5802 section 3). The password itself is not needed to verify a client.
+type ScramKeys struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewScramKeys derives the stored SCRAM credentials for password. mechanism
+// is one of SCRAM-SHA-1 or SCRAM-SHA-256. If salt is nil a random one is
+// generated.
+func NewScramKeys(mechanism, password string, salt []byte, iterations int) (*ScramKeys, error) {
+	h := scramHash(mechanism)
+	if h == nil {
+		return nil, errors.New("unsupported SCRAM mechanism " + mechanism)
+	}
+	if iterations < ScramMinIterations {
+		iterations = ScramMinIterations
+	}
+	if salt == nil {
+		salt = make([]byte, 16)
+		if _, err := rand.Read(salt); err != nil {
+			return nil, err
+		}
+	}
+	salted := scramHi(h, []byte(password), salt, iterations)
+	clientKey := scramHMAC(h, salted, []byte("Client Key"))
+	storedKey := h()
+	storedKey.Write(clientKey)
+	return &ScramKeys{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey.Sum(nil),
+		ServerKey:  scramHMAC(h, salted, []byte("Server Key")),
+	}, nil
+}
+
+// scramHash returns the hash function for a SCRAM mechanism name
+func scramHash(mechanism string) func() hash.Hash {
+	switch strings.TrimSuffix(mechanism, "-PLUS") {
+	case "SCRAM-SHA-1":
+		return sha1.New
+	case "SCRAM-SHA-256":
+		return sha256.New
+	}
+	return nil
+}
+
+// scramHMAC computes HMAC(key, data)
+func scramHMAC(h func() hash.Hash, key, data []byte) []byte {
+	mac := hmac.New(h, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// scramHi is the Hi() function of RFC 5802, which is PBKDF2 with a single
+// output block.
+func scramHi(h func() hash.Hash, password, salt []byte, iterations int) []byte {
+	mac := hmac.New(h, password)
+	mac.Write(salt)
+	mac.Write([]byte{0, 0, 0, 1})
+	u := mac.Sum(nil)
+	result := make([]byte, len(u))
+	copy(result, u)
+	for i := 1; i < iterations; i++ {
+		mac.Reset()
+		mac.Write(u)
+		u = mac.Sum(u[:0])
+		for j := range result {
+			result[j] ^= u[j]
+		}
+	}
+	return result
+}
+
+// scramMechanism implements the server side of SCRAM-SHA-1 and
+// SCRAM-SHA-256, and their channel binding -PLUS variants (RFC 5802, 7677)
+type scramMechanism struct {
+	mechanism string
+	plus      bool
+	hash      func() hash.Hash
+	conn      *Connection
+	client    *Client
+	server    *Server
+
+	step            int
+	authcid         string
+	authzid         string
+	username        string
+	gs2Header       string
+	cbData          []byte
+	clientFirstBare string
+	serverFirst     string
+	nonce           string
+	keys            *ScramKeys
+}
+
+func newScramMechanism(mechanism string, c *Connection, client *Client, s *Server) *scramMechanism {
+	return &scramMechanism{
+		mechanism: strings.TrimSuffix(mechanism, "-PLUS"),
+		plus:      strings.HasSuffix(mechanism, "-PLUS"),
+		hash:      scramHash(mechanism),
+		conn:      c,
+		client:    client,
+		server:    s,
+	}
+}
+
+// Next advances the exchange
+func (m *scramMechanism) Next(response []byte) ([]byte, bool, error) {
+	m.step++
+	switch m.step {
+	case 1:
+		return m.clientFirst(string(response))
+	case 2:
+		return m.clientFinal(string(response))
+	}
+	return nil, false, errSASLMalformedRequest
+}
+
+// Username returns the localpart the client acts as
+func (m *scramMechanism) Username() string {
+	return m.username
+}
+
+// clientFirst handles client-first-message and answers with server-first-message
+func (m *scramMechanism) clientFirst(message string) ([]byte, bool, error) {
+	// gs2-header: gs2-cbind-flag "," [ authzid ] ","
+	parts := strings.SplitN(message, ",", 3)
+	if len(parts) != 3 {
+		return nil, false, errSASLMalformedRequest
+	}
+	if err := m.channelBinding(parts[0]); err != nil {
+		return nil, false, err
+	}
+	authzid := ""
+	if parts[1] != "" {
+		if !strings.HasPrefix(parts[1], "a=") {
+			return nil, false, errSASLMalformedRequest
+		}
+		var err error
+		if authzid, err = scramUnescape(parts[1][2:]); err != nil {
+			return nil, false, err
+		}
+	}
+	m.gs2Header = parts[0] + "," + parts[1] + ","
+	m.clientFirstBare = parts[2]
+
+	attrs, err := scramAttributes(m.clientFirstBare)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(attrs) < 2 || attrs[0][0] != "n" || attrs[1][0] != "r" {
+		// a leading m= marks a mandatory extension we do not understand
+		return nil, false, errSASLMalformedRequest
+	}
+	username, err := scramUnescape(attrs[0][1])
+	if err != nil {
+		return nil, false, err
+	}
+	clientNonce := attrs[1][1]
+	if username == "" || clientNonce == "" {
+		return nil, false, errSASLMalformedRequest
+	}
+	if normalized, ok := saslLocalpart(username, m.client.jid.Domain()); ok {
+		// an invalid username simply has no keys
+		username = normalized
+	}
+	m.authcid = username
+	m.authzid = authzid
+
+	keys, err := m.server.Accounts.ScramKeys(username, m.mechanism)
+	if err != nil {
+		return nil, false, errSASLTemporaryAuthFailure
+	}
+	if keys == nil {
+		// unknown user: continue with made up keys so the failure looks
+		// the same as a bad password
+		salt := m.server.fakeScramSalt(m.mechanism, username)
+		keys, err = NewScramKeys(m.mechanism, string(randomBytes(16)), salt, ScramMinIterations)
+		if err != nil {
+			return nil, false, errSASLTemporaryAuthFailure
+		}
+		keys.StoredKey = nil
+	}
+	m.keys = keys
+
+	m.nonce = clientNonce + base64.RawStdEncoding.EncodeToString(randomBytes(18))
+	m.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", m.nonce, base64.StdEncoding.EncodeToString(keys.Salt), keys.Iterations)
+	return []byte(m.serverFirst), false, nil
+}
+
+// fakeScramSalt returns the salt shown to clients logging in as an unknown
+// user. It stays the same across attempts, so that it does not tell the
+// account does not exist.
+func (s *Server) fakeScramSalt(mechanism, username string) []byte {
+	s.scramSecretOnce.Do(func() {
+		s.scramSecret = randomBytes(32)
+	})
+	mac := hmac.New(sha256.New, s.scramSecret)
+	mac.Write([]byte(mechanism + "\x00" + username))
+	return mac.Sum(nil)[:16]
+}
+
+// channelBinding checks the gs2-cbind-flag and looks up the binding data
+func (m *scramMechanism) channelBinding(flag string) error {
+	switch {
+	case flag == "n":
+		if m.plus {
+			return errSASLMalformedRequest
+		}
+	case flag == "y":
+		// the client supports channel binding but thinks we do not, which
+		// means the mechanism list was tampered with
+		if m.plus || len(m.conn.channelBindingTypes()) > 0 {
+			return errSASLNotAuthorized
+		}
+	case strings.HasPrefix(flag, "p="):
+		if !m.plus {
+			return errSASLMalformedRequest
+		}
+		cbType := flag[2:]
+		supported := false
+		for _, t := range m.conn.channelBindingTypes() {
+			supported = supported || t == cbType
+		}
+		if !supported {
+			return errSASLMalformedRequest
+		}
+		data, err := m.conn.channelBinding(cbType)
+		if err != nil {
+			return errSASLTemporaryAuthFailure
+		}
+		m.cbData = data
+	default:
+		return errSASLMalformedRequest
+	}
+	return nil
+}
+
+// clientFinal verifies the client proof and returns server-final-message
+func (m *scramMechanism) clientFinal(message string) ([]byte, bool, error) {
+	attrs, err := scramAttributes(message)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(attrs) < 3 || attrs[0][0] != "c" || attrs[1][0] != "r" || attrs[len(attrs)-1][0] != "p" {
+		return nil, false, errSASLMalformedRequest
+	}
+	binding, err := base64.StdEncoding.DecodeString(attrs[0][1])
+	if err != nil || subtle.ConstantTimeCompare(binding, append([]byte(m.gs2Header), m.cbData...)) != 1 {
+		return nil, false, errSASLNotAuthorized
+	}
+	if attrs[1][1] != m.nonce {
+		return nil, false, errSASLNotAuthorized
+	}
+	proof, err := base64.StdEncoding.DecodeString(attrs[len(attrs)-1][1])
+	if err != nil {
+		return nil, false, errSASLIncorrectEncoding
+	}
+
+	withoutProof := message[:strings.LastIndex(message, ",p=")]
+	authMessage := []byte(m.clientFirstBare + "," + m.serverFirst + "," + withoutProof)
+
+	clientSignature := scramHMAC(m.hash, m.keys.StoredKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return nil, false, errSASLNotAuthorized
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := m.hash()
+	storedKey.Write(clientKey)
+	if m.keys.StoredKey == nil || subtle.ConstantTimeCompare(storedKey.Sum(nil), m.keys.StoredKey) != 1 {
+		return nil, false, errSASLNotAuthorized
+	}
+
+	// authorization is only checked once the client proved its identity
+	if m.username, err = saslAuthorize(m.server, m.client, m.authcid, m.authzid); err != nil {
+		return nil, false, err
+	}
+
+	serverSignature := scramHMAC(m.hash, m.keys.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), true, nil
+}
+
+// scramAttributes splits a SCRAM message into its attr=value pairs
+func scramAttributes(message string) ([][2]string, error) {
+	var attrs [][2]string
+	for _, field := range strings.Split(message, ",") {
+		if len(field) < 2 || field[1] != '=' {
+			return nil, errSASLMalformedRequest
+		}
+		attrs = append(attrs, [2]string{field[:1], field[2:]})
+	}
+	return attrs, nil
+}
+
+// scramUnescape decodes the =2C and =3D escapes used in saslname
+func scramUnescape(name string) (string, error) {
+	var buf bytes.Buffer
+	for i := 0; i < len(name); i++ {
+		if name[i] != '=' {
+			buf.WriteByte(name[i])
+			continue
+		}
+		if i+3 > len(name) {
+			return "", errSASLMalformedRequest
+		}
+		switch name[i+1 : i+3] {
+		case "2C":
+			buf.WriteByte(',')
+		case "3D":
+			buf.WriteByte('=')
+		default:
+			return "", errSASLMalformedRequest
+		}
+		i += 2
+	}
+	return buf.String(), nil
+}
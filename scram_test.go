@@ -0,0 +1,180 @@
+package xmpp
+
+import (
+	"encoding/base64"
+	"testing"
+)
+
+// scramTestAccounts serves stored SCRAM keys by mechanism
+type scramTestAccounts struct {
+	smTestAccounts
+	keys map[string]*ScramKeys
+}
+
+func (a scramTestAccounts) ScramKeys(username, mechanism string) (*ScramKeys, error) {
+	if username != "user" {
+		return nil, nil
+	}
+	return a.keys[mechanism], nil
+}
+
+// scramVector is an example exchange from RFC 5802 section 5 or RFC 7677
+// section 3, with the server nonce the example uses
+type scramVector struct {
+	mechanism   string
+	salt        string
+	clientFirst string
+	serverFirst string
+	clientFinal string
+	serverFinal string
+}
+
+var scramVectors = []scramVector{
+	{
+		mechanism:   "SCRAM-SHA-1",
+		salt:        "QSXCR+Q6sek8bf92",
+		clientFirst: "n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL",
+		serverFirst: "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096",
+		clientFinal: "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=",
+		serverFinal: "v=rmF9pqV8S7suAoZWja4dJRkFsKQ=",
+	},
+	{
+		mechanism:   "SCRAM-SHA-256",
+		salt:        "W22ZaJ0SNY7soEsUEjb6gQ==",
+		clientFirst: "n,,n=user,r=rOprNGfwEbeRWgbNEkqO",
+		serverFirst: "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096",
+		clientFinal: "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=",
+		serverFinal: "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=",
+	},
+}
+
+// scramTestServer stores the keys of user with password for every vector
+func scramTestServer(t *testing.T, password string) *Server {
+	t.Helper()
+	accounts := scramTestAccounts{keys: make(map[string]*ScramKeys)}
+	for _, vector := range scramVectors {
+		salt, err := base64.StdEncoding.DecodeString(vector.salt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys, err := NewScramKeys(vector.mechanism, password, salt, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		accounts.keys[vector.mechanism] = keys
+	}
+	return &Server{Domain: "example.com", Accounts: accounts}
+}
+
+// scramTestMechanism starts a SCRAM exchange of a client of example.com
+func scramTestMechanism(t *testing.T, s *Server, mechanism string) *scramMechanism {
+	t.Helper()
+	domain, err := ParseJID("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newScramMechanism(mechanism, nil, &Client{jid: domain}, s)
+}
+
+// scramExchange runs clientFirst and clientFinal against the server, using
+// the server nonce of vector instead of a random one
+func scramExchange(t *testing.T, s *Server, vector scramVector, clientFirst, clientFinal string) (string, error) {
+	t.Helper()
+	m := scramTestMechanism(t, s, vector.mechanism)
+	if _, _, err := m.Next([]byte(clientFirst)); err != nil {
+		return "", err
+	}
+	attrs, err := scramAttributes(vector.serverFirst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.nonce = attrs[0][1]
+	m.serverFirst = vector.serverFirst
+	final, done, err := m.Next([]byte(clientFinal))
+	if err == nil && !done {
+		t.Fatal("the exchange did not finish")
+	}
+	return string(final), err
+}
+
+func TestScramVectors(t *testing.T) {
+	s := scramTestServer(t, "pencil")
+	for _, vector := range scramVectors {
+		t.Run(vector.mechanism, func(t *testing.T) {
+			m := scramTestMechanism(t, s, vector.mechanism)
+			serverFirst, _, err := m.Next([]byte(vector.clientFirst))
+			if err != nil {
+				t.Fatal(err)
+			}
+			// everything but the server's part of the nonce is fixed
+			attrs, err := scramAttributes(string(serverFirst))
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, _ := scramAttributes(vector.serverFirst)
+			if attrs[1] != want[1] || attrs[2] != want[2] {
+				t.Errorf("server-first %v, want salt and iterations of %v", string(serverFirst), vector.serverFirst)
+			}
+
+			final, err := scramExchange(t, s, vector, vector.clientFirst, vector.clientFinal)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if final != vector.serverFinal {
+				t.Errorf("server-final %v, want %v", final, vector.serverFinal)
+			}
+		})
+	}
+}
+
+func TestScramFailures(t *testing.T) {
+	vector := scramVectors[1]
+	tests := []struct {
+		name        string
+		password    string
+		clientFirst string
+		clientFinal string
+		err         error
+	}{
+		{"wrong password", "pen", vector.clientFirst, vector.clientFinal, errSASLNotAuthorized},
+		{"unknown user", "pencil", "n,,n=someone,r=rOprNGfwEbeRWgbNEkqO", vector.clientFinal, errSASLNotAuthorized},
+		{"altered proof", "pencil", vector.clientFirst,
+			"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=eHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", errSASLNotAuthorized},
+		{"short proof", "pencil", vector.clientFirst,
+			"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=", errSASLNotAuthorized},
+		{"other nonce", "pencil", vector.clientFirst,
+			"c=biws,r=rOprNGfwEbeRWgbNEkqO,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", errSASLNotAuthorized},
+		{"other channel binding", "pencil", vector.clientFirst,
+			"c=eSws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", errSASLNotAuthorized},
+		{"proof not base64", "pencil", vector.clientFirst,
+			"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=!", errSASLIncorrectEncoding},
+		{"no proof", "pencil", vector.clientFirst,
+			"c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0", errSASLMalformedRequest},
+		{"no nonce", "pencil", "n,,n=user", vector.clientFinal, errSASLMalformedRequest},
+		{"mandatory extension", "pencil", "n,,m=ext,n=user,r=rOprNGfwEbeRWgbNEkqO", vector.clientFinal, errSASLMalformedRequest},
+		{"no gs2 header", "pencil", "n=user,r=rOprNGfwEbeRWgbNEkqO", vector.clientFinal, errSASLMalformedRequest},
+		{"bad escape", "pencil", "n,,n=us=2Ber,r=rOprNGfwEbeRWgbNEkqO", vector.clientFinal, errSASLMalformedRequest},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s := scramTestServer(t, test.password)
+			if _, err := scramExchange(t, s, vector, test.clientFirst, test.clientFinal); err != test.err {
+				t.Errorf("error %v, want %v", err, test.err)
+			}
+		})
+	}
+}
+
+func TestFakeScramSalt(t *testing.T) {
+	s := scramTestServer(t, "pencil")
+	first := s.fakeScramSalt("SCRAM-SHA-256", "someone")
+	if len(first) != 16 {
+		t.Fatalf("salt of %v bytes, want 16", len(first))
+	}
+	if again := s.fakeScramSalt("SCRAM-SHA-256", "someone"); string(again) != string(first) {
+		t.Error("the salt of an unknown user changed between attempts")
+	}
+	if other := s.fakeScramSalt("SCRAM-SHA-256", "someone-else"); string(other) == string(first) {
+		t.Error("two unknown users got the same salt")
+	}
+}
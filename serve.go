@@ -0,0 +1,162 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// maxAcceptDelay caps the backoff between failed Accept calls
+const maxAcceptDelay = time.Second
+
+// ListenerOptions configures the connections accepted on one listener
+type ListenerOptions struct {
+	// RequireTLS forces STARTTLS on this listener even if Server.SkipTLS
+	// is set
+	RequireTLS bool
+	// DirectTLS makes clients start TLS right after connecting instead of
+	// using STARTTLS (XEP-0368). The ALPN protocol "xmpp-client" is
+	// negotiated.
+	DirectTLS bool
+	// TLSConfig overrides Server.TLSConfig for this listener
+	TLSConfig *tls.Config
+}
+
+// Serve accepts connections on l and handles each of them in its own
+// goroutine. It can be called for several listeners on one Server. Serve
+// always returns a non-nil error; after Shutdown it is ErrServerClosed.
+func (s *Server) Serve(l net.Listener) error {
+	return s.ServeWithOptions(l, ListenerOptions{})
+}
+
+// ServeWithOptions is like Serve with per-listener options
+func (s *Server) ServeWithOptions(l net.Listener, opts ListenerOptions) error {
+	if (opts.RequireTLS || opts.DirectTLS) && opts.TLSConfig == nil && s.TLSConfig == nil {
+		return errors.New("xmpp: TLS listener without a TLS config")
+	}
+	if err := s.trackListener(l); err != nil {
+		l.Close()
+		return err
+	}
+	defer s.untrackListener(l)
+	defer l.Close()
+
+	var delay time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if s.isClosing() {
+				return ErrServerClosed
+			}
+			if temporaryAcceptError(err) {
+				// back off like net/http does, e.g. when out of file
+				// descriptors
+				if delay == 0 {
+					delay = 5 * time.Millisecond
+				} else {
+					delay *= 2
+				}
+				if delay > maxAcceptDelay {
+					delay = maxAcceptDelay
+				}
+				log.Printf("Accept error on %v: %v; retrying in %v\n", l.Addr(), err.Error(), delay)
+				time.Sleep(delay)
+				continue
+			}
+			return err
+		}
+		delay = 0
+		go s.serveConn(conn, opts)
+	}
+}
+
+// temporaryAcceptError reports whether Accept may succeed again after err,
+// e.g. once file descriptors are free again or for a connection that was
+// reset before it could be accepted
+func temporaryAcceptError(err error) bool {
+	var ne net.Error
+	if errors.As(err, &ne) && ne.Timeout() {
+		return true
+	}
+	for _, errno := range []syscall.Errno{syscall.EMFILE, syscall.ENFILE, syscall.ENOBUFS, syscall.ENOMEM, syscall.ECONNABORTED, syscall.ECONNRESET} {
+		if errors.Is(err, errno) {
+			return true
+		}
+	}
+	return false
+}
+
+// ListenAndServe listens on addr and calls Serve. addr is a TCP address such
+// as ":5222" or "[::1]:5222", optionally prefixed with "tcp4:" or "tcp6:" to
+// restrict the address family, or "unix:" followed by a socket path.
+func (s *Server) ListenAndServe(addr string) error {
+	return s.ListenAndServeWithOptions(addr, ListenerOptions{})
+}
+
+// ListenAndServeWithOptions is like ListenAndServe with per-listener options
+func (s *Server) ListenAndServeWithOptions(addr string, opts ListenerOptions) error {
+	network, address := splitListenAddr(addr)
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return err
+	}
+	log.Printf("Listening on %v %v\n", network, l.Addr())
+	return s.ServeWithOptions(l, opts)
+}
+
+// ListenAndServeTLS is like ListenAndServe but loads the certificate from
+// certFile and keyFile and requires STARTTLS on the listener
+func (s *Server) ListenAndServeTLS(addr, certFile, keyFile string) error {
+	config, err := s.certificateConfig(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	return s.ListenAndServeWithOptions(addr, ListenerOptions{RequireTLS: true, TLSConfig: config})
+}
+
+// ListenAndServeDirectTLS is like ListenAndServeTLS but serves direct TLS
+// (XEP-0368), usually on port 5223
+func (s *Server) ListenAndServeDirectTLS(addr, certFile, keyFile string) error {
+	config, err := s.certificateConfig(certFile, keyFile)
+	if err != nil {
+		return err
+	}
+	return s.ListenAndServeWithOptions(addr, ListenerOptions{DirectTLS: true, TLSConfig: config})
+}
+
+// certificateConfig returns a copy of s.TLSConfig serving the certificate
+// in certFile and keyFile
+func (s *Server) certificateConfig(certFile, keyFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{}
+	if s.TLSConfig != nil {
+		config = s.TLSConfig.Clone()
+	}
+	config.Certificates = []tls.Certificate{cert}
+	return config, nil
+}
+
+// splitListenAddr splits an optional network prefix off addr
+func splitListenAddr(addr string) (network, address string) {
+	for _, network := range []string{"unix", "tcp4", "tcp6", "tcp"} {
+		if strings.HasPrefix(addr, network+":") {
+			return network, addr[len(network)+1:]
+		}
+	}
+	return "tcp", addr
+}
+
+// isClosing reports whether Shutdown has been called
+func (s *Server) isClosing() bool {
+	t := &s.conns
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.closing
+}
@@ -0,0 +1,177 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"errors"
+	"log"
+	"sync"
+	"time"
+)
+
+// ResourceConflict decides what happens when a client binds a resource that
+// is already in use (RFC 6120 section 7.7.2.2)
+type ResourceConflict int
+
+const (
+	// ConflictKickOld terminates the existing session with a <conflict/>
+	// stream error and binds the new one
+	ConflictKickOld ResourceConflict = iota
+	// ConflictReject refuses the new bind request with a <conflict/> error
+	ConflictReject
+	// ConflictRename binds the new session to a generated resource
+	ConflictRename
+)
+
+// kickTimeout bounds how long a bind waits for a kicked session to go away
+const kickTimeout = 5 * time.Second
+
+// errResourceConflict is returned when a resource is in use and the
+// ConflictReject policy is active
+var errResourceConflict = errors.New("resource conflict")
+
+// sessionTable tracks the bound sessions of a Server by full JID
+type sessionTable struct {
+	lock     sync.Mutex
+	sessions map[JID]*Client
+}
+
+// bindResource registers client under resource, or a random resource if
+// none was requested, resolving conflicts with the server's policy. On
+// success client.jid is the bound full JID.
+func (s *Server) bindResource(client *Client, resource string) error {
+	table := &s.sessions
+	table.lock.Lock()
+	if table.sessions == nil {
+		table.sessions = make(map[JID]*Client)
+	}
+
+	if resource == "" {
+		resource = makeResource()
+	}
+	jid, err := client.jid.WithResource(resource)
+	if err != nil {
+		table.lock.Unlock()
+		return err
+	}
+	existing := table.sessions[jid]
+	if existing != nil {
+		switch s.ResourceConflict {
+		case ConflictReject:
+			table.lock.Unlock()
+			return errResourceConflict
+		case ConflictRename:
+			for existing != nil {
+				jid, _ = client.jid.WithResource(jid.Resource() + "-" + makeResource()[:8])
+				existing = table.sessions[jid]
+			}
+		}
+	}
+
+	client.jid = jid
+	table.sessions[jid] = client
+	table.lock.Unlock()
+
+	if existing != nil {
+		// ConflictKickOld: wait for the old session to disconnect so its
+		// Disconnect reaches the router before our Connect does
+		log.Printf("Resource conflict, kicking %v\n", existing.jid)
+		existing.send(&StreamError{Any: xml.Name{Space: NsStreams, Local: "conflict"}})
+		select {
+		case <-existing.done:
+		case <-time.After(kickTimeout):
+			log.Printf("Kicked session %v did not close in time\n", existing.jid)
+		}
+	}
+	return nil
+}
+
+// unbindResource removes client from the session table
+func (s *Server) unbindResource(client *Client) {
+	table := &s.sessions
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	if table.sessions[client.jid] == client {
+		delete(table.sessions, client.jid)
+	}
+}
+
+// session returns the session bound to the full JID jid, or nil
+func (s *Server) session(jid JID) *Client {
+	table := &s.sessions
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	return table.sessions[jid]
+}
+
+// accountSessions returns the bound sessions of the account bare
+func (s *Server) accountSessions(bare JID) []*Client {
+	table := &s.sessions
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	var clients []*Client
+	for jid, client := range table.sessions {
+		if jid.Bare() == bare {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// send delivers a message to the client's connection unless the session
+// has already ended
+func (c *Client) send(message interface{}) bool {
+	select {
+	case c.messages <- message:
+		return true
+	case <-c.done:
+		return false
+	}
+}
+
+// outbox queues what other sessions send to a session, so that they never
+// block on it and it still gets their stanzas in order
+type outbox struct {
+	lock     sync.Mutex
+	queue    []interface{}
+	draining bool
+}
+
+// push queues message for the client without blocking. Messages pushed to
+// a session are delivered in the order they were pushed.
+func (c *Client) push(message interface{}) {
+	o := &c.outbox
+	o.lock.Lock()
+	o.queue = append(o.queue, message)
+	start := !o.draining
+	o.draining = true
+	o.lock.Unlock()
+	if start {
+		go c.drainOutbox()
+	}
+}
+
+// drainOutbox sends the pushed messages until none are left or the session
+// has ended
+func (c *Client) drainOutbox() {
+	o := &c.outbox
+	for {
+		o.lock.Lock()
+		if len(o.queue) == 0 {
+			o.draining = false
+			o.lock.Unlock()
+			return
+		}
+		message := o.queue[0]
+		o.queue[0] = nil
+		o.queue = o.queue[1:]
+		o.lock.Unlock()
+
+		if !c.send(message) {
+			o.lock.Lock()
+			o.queue = nil
+			o.draining = false
+			o.lock.Unlock()
+			return
+		}
+	}
+}
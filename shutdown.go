@@ -0,0 +1,182 @@
+package xmpp
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrServerClosed is returned for connections handed to a Server after
+// Shutdown was called
+var ErrServerClosed = errors.New("xmpp: server closed")
+
+// closeTimeout bounds how long we wait for the client's closing tag after
+// closing our side of the stream
+const closeTimeout = time.Second
+
+// connTracker tracks the live connections of a Server so it can be shut
+// down
+type connTracker struct {
+	lock      sync.Mutex
+	closing   bool
+	quit      chan struct{}
+	conns     map[*Client]*trackedConn
+	listeners map[net.Listener]struct{}
+	finished  sync.WaitGroup
+}
+
+// trackedConn is a connection and whether it reached the Normal state
+type trackedConn struct {
+	raw    io.Closer
+	active bool
+}
+
+// quitChan returns the channel that is closed when Shutdown starts
+func (s *Server) quitChan() chan struct{} {
+	t := &s.conns
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.quit == nil {
+		t.quit = make(chan struct{})
+	}
+	return t.quit
+}
+
+// trackConn registers a new connection, failing once Shutdown was called
+func (s *Server) trackConn(client *Client, raw io.Closer) error {
+	t := &s.conns
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closing {
+		return ErrServerClosed
+	}
+	if t.conns == nil {
+		t.conns = make(map[*Client]*trackedConn)
+	}
+	t.conns[client] = &trackedConn{raw: raw}
+	t.finished.Add(1)
+	return nil
+}
+
+// trackListener registers a listener for Shutdown to close, failing once
+// Shutdown was called
+func (s *Server) trackListener(l net.Listener) error {
+	t := &s.conns
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closing {
+		return ErrServerClosed
+	}
+	if t.listeners == nil {
+		t.listeners = make(map[net.Listener]struct{})
+	}
+	t.listeners[l] = struct{}{}
+	return nil
+}
+
+// untrackListener forgets a listener that has been closed
+func (s *Server) untrackListener(l net.Listener) {
+	t := &s.conns
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.listeners, l)
+}
+
+// untrackConn forgets a connection that has been closed
+func (s *Server) untrackConn(client *Client) {
+	t := &s.conns
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if _, ok := t.conns[client]; ok {
+		delete(t.conns, client)
+		t.finished.Done()
+	}
+}
+
+// moveConn tracks the connection of client under session instead, for a
+// connection that resumed session
+func (s *Server) moveConn(client, session *Client) {
+	t := &s.conns
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if conn, ok := t.conns[client]; ok {
+		delete(t.conns, client)
+		t.conns[session] = conn
+	}
+}
+
+// closeConn closes the connection serving client, if any
+func (s *Server) closeConn(client *Client) {
+	t := &s.conns
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if conn, ok := t.conns[client]; ok {
+		conn.raw.Close()
+	}
+}
+
+// activateConn marks the connection as established. From then on the
+// Normal state handles Shutdown itself; it returns false if Shutdown has
+// already started.
+func (s *Server) activateConn(client *Client) bool {
+	t := &s.conns
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closing {
+		return false
+	}
+	if conn, ok := t.conns[client]; ok {
+		conn.active = true
+	}
+	return true
+}
+
+// Shutdown gracefully stops the server. Listeners passed to Serve are
+// closed, new connections are refused, connections still negotiating the
+// stream are closed and established sessions get their queued messages
+// followed by a <system-shutdown/> stream error. Shutdown waits for every connection to finish; if ctx
+// expires first the remaining connections are closed and ctx.Err() is
+// returned.
+func (s *Server) Shutdown(ctx context.Context) error {
+	quit := s.quitChan()
+	t := &s.conns
+	t.lock.Lock()
+	if !t.closing {
+		t.closing = true
+		close(quit)
+		for l := range t.listeners {
+			l.Close()
+		}
+		for _, conn := range t.conns {
+			if !conn.active {
+				conn.raw.Close()
+			}
+		}
+	}
+	t.lock.Unlock()
+	s.expireDetachedSessions()
+
+	finished := make(chan struct{})
+	go func() {
+		t.finished.Wait()
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		log.Println("Server shut down")
+		return nil
+	case <-ctx.Done():
+		t.lock.Lock()
+		for _, conn := range t.conns {
+			conn.raw.Close()
+		}
+		t.lock.Unlock()
+		log.Printf("Server shutdown interrupted: %v\n", ctx.Err())
+		return ctx.Err()
+	}
+}
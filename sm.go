@@ -0,0 +1,416 @@
+package xmpp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	// defaultResumeTimeout is used when Server.ResumeTimeout is zero
+	defaultResumeTimeout = 5 * time.Minute
+	// smRequestEvery is how many unacknowledged stanzas trigger an <r/>
+	smRequestEvery = 5
+	// smMaxUnacked bounds the queue of unacknowledged stanzas per session
+	smMaxUnacked = 1000
+	// smTakeoverTimeout bounds how long a resumption waits for the old
+	// connection of a session that was still attached to let go of it
+	smTakeoverTimeout = 5 * time.Second
+)
+
+// OfflineStore keeps messages that could not be delivered to a session,
+// for example when a stream management resumption timed out
+type OfflineStore interface {
+	StoreOffline(message *ClientMessage) error
+}
+
+// errSessionDetached is returned by the Normal state when the connection
+// dropped but the session waits to be resumed
+var errSessionDetached = errors.New("session detached for resumption")
+
+// errStreamTerminated is returned by deliver after a stream error was sent
+var errStreamTerminated = errors.New("stream terminated")
+
+// streamManagement is the XEP-0198 state of a session. It outlives the
+// connection while the session waits to be resumed.
+type streamManagement struct {
+	lock      sync.Mutex
+	enabled   bool // outbound stanzas are counted and queued
+	inbound   bool // inbound stanzas are counted
+	resumable bool
+	id        string
+	// handled counts inbound stanzas, sent counts outbound stanzas
+	handled uint32
+	sent    uint32
+	// unacked holds sent stanzas the client has not acknowledged yet,
+	// pending those to resend after a resumption
+	unacked []interface{}
+	pending []interface{}
+}
+
+// countInbound counts a stanza received from the client
+func (sm *streamManagement) countInbound() {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	if sm.inbound {
+		sm.handled++
+	}
+}
+
+// inboundCount returns the number of stanzas handled so far
+func (sm *streamManagement) inboundCount() uint32 {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	return sm.handled
+}
+
+// queue records an outbound stanza before it is written. It reports
+// whether an ack should be requested and fails if the client is too far
+// behind.
+func (sm *streamManagement) queue(stanza interface{}) (bool, error) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	if !sm.enabled {
+		return false, nil
+	}
+	if len(sm.unacked) >= smMaxUnacked {
+		return false, errors.New("too many unacknowledged stanzas")
+	}
+	sm.sent++
+	sm.unacked = append(sm.unacked, stanza)
+	return len(sm.unacked)%smRequestEvery == 0, nil
+}
+
+// ack drops the stanzas acknowledged by h from the queue
+func (sm *streamManagement) ack(h uint32) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	// h and sent wrap around at 2^32 (XEP-0198 section 4)
+	outstanding := sm.sent - h
+	if int64(outstanding) > int64(len(sm.unacked)) {
+		log.Printf("Client acknowledged stanzas it was never sent: h=%v sent=%v\n", h, sm.sent)
+		return
+	}
+	sm.unacked = sm.unacked[len(sm.unacked)-int(outstanding):]
+}
+
+// takePending returns the stanzas to resend after a resumption
+func (sm *streamManagement) takePending() []interface{} {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	pending := sm.pending
+	sm.pending = nil
+	return pending
+}
+
+// undelivered empties the queues and returns everything the client has
+// not acknowledged
+func (sm *streamManagement) undelivered() []interface{} {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	stanzas := append(sm.unacked, sm.pending...)
+	sm.unacked, sm.pending = nil, nil
+	return stanzas
+}
+
+// detachedSession is a session whose connection dropped and that can
+// still be resumed
+type detachedSession struct {
+	client  *Client
+	timer   *time.Timer
+	stop    chan struct{}
+	stopped chan struct{}
+}
+
+// attachedSession is a resumable session that still has its connection
+type attachedSession struct {
+	client *Client
+	// gone is closed once the connection stopped serving the session,
+	// which is then detached or ended
+	gone chan struct{}
+}
+
+// smTable tracks the resumable sessions of a Server by stream management
+// id
+type smTable struct {
+	lock     sync.Mutex
+	attached map[string]*attachedSession
+	detached map[string]*detachedSession
+}
+
+// attachSession registers a resumable session served by a connection.
+// The caller holds the table lock.
+func (table *smTable) attachSession(id string, client *Client) {
+	if table.attached == nil {
+		table.attached = make(map[string]*attachedSession)
+	}
+	table.attached[id] = &attachedSession{client: client, gone: make(chan struct{})}
+}
+
+// releaseSession forgets the connection of a resumable session. The
+// caller holds the table lock.
+func (table *smTable) releaseSession(id string, client *Client) {
+	if a := table.attached[id]; a != nil && a.client == client {
+		delete(table.attached, id)
+		close(a.gone)
+	}
+}
+
+// resumeTimeout returns how long detached sessions are kept
+func (s *Server) resumeTimeout() time.Duration {
+	if s.ResumeTimeout > 0 {
+		return s.ResumeTimeout
+	}
+	return defaultResumeTimeout
+}
+
+// smFeature returns the stream management stream feature, if offered
+func smFeature(s *Server) string {
+	if s.DisableStreamManagement {
+		return ""
+	}
+	return "<sm xmlns='" + NsSM + "'/>"
+}
+
+// smFailure builds a <failed/> nonza with a stanza error condition
+func smFailure(condition string, h *uint32) *smFailed {
+	return &smFailed{H: h, Condition: fmt.Sprintf("<%s xmlns='%s'/>", condition, NsStanzas)}
+}
+
+// handleSM processes the stream management nonzas the client sends in the
+// Normal state. It returns false for anything else.
+func (s *Server) handleSM(client *Client, message interface{}) bool {
+	sm := client.sm
+	switch v := message.(type) {
+	case *smEnable:
+		sm.lock.Lock()
+		if s.DisableStreamManagement || sm.inbound {
+			sm.lock.Unlock()
+			client.send(smFailure("unexpected-request", nil))
+			return true
+		}
+		sm.inbound = true
+		enabled := &smEnabled{}
+		if v.Resume {
+			sm.resumable = true
+			sm.id = fmt.Sprintf("%x", randomBytes(16))
+			enabled.ID = sm.id
+			enabled.Resume = true
+			enabled.Max = int(s.resumeTimeout() / time.Second)
+		}
+		id := sm.id
+		sm.lock.Unlock()
+		if v.Resume {
+			s.resumable.lock.Lock()
+			s.resumable.attachSession(id, client)
+			s.resumable.lock.Unlock()
+		}
+		log.Printf("Stream management enabled for %v (resume: %v)\n", client.jid, v.Resume)
+		// outbound counting starts when <enabled/> is written
+		client.send(enabled)
+	case *smRequest:
+		client.send(&smAnswer{H: sm.inboundCount()})
+	case *smAnswer:
+		sm.ack(v.H)
+	default:
+		return false
+	}
+	return true
+}
+
+// detachSession keeps a resumable session alive after its connection
+// dropped. It returns false if the session cannot be resumed.
+func (s *Server) detachSession(client *Client) bool {
+	sm := client.sm
+	sm.lock.Lock()
+	resumable, id := sm.resumable, sm.id
+	sm.lock.Unlock()
+	if !resumable || s.isClosing() {
+		return false
+	}
+
+	d := &detachedSession{
+		client:  client,
+		timer:   time.NewTimer(s.resumeTimeout()),
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	table := &s.resumable
+	table.lock.Lock()
+	if table.detached == nil {
+		table.detached = make(map[string]*detachedSession)
+	}
+	table.detached[id] = d
+	table.lock.Unlock()
+	log.Printf("Session %v detached, waiting %v for resumption\n", client.jid, s.resumeTimeout())
+
+	go s.holdSession(id, d)
+	return true
+}
+
+// holdSession queues what is routed to a detached session until it is
+// resumed, kicked or times out
+func (s *Server) holdSession(id string, d *detachedSession) {
+	defer close(d.stopped)
+	defer d.timer.Stop()
+	for {
+		select {
+		case message := <-d.client.messages:
+			if _, ok := message.(*StreamError); !ok {
+				d.client.sm.lock.Lock()
+				d.client.sm.pending = append(d.client.sm.pending, message)
+				d.client.sm.lock.Unlock()
+				continue
+			}
+			// the session was replaced or removed
+		case <-d.timer.C:
+			log.Printf("Session %v was not resumed in time\n", d.client.jid)
+		case <-d.stop:
+			return
+		}
+		if s.takeDetached(id) == d {
+			s.expireSession(d.client)
+		}
+		return
+	}
+}
+
+// takeDetached removes a detached session from the table
+func (s *Server) takeDetached(id string) *detachedSession {
+	table := &s.resumable
+	table.lock.Lock()
+	defer table.lock.Unlock()
+	d := table.detached[id]
+	delete(table.detached, id)
+	return d
+}
+
+// halt stops the goroutine holding a detached session
+func (d *detachedSession) halt() {
+	close(d.stop)
+	<-d.stopped
+}
+
+// expireSession ends a detached session for good: unacknowledged stanzas
+// are stored offline or bounced and the router is told it is gone
+func (s *Server) expireSession(client *Client) {
+	for _, stanza := range client.sm.undelivered() {
+		s.undeliverable(stanza)
+	}
+	s.disconnect(client)
+	close(client.done)
+}
+
+// expireDetachedSessions ends all detached sessions, for Shutdown
+func (s *Server) expireDetachedSessions() {
+	table := &s.resumable
+	table.lock.Lock()
+	var ids []string
+	for id := range table.detached {
+		ids = append(ids, id)
+	}
+	table.lock.Unlock()
+	for _, id := range ids {
+		if d := s.takeDetached(id); d != nil {
+			d.halt()
+			s.expireSession(d.client)
+		}
+	}
+}
+
+// undeliverable handles a stanza that never reached a session: messages go
+// to offline storage or bounce, requests are answered with an error
+// (XEP-0198 section 5)
+func (s *Server) undeliverable(stanza interface{}) {
+	var reply interface{}
+	var to JID
+	switch v := stanza.(type) {
+	case *ClientMessage:
+		if v.Type == "error" || v.Type == "groupchat" || v.Type == "headline" {
+			return
+		}
+		if s.OfflineStore != nil {
+			if err := s.OfflineStore.StoreOffline(v); err == nil {
+				return
+			}
+		}
+		reply, to = ErrorReply(v, StanzaRecipientUnavailable("")), v.From
+	case *ClientIQ:
+		reply, to = ErrorReply(v, StanzaServiceUnavailable("")), v.From
+	}
+	if reply == nil {
+		return
+	}
+	if sender := s.session(to); sender != nil {
+		go sender.send(reply)
+	}
+}
+
+// releaseResumable forgets the connection of a resumable session once it
+// stopped serving it
+func (s *Server) releaseResumable(client *Client) {
+	client.sm.lock.Lock()
+	id := client.sm.id
+	client.sm.lock.Unlock()
+	if id == "" {
+		return
+	}
+	table := &s.resumable
+	table.lock.Lock()
+	table.releaseSession(id, client)
+	table.lock.Unlock()
+}
+
+// resumeSession takes over the session named by resume for client, which
+// has just authenticated on a new connection. A session whose old
+// connection is still attached, as when the client noticed a dead network
+// before the server did, has that connection closed first. On success the
+// connection serves the old session from then on, see Connection.resumed.
+func (s *Server) resumeSession(c *Connection, client *Client, resume *smResume) bool {
+	table := &s.resumable
+	table.lock.Lock()
+	d := table.detached[resume.PrevID]
+	if a := table.attached[resume.PrevID]; d == nil && a != nil && a.client.jid.Bare() == client.jid.Bare() {
+		table.lock.Unlock()
+		log.Printf("Session %v resumed while attached, closing its old connection\n", a.client.jid)
+		s.closeConn(a.client)
+		select {
+		case <-a.gone:
+		case <-time.After(smTakeoverTimeout):
+		}
+		table.lock.Lock()
+		d = table.detached[resume.PrevID]
+	}
+	if d == nil || d.client.jid.Bare() != client.jid.Bare() {
+		table.lock.Unlock()
+		c.SendStanza(smFailure("item-not-found", nil))
+		return false
+	}
+	delete(table.detached, resume.PrevID)
+	table.lock.Unlock()
+	d.halt()
+
+	old := d.client
+	old.sm.ack(resume.H)
+	sm := old.sm
+	sm.lock.Lock()
+	// resend everything unacknowledged, counting it again
+	sm.pending = append(sm.unacked, sm.pending...)
+	sm.unacked = nil
+	sm.sent = resume.H
+	handled := sm.handled
+	sm.lock.Unlock()
+
+	// the connection takes over the old session, which the router and the
+	// session table still know under the old Client
+	s.moveConn(client, old)
+	c.resumed = old
+	table.lock.Lock()
+	table.attachSession(resume.PrevID, old)
+	table.lock.Unlock()
+	log.Printf("Session %v resumed\n", old.jid)
+	c.SendStanza(&smResumed{PrevID: resume.PrevID, H: handled})
+	return true
+}
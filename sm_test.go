@@ -0,0 +1,145 @@
+package xmpp
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"net"
+	"testing"
+	"time"
+)
+
+// smTestAccounts knows the account alice with the password secret
+type smTestAccounts struct{}
+
+func (smTestAccounts) Authenticate(username, password string) (bool, error) {
+	return username == "alice" && password == "secret", nil
+}
+func (smTestAccounts) ScramKeys(username, mechanism string) (*ScramKeys, error) { return nil, nil }
+func (smTestAccounts) CreateAccount(username, password string) (bool, error)    { return false, nil }
+func (smTestAccounts) OnlineRoster(jid string) ([]string, error)                { return nil, nil }
+
+// smTestLog drops the library's log messages
+type smTestLog struct{}
+
+func (smTestLog) Debug(format string, args ...interface{})  {}
+func (smTestLog) Info(format string, args ...interface{})   {}
+func (smTestLog) Waring(format string, args ...interface{}) {}
+func (smTestLog) Error(format string, args ...interface{})  {}
+
+// smTestClient is the client end of a connection to a test server
+type smTestClient struct {
+	t    *testing.T
+	conn net.Conn
+	dec  *xml.Decoder
+}
+
+// dialSMTest connects a client to s, logs in as alice and opens the
+// authenticated stream
+func dialSMTest(t *testing.T, s *Server) *smTestClient {
+	server, client := net.Pipe()
+	go s.TCPAnswer(server)
+	c := &smTestClient{t: t, conn: client, dec: xml.NewDecoder(client)}
+	c.open()
+	c.send("<auth xmlns='urn:ietf:params:xml:ns:xmpp-sasl' mechanism='PLAIN'>" +
+		base64.StdEncoding.EncodeToString([]byte("\x00alice\x00secret")) + "</auth>")
+	c.expect("success")
+	c.open()
+	return c
+}
+
+func (c *smTestClient) send(data string) {
+	c.t.Helper()
+	c.conn.SetWriteDeadline(time.Now().Add(3 * time.Second))
+	if _, err := c.conn.Write([]byte(data)); err != nil {
+		c.t.Fatalf("write: %v", err)
+	}
+}
+
+// open starts a stream and reads the stream features
+func (c *smTestClient) open() {
+	c.t.Helper()
+	c.send("<?xml version='1.0'?><stream:stream to='localhost' version='1.0' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'>")
+	c.expect("stream")
+	c.expect("features")
+}
+
+// expect reads the next element, which has to be called name, and returns
+// its attributes
+func (c *smTestClient) expect(name string) map[string]string {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		token, err := c.dec.Token()
+		if err != nil {
+			c.t.Fatalf("reading <%v/>: %v", name, err)
+		}
+		se, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		if se.Name.Local != "stream" {
+			c.dec.Skip()
+		}
+		if se.Name.Local != name {
+			c.t.Fatalf("got <%v/>, want <%v/>", se.Name.Local, name)
+		}
+		attrs := make(map[string]string)
+		for _, attr := range se.Attr {
+			attrs[attr.Name.Local] = attr.Value
+		}
+		return attrs
+	}
+}
+
+func TestResumeAttachedSession(t *testing.T) {
+	s := &Server{
+		Domain:        "localhost",
+		SkipTLS:       true,
+		Accounts:      smTestAccounts{},
+		ConnectBus:    make(chan Connect, 10),
+		DisconnectBus: make(chan Disconnect, 10),
+		Log:           smTestLog{},
+	}
+	old := dialSMTest(t, s)
+	old.send("<iq type='set' id='bind'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><resource>phone</resource></bind></iq>")
+	old.expect("iq")
+	old.send("<enable xmlns='urn:xmpp:sm:3' resume='true'/>")
+	id := old.expect("enabled")["id"]
+
+	jid, err := ParseJID("alice@localhost/phone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session := s.session(jid)
+	session.send(&ClientMessage{ID: "m1", Body: "read but not acknowledged"})
+	old.expect("message")
+	// the network is gone: the server blocks writing the next message and
+	// still thinks the old connection is up
+	go session.send(&ClientMessage{ID: "m2", Body: "never read"})
+
+	resumed := dialSMTest(t, s)
+	resumed.send("<resume xmlns='urn:xmpp:sm:3' previd='" + id + "' h='0'/>")
+	if attrs := resumed.expect("resumed"); attrs["previd"] != id {
+		t.Fatalf("resumed %v, want %v", attrs["previd"], id)
+	}
+	for _, want := range []string{"m1", "m2"} {
+		if got := resumed.expect("message")["id"]; got != want {
+			t.Fatalf("replayed %v, want %v", got, want)
+		}
+	}
+
+	// the old connection was closed and the new one serves the session
+	old.conn.SetReadDeadline(time.Now().Add(3 * time.Second))
+	for {
+		if _, err := old.dec.Token(); err != nil {
+			break
+		}
+	}
+	if s.session(jid) != session {
+		t.Fatal("the resumed session is not the bound one")
+	}
+	session.send(&ClientMessage{ID: "m3"})
+	if got := resumed.expect("message")["id"]; got != "m3" {
+		t.Fatalf("got %v after resuming, want m3", got)
+	}
+}
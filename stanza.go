@@ -0,0 +1,268 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"log"
+)
+
+// Stanza error types, RFC 6120 section 8.3.2
+const (
+	// ErrorTypeAuth means retry after providing credentials
+	ErrorTypeAuth = "auth"
+	// ErrorTypeCancel means do not retry
+	ErrorTypeCancel = "cancel"
+	// ErrorTypeContinue means proceed, the condition was only a warning
+	ErrorTypeContinue = "continue"
+	// ErrorTypeModify means retry after changing the data sent
+	ErrorTypeModify = "modify"
+	// ErrorTypeWait means retry after waiting
+	ErrorTypeWait = "wait"
+)
+
+// NewStanzaError returns a stanza error of the given type with a defined
+// condition (RFC 6120 section 8.3.3) and optional descriptive text
+func NewStanzaError(errorType, condition, text string) *ClientError {
+	return &ClientError{Type: errorType, Any: xml.Name{Space: NsStanzas, Local: condition}, Text: text}
+}
+
+// Error implements the error interface so handlers can return stanza errors
+func (e *ClientError) Error() string {
+	if e.Text != "" {
+		return "stanza error: " + e.Any.Local + ": " + e.Text
+	}
+	return "stanza error: " + e.Any.Local
+}
+
+// Condition returns the defined condition of the error
+func (e *ClientError) Condition() string {
+	return e.Any.Local
+}
+
+// WithType returns a copy of the error with a different error type
+func (e *ClientError) WithType(errorType string) *ClientError {
+	c := *e
+	c.Type = errorType
+	return &c
+}
+
+// MarshalXML writes the <error/> element with its condition and text in the
+// stanzas namespace
+func (e ClientError) MarshalXML(enc *xml.Encoder, start xml.StartElement) error {
+	start = xml.StartElement{Name: xml.Name{Local: "error"}}
+	if e.Type != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "type"}, Value: e.Type})
+	}
+	if e.Code != "" {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "code"}, Value: e.Code})
+	}
+	if !e.By.IsZero() {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "by"}, Value: e.By.String()})
+	}
+	if err := enc.EncodeToken(start); err != nil {
+		return err
+	}
+	if e.Any.Local != "" {
+		condition := xml.StartElement{Name: xml.Name{Space: NsStanzas, Local: e.Any.Local}}
+		if err := enc.EncodeToken(condition); err != nil {
+			return err
+		}
+		if e.URI != "" {
+			if err := enc.EncodeToken(xml.CharData(e.URI)); err != nil {
+				return err
+			}
+		}
+		if err := enc.EncodeToken(condition.End()); err != nil {
+			return err
+		}
+	}
+	if e.Text != "" {
+		text := xml.StartElement{Name: xml.Name{Space: NsStanzas, Local: "text"}}
+		if err := enc.EncodeElement(e.Text, text); err != nil {
+			return err
+		}
+	}
+	return enc.EncodeToken(start.End())
+}
+
+// Stanza error conditions, RFC 6120 section 8.3.3, with their usual types
+
+// StanzaBadRequest reports a malformed or unprocessable request
+func StanzaBadRequest(text string) *ClientError {
+	return NewStanzaError(ErrorTypeModify, "bad-request", text)
+}
+
+// StanzaConflict reports a name or lock that is already in use
+func StanzaConflict(text string) *ClientError {
+	return NewStanzaError(ErrorTypeCancel, "conflict", text)
+}
+
+// StanzaFeatureNotImplemented reports a feature the recipient lacks
+func StanzaFeatureNotImplemented(text string) *ClientError {
+	return NewStanzaError(ErrorTypeCancel, "feature-not-implemented", text)
+}
+
+// StanzaForbidden reports a sender without permission for the action
+func StanzaForbidden(text string) *ClientError {
+	return NewStanzaError(ErrorTypeAuth, "forbidden", text)
+}
+
+// StanzaGone reports a recipient that is no longer at this address; uri is
+// its new address, if known
+func StanzaGone(uri, text string) *ClientError {
+	e := NewStanzaError(ErrorTypeCancel, "gone", text)
+	e.URI = uri
+	return e
+}
+
+// StanzaInternalServerError reports a server misconfiguration or failure
+func StanzaInternalServerError(text string) *ClientError {
+	return NewStanzaError(ErrorTypeCancel, "internal-server-error", text)
+}
+
+// StanzaItemNotFound reports that the addressed item does not exist
+func StanzaItemNotFound(text string) *ClientError {
+	return NewStanzaError(ErrorTypeCancel, "item-not-found", text)
+}
+
+// StanzaJIDMalformed reports an address that violates RFC 7622
+func StanzaJIDMalformed(text string) *ClientError {
+	return NewStanzaError(ErrorTypeModify, "jid-malformed", text)
+}
+
+// StanzaNotAcceptable reports a request that does not meet the recipient's
+// criteria
+func StanzaNotAcceptable(text string) *ClientError {
+	return NewStanzaError(ErrorTypeModify, "not-acceptable", text)
+}
+
+// StanzaNotAllowed reports an action no one may perform
+func StanzaNotAllowed(text string) *ClientError {
+	return NewStanzaError(ErrorTypeCancel, "not-allowed", text)
+}
+
+// StanzaNotAuthorized reports a sender that has to authenticate first
+func StanzaNotAuthorized(text string) *ClientError {
+	return NewStanzaError(ErrorTypeAuth, "not-authorized", text)
+}
+
+// StanzaPolicyViolation reports a violation of local service policy
+func StanzaPolicyViolation(text string) *ClientError {
+	return NewStanzaError(ErrorTypeModify, "policy-violation", text)
+}
+
+// StanzaRecipientUnavailable reports a recipient that is temporarily away
+func StanzaRecipientUnavailable(text string) *ClientError {
+	return NewStanzaError(ErrorTypeWait, "recipient-unavailable", text)
+}
+
+// StanzaRedirect points the sender to uri, where the request should go
+func StanzaRedirect(uri, text string) *ClientError {
+	e := NewStanzaError(ErrorTypeModify, "redirect", text)
+	e.URI = uri
+	return e
+}
+
+// StanzaRegistrationRequired reports a sender that has to register first
+func StanzaRegistrationRequired(text string) *ClientError {
+	return NewStanzaError(ErrorTypeAuth, "registration-required", text)
+}
+
+// StanzaRemoteServerNotFound reports a remote domain that cannot be reached
+func StanzaRemoteServerNotFound(text string) *ClientError {
+	return NewStanzaError(ErrorTypeCancel, "remote-server-not-found", text)
+}
+
+// StanzaRemoteServerTimeout reports a remote domain that did not answer in
+// time
+func StanzaRemoteServerTimeout(text string) *ClientError {
+	return NewStanzaError(ErrorTypeWait, "remote-server-timeout", text)
+}
+
+// StanzaResourceConstraint reports a recipient that is too busy
+func StanzaResourceConstraint(text string) *ClientError {
+	return NewStanzaError(ErrorTypeWait, "resource-constraint", text)
+}
+
+// StanzaServiceUnavailable reports a service the recipient does not offer
+func StanzaServiceUnavailable(text string) *ClientError {
+	return NewStanzaError(ErrorTypeCancel, "service-unavailable", text)
+}
+
+// StanzaSubscriptionRequired reports a sender that has to subscribe first
+func StanzaSubscriptionRequired(text string) *ClientError {
+	return NewStanzaError(ErrorTypeAuth, "subscription-required", text)
+}
+
+// StanzaUndefinedCondition reports a condition not defined by RFC 6120
+func StanzaUndefinedCondition(text string) *ClientError {
+	return NewStanzaError(ErrorTypeCancel, "undefined-condition", text)
+}
+
+// StanzaUnexpectedRequest reports a request that came out of order
+func StanzaUnexpectedRequest(text string) *ClientError {
+	return NewStanzaError(ErrorTypeWait, "unexpected-request", text)
+}
+
+// ErrorReply builds the error response to a *ClientMessage, *ClientPresence
+// or *ClientIQ: same id, type 'error', 'to' and 'from' swapped and err
+// attached. It returns nil for stanzas that are errors themselves, which
+// must never be answered with an error (RFC 6120 section 8.3.1).
+func ErrorReply(stanza interface{}, err *ClientError) interface{} {
+	switch v := stanza.(type) {
+	case *ClientMessage:
+		if v.Type == "error" {
+			return nil
+		}
+		return &ClientMessage{From: v.To, To: v.From, ID: v.ID, Type: "error",
+			Subject: v.Subject, Body: v.Body, Thread: v.Thread, Error: err}
+	case *ClientPresence:
+		if v.Type == "error" {
+			return nil
+		}
+		return &ClientPresence{From: v.To, To: v.From, ID: v.ID, Type: "error", Error: err}
+	case *ClientIQ:
+		if v.Type == "error" || v.Type == "result" {
+			return nil
+		}
+		return &ClientIQ{From: v.To, To: v.From, ID: v.ID, Type: "error", Error: err}
+	}
+	log.Printf("ErrorReply: not a stanza: %T\n", stanza)
+	return nil
+}
+
+// undecodedStanza returns a stanza with the id and type of the element se
+// sent by from, which is enough to answer it with ErrorReply when the rest
+// of it could not be decoded
+func undecodedStanza(se xml.StartElement, from JID) interface{} {
+	var id, kind string
+	for _, attr := range se.Attr {
+		switch attr.Name {
+		case xml.Name{Local: "id"}:
+			id = attr.Value
+		case xml.Name{Local: "type"}:
+			kind = attr.Value
+		}
+	}
+	switch se.Name.Local {
+	case "message":
+		return &ClientMessage{From: from, ID: id, Type: kind}
+	case "presence":
+		return &ClientPresence{From: from, ID: id, Type: kind}
+	case "iq":
+		return &ClientIQ{From: from, ID: id, Type: kind}
+	}
+	return nil
+}
+
+// replyError sends an error response for stanza to client
+func (c *Client) replyError(stanza interface{}, err *ClientError) {
+	if reply := ErrorReply(stanza, err); reply != nil {
+		c.send(reply)
+	}
+}
+
+// addressesAccount reports whether to addresses the client's own account or
+// server, as requests handled on the user's behalf are (RFC 6120 10.3)
+func (c *Client) addressesAccount(to JID) bool {
+	return to.IsZero() || to == c.jid.Bare() || to.String() == c.jid.Domain()
+}
@@ -2,10 +2,10 @@ package xmpp
 
 import (
 	"crypto/tls"
-	"encoding/base64"
+	"encoding/xml"
 	"errors"
 	"log"
-	"strings"
+	"time"
 )
 
 // State processes the stream and moves to the next state
@@ -15,41 +15,64 @@ type State interface {
 
 // NewTLSStateMachine return steps through TCP TLS state
 func NewTLSStateMachine(skipTLS bool) State {
+	return newStateMachine(skipTLS, nil)
+}
+
+// newStateMachine builds the state chain for one connection; config
+// overrides Server.TLSConfig for STARTTLS
+func newStateMachine(skipTLS bool, config *tls.Config) State {
 	normal := &Normal{}
 	if skipTLS {
 		authedstream := &AuthedStream{Next: normal}
 		authedstart := &AuthedStart{Next: authedstream}
-		auth := &Auth{Next: authedstart}
-		start := &Start{Next: auth}
+		auth := &Auth{Next: authedstart, LegacyNext: normal}
+		start := &Start{Next: auth, SkipTLS: true}
 		return start
 	} else {
 		authedstream := &AuthedStream{Next: normal}
 		authedstart := &AuthedStart{Next: authedstream}
-		tlsauth := &TLSAuth{Next: authedstart}
+		tlsauth := &TLSAuth{Next: authedstart, LegacyNext: normal}
 		tlsstartstream := &TLSStartStream{Next: tlsauth}
-		tlsupgrade := &TLSUpgrade{Next: tlsstartstream}
+		tlsupgrade := &TLSUpgrade{Next: tlsstartstream, Config: config}
 		firststream := &TLSUpgradeRequest{Next: tlsupgrade}
 		start := &Start{Next: firststream}
 		return start
 	}
 }
 
+// newDirectTLSStateMachine builds the state chain for a connection that
+// completed the TLS handshake before the stream started (XEP-0368)
+func newDirectTLSStateMachine() State {
+	normal := &Normal{}
+	authedstream := &AuthedStream{Next: normal}
+	authedstart := &AuthedStart{Next: authedstream}
+	tlsauth := &TLSAuth{Next: authedstart, LegacyNext: normal}
+	return &Start{Next: tlsauth, SkipTLS: true}
+}
+
 // Start state
 type Start struct {
 	Next State
+	// SkipTLS offers SASL right away instead of STARTTLS
+	SkipTLS bool
 }
 
 // Process message
 func (state *Start) Process(c *Connection, client *Client, s *Server) (State, *Connection, error) {
 	log.Println("Start Process!!!")
-	_, err := c.Next()
-	if err != nil {
+	if err := startStream(c, client, s); err != nil {
 		return nil, c, err
 	}
-	// TODO: check that se is a stream
-	c.SendRawf("<?xml version='1.0'?><stream:stream id='%x' version='1.0' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'>", createCookie())
-	if s.SkipTLS {
-		c.SendRaw("<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism><mechanism>X-OAUTH2</mechanism></mechanisms></stream:features>")
+	if c.preXMPP {
+		// streams older than XMPP 1.0 have no features, the client goes
+		// straight to jabber:iq:auth and cannot negotiate STARTTLS
+		if !state.SkipTLS || !legacyAuthAllowed(c, s) {
+			return nil, c, StreamUnsupportedVersion("version 1.0 is required")
+		}
+		return state.Next, c, nil
+	}
+	if state.SkipTLS {
+		c.SendRaw("<stream:features>" + saslFeature(c, client, s) + registerFeature(s) + legacyAuthFeature(c, s) + "</stream:features>")
 	} else {
 		c.SendRaw("<stream:features><starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'><required/></starttls></stream:features>")
 	}
@@ -75,6 +98,8 @@ func (state *TLSUpgradeRequest) Process(c *Connection, client *Client, s *Server
 // TLSUpgrade state
 type TLSUpgrade struct {
 	Next State
+	// Config overrides Server.TLSConfig
+	Config *tls.Config
 }
 
 // Process message
@@ -82,13 +107,17 @@ func (state *TLSUpgrade) Process(c *Connection, client *Client, s *Server) (Stat
 	log.Println("TLSUpgrade Process!!!")
 	c.SendRaw("<proceed xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>")
 	// perform the TLS handshake
-	tlsConn := tls.Server(c.Raw, s.TLSConfig)
-	err := tlsConn.Handshake()
+	config := state.Config
+	if config == nil {
+		config = s.TLSConfig
+	}
+	tlsConn, cert, err := tlsHandshake(c.Raw, config)
 	if err != nil {
 		return nil, c, err
 	}
 	// restart the Connection
 	c = NewConn(tlsConn, c.MessageTypes)
+	c.serverCert = cert
 	return state.Next, c, nil
 }
 
@@ -100,19 +129,23 @@ type TLSStartStream struct {
 // Process messages
 func (state *TLSStartStream) Process(c *Connection, client *Client, s *Server) (State, *Connection, error) {
 	log.Println("TLSStartStream Process!!!")
-	_, err := c.Next()
-	if err != nil {
+	if err := startStream(c, client, s); err != nil {
 		return nil, c, err
 	}
-	// TODO: ensure check that se is a stream
-	c.SendRawf("<?xml version='1.0'?><stream:stream id='%x' version='1.0' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'>", createCookie())
-	c.SendRaw("<stream:features><mechanisms xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><mechanism>PLAIN</mechanism></mechanisms></stream:features>")
+	if c.preXMPP {
+		return state.Next, c, nil
+	}
+	c.SendRaw("<stream:features>" + saslFeature(c, client, s) + registerFeature(s) + legacyAuthFeature(c, s) + "</stream:features>")
 	return state.Next, c, nil
 }
 
 // TLSAuth state
 type TLSAuth struct {
 	Next State
+	// LegacyNext is entered after a legacy (XEP-0078) login, which binds
+	// the resource itself
+	LegacyNext State
+	failures   int
 }
 
 // Process messages
@@ -122,7 +155,6 @@ func (state *TLSAuth) Process(c *Connection, client *Client, s *Server) (State,
 	if err != nil {
 		return nil, c, err
 	}
-	// TODO: check what client sends, auth or register
 
 	// read the full auth stanza
 	_, val, err := c.Read(se)
@@ -133,35 +165,43 @@ func (state *TLSAuth) Process(c *Connection, client *Client, s *Server) (State,
 	}
 	switch v := val.(type) {
 	case *saslAuth:
-		data, err := base64.StdEncoding.DecodeString(v.Body)
-		if err != nil {
-			return nil, c, err
+		if c.preXMPP {
+			// only jabber:iq:auth before XMPP 1.0
+			return nil, c, StreamNotAuthorized("")
 		}
-		info := strings.Split(string(data), "\x00")
-		// should check that info[1] starts with client.jid
-		success, err := s.Accounts.Authenticate(info[1], info[2])
+		success, err := saslAuthenticate(c, client, s, v)
 		if err != nil {
 			return nil, c, err
 		}
-		if success {
-			client.localpart = info[1]
-			c.SendRaw("<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>")
-		} else {
-			c.SendRaw("<failure xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><not-authorized/></failure>")
+		if !success {
+			state.failures++
+			if state.failures >= maxAuthAttempts {
+				return nil, c, errors.New("client not authorized")
+			}
+			return state, c, nil
 		}
+	case *ClientIQ:
+		next, err := preAuthIQ(c, client, s, v, state, state.LegacyNext, &state.failures)
+		return next, c, err
 	default:
 		// expected authentication
 		//s.Log.Error(errors.New("Expected authentication").Error())
 		log.Println("Expected authentication")
-		return nil, c, err
+		return nil, c, errors.New("expected authentication")
 	}
 	return state.Next, c, nil
 }
 
+// Auth state
 type Auth struct {
 	Next State
+	// LegacyNext is entered after a legacy (XEP-0078) login, which binds
+	// the resource itself
+	LegacyNext State
+	failures   int
 }
 
+// Process messages
 func (state *Auth) Process(c *Connection, client *Client, s *Server) (State, *Connection, error) {
 	log.Println("Auth Process!!!")
 	se, err := c.Next()
@@ -171,7 +211,6 @@ func (state *Auth) Process(c *Connection, client *Client, s *Server) (State, *Co
 	}
 	//s.Log.Info(fmt.Sprintf("Auth read : %v", se))
 	log.Printf("Auth read: %v\n", se)
-	// TODO: check what client sends, auth or register
 
 	// read the full auth stanza
 	_, val, err := c.Read(se)
@@ -184,32 +223,57 @@ func (state *Auth) Process(c *Connection, client *Client, s *Server) (State, *Co
 	}
 	switch v := val.(type) {
 	case *saslAuth:
-		data, err := base64.StdEncoding.DecodeString(v.Body)
-		if err != nil {
-			return nil, c, err
+		if c.preXMPP {
+			// only jabber:iq:auth before XMPP 1.0
+			return nil, c, StreamNotAuthorized("")
 		}
-		info := strings.Split(string(data), "\x00")
-		// should check that info[1] starts with client.jid
-		success, err := s.Accounts.Authenticate(info[1], info[2])
+		success, err := saslAuthenticate(c, client, s, v)
 		if err != nil {
 			return nil, c, err
 		}
-		if success {
-			client.localpart = info[1]
-			c.SendRaw("<success xmlns='urn:ietf:params:xml:ns:xmpp-sasl'/>")
-		} else {
-			c.SendRaw("<failure xmlns='urn:ietf:params:xml:ns:xmpp-sasl'><not-authorized/></failure>")
-			return nil, c, errors.New("client not authorized")
+		if !success {
+			state.failures++
+			if state.failures >= maxAuthAttempts {
+				return nil, c, errors.New("client not authorized")
+			}
+			return state, c, nil
 		}
+	case *ClientIQ:
+		next, err := preAuthIQ(c, client, s, v, state, state.LegacyNext, &state.failures)
+		return next, c, err
 	default:
 		// expected authentication
 		//s.Log.Error(errors.New("Expected authentication").Error())
 		log.Println("Expected authentication")
-		return nil, c, err
+		return nil, c, errors.New("expected authentication")
 	}
 	return state.Next, c, nil
 }
 
+// preAuthIQ handles the IQs allowed before authentication, in-band
+// registration and legacy authentication, and returns the next state.
+// Streams older than XMPP 1.0 only get legacy authentication.
+func preAuthIQ(c *Connection, client *Client, s *Server, iq *ClientIQ, current, legacyNext State, failures *int) (State, error) {
+	if legacyNext != nil {
+		switch s.legacyAuth(c, client, iq) {
+		case legacyBound:
+			return legacyNext, nil
+		case legacyFailed:
+			*failures++
+			if *failures >= maxAuthAttempts {
+				return nil, errors.New("client not authorized")
+			}
+			return current, nil
+		case legacyAnswered:
+			return current, nil
+		}
+	}
+	if c.preXMPP || !s.handleRegistration(client, iq, func(reply interface{}) { c.SendStanza(reply) }) {
+		return nil, StreamNotAuthorized("")
+	}
+	return current, nil
+}
+
 // AuthedStart state
 type AuthedStart struct {
 	Next State
@@ -218,13 +282,15 @@ type AuthedStart struct {
 // Process messages
 func (state *AuthedStart) Process(c *Connection, client *Client, s *Server) (State, *Connection, error) {
 	log.Println("AuthedStart Process!!!")
-	_, err := c.Next()
-	if err != nil {
+	if err := startStream(c, client, s); err != nil {
 		return nil, c, err
 	}
-	c.SendRawf("<?xml version='1.0'?><stream:stream id='%x' version='1.0' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'>", createCookie())
+	if c.preXMPP {
+		// resource binding needs the stream features
+		return nil, c, StreamUnsupportedVersion("version 1.0 is required")
+	}
 	//org
-	c.SendRaw("<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/></stream:features>")
+	c.SendRaw("<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/>" + smFeature(s) + "<ver xmlns='" + NsRosterVer + "'/></stream:features>")
 
 	//c.SendRaw("<stream:features><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'/><session xmlns='urn:ietf:params:xml:ns:xmpp-session'><optional/></session><c ver='LcF33OEjnzEcDbJUF4hNy/ifCdE=' node='http://auth.kaonrms.com/' hash='sha-1' xmlns='http://jabber.org/protocol/caps'/><ver xmlns='urn:xmpp:features:rosterver'/><keepalive xmlns='urn:xmpp:keepalive:0'><interval min='60' max='300'/></keepalive></stream:features>")
 	return state.Next, c, nil
@@ -250,25 +316,40 @@ func (state *AuthedStream) Process(c *Connection, client *Client, s *Server) (St
 	}
 	switch v := val.(type) {
 	case *ClientIQ:
-		// TODO: actually validate that it's a bind request
-		// if v.Bind.Resource == "" {
-		// 	client.resourcepart = makeResource()
-		// } else {
-		// 	s.Log.Error(errors.New("Invalid bind request").Error())
-		// 	return nil, c, err
-		// }
-		log.Println("AuthedStream Client localpart(Username)", client.localpart)
-		log.Println("AuthedStream Clientdomainpart", client.domainpart)
-		log.Println("AuthedStream Clientresourcepart", client.resourcepart)
-
-		client.jid = client.localpart + "@" + client.domainpart + "/" + client.resourcepart
+		if v.Type != "set" || v.Bind == nil {
+			log.Println("Expected bind request")
+			c.SendStanza(ErrorReply(v, StanzaBadRequest("")))
+			return state, c, nil
+		}
+		err := s.bindResource(client, v.Bind.Resource)
+		if err == errResourceConflict {
+			c.SendStanza(ErrorReply(v, StanzaConflict("")))
+			return state, c, nil
+		}
+		if err != nil {
+			c.SendStanza(ErrorReply(v, StanzaBadRequest(err.Error())))
+			return state, c, nil
+		}
+		log.Println("AuthedStream Client localpart(Username)", client.jid.Local())
+		log.Println("AuthedStream Clientdomainpart", client.jid.Domain())
+		log.Println("AuthedStream Clientresourcepart", client.jid.Resource())
+
 		c.SendRawf("<iq id='%s' type='result'><bind xmlns='urn:ietf:params:xml:ns:xmpp-bind'><jid>%s</jid></bind></iq>", v.ID, client.jid)
 
-		s.ConnectBus <- Connect{Jid: client.jid, Receiver: client.messages}
+		s.ConnectBus <- Connect{Jid: client.jid, Receiver: client.messages, Anonymous: client.anonymous}
+	case *smResume:
+		// a resumed session is already bound and known to the router
+		if s.DisableStreamManagement {
+			c.SendStanza(smFailure("feature-not-implemented", nil))
+			return state, c, nil
+		}
+		if !s.resumeSession(c, client, v) {
+			return state, c, nil
+		}
 	default:
 		//s.Log.Error(errors.New("Expected ClientIQ message").Error())
 		log.Println("Expected ClientIQ message")
-		return nil, c, err
+		return nil, c, errors.New("expected bind request")
 	}
 	return state.Next, c, nil
 }
@@ -279,52 +360,222 @@ type Normal struct{}
 // Process messages
 func (state *Normal) Process(c *Connection, client *Client, s *Server) (State, *Connection, error) {
 	log.Println("Normal Process!!!")
-	var err error
-	readDone := make(chan bool)
-	errors := make(chan error)
+	errors := make(chan error, 1)
 
 	// one go routine to read/respond
-	go func(done chan bool, errors chan error) {
+	go func(errors chan error) {
 		for {
 			se, err := c.Next()
 			if err != nil {
 				log.Printf("err: %v\n", err.Error())
 				errors <- err
-				done <- true
 				return
 			}
 			log.Printf("start element: %v\n", se)
 
 			name, val, readErr := c.Read(se)
 			if readErr != nil {
-				log.Printf("Read Error: %v\n", err.Error())
-			} else {
-				log.Printf("Read Name[%v]: %v\n", name, val)
+				log.Printf("Read Error: %v\n", readErr.Error())
+				if isStanza(se.Name) {
+					client.replyError(undecodedStanza(se, client.jid), readErrorCondition(readErr))
+					client.sm.countInbound()
+				}
+				continue
 			}
+			log.Printf("Read Name[%v]: %v\n", name, val)
 
-			for _, extension := range s.Extensions {
-				extension.Process(val, client)
+			if s.handleSM(client, val) {
+				continue
+			}
+			s.processStanza(client, val)
+			if isStanza(se.Name) {
+				client.sm.countInbound()
 			}
 		}
-	}(readDone, errors)
+	}(errors)
+
+	if !s.activateConn(client) {
+		c.sendStreamError(StreamSystemShutdown(""), client.jid.Domain())
+		return nil, c, nil
+	}
+	quit := s.quitChan()
+
+	// after a resumption, resend what the client has not acknowledged
+	for _, message := range client.sm.takePending() {
+		if err := deliver(c, client, message); err != nil {
+			return state.stop(c, client, s, err, errors)
+		}
+	}
 
 	for {
 		select {
-		case messages := <-client.messages:
-			switch msg := messages.(type) {
-			default:
-				err = c.SendStanza(msg)
-			case string:
-				err = c.SendRaw(msg)
-			}
-			if err != nil {
-				errors <- err
+		case message := <-client.messages:
+			s.receivedCarbons(client, message)
+			if err := deliver(c, client, message); err != nil {
+				return state.stop(c, client, s, err, errors)
 			}
-		case <-readDone:
-			return nil, c, nil
 		case err := <-errors:
+			if err == ErrStreamClosed {
+				// answer the client's closing tag with ours once everything
+				// queued for it has been written (RFC 6120 4.4)
+				log.Printf("Stream closed by %v\n", client.jid)
+				flush(c, client)
+				c.closeStream()
+				return nil, c, nil
+			}
 			//s.Log.Error(fmt.Sprintf("Connection Error: %s", err.Error()))
 			log.Printf("Connection Error: %v\n", err.Error())
+			// the decoder reports a connection dropped inside the stream
+			// as a syntax error
+			if se, ok := err.(*xml.SyntaxError); ok && se.Msg != "unexpected EOF" {
+				c.sendStreamError(StreamNotWellFormed(""), client.jid.Domain())
+				return nil, c, nil
+			}
+			if s.detachSession(client) {
+				return nil, c, errSessionDetached
+			}
+			return nil, c, nil
+		case <-quit:
+			if flush(c, client) == nil {
+				c.sendStreamError(StreamSystemShutdown(""), client.jid.Domain())
+				awaitClose(errors)
+			}
+			return nil, c, nil
+		}
+	}
+}
+
+// stop ends the Normal state after deliver failed. A failed write leaves
+// a resumable session detached instead of closing it.
+func (state *Normal) stop(c *Connection, client *Client, s *Server, err error, errors <-chan error) (State, *Connection, error) {
+	if err == errStreamTerminated {
+		awaitClose(errors)
+		return nil, c, nil
+	}
+	if s.detachSession(client) {
+		return nil, c, errSessionDetached
+	}
+	return nil, c, nil
+}
+
+// readErrorCondition is the stanza error answering a stanza that could not
+// be decoded
+func readErrorCondition(err error) *ClientError {
+	var jidErr *MalformedJIDError
+	if errors.As(err, &jidErr) {
+		return StanzaJIDMalformed(jidErr.Error())
+	}
+	return StanzaBadRequest("")
+}
+
+// isStanza reports whether name is a stanza, which stream management counts
+func isStanza(name xml.Name) bool {
+	return name.Space == NsClient && (name.Local == "message" || name.Local == "presence" || name.Local == "iq")
+}
+
+// processStanza hands a stanza read in the Normal state to the built-in
+// handlers and then to the extensions
+func (s *Server) processStanza(client *Client, val interface{}) {
+	iq, isIQ := val.(*ClientIQ)
+	if isIQ {
+		// the server stamps the sender's address (RFC 6120 8.1.2.1)
+		iq.From = client.jid
+		if s.handleRegistration(client, iq, func(reply interface{}) { client.send(reply) }) {
+			return
+		}
+		if s.handleCarbons(client, iq) {
+			return
+		}
+		if s.handleRoster(client, iq) {
+			return
+		}
+	}
+	if presence, ok := val.(*ClientPresence); ok {
+		presence.From = client.jid
+		if s.handlePresence(client, presence) {
+			return
+		}
+	}
+	message, isMessage := val.(*ClientMessage)
+	if isMessage {
+		// stamped here too as carbons copy the message after routing
+		message.From = client.jid
+	}
+	handled := false
+	for _, extension := range s.Extensions {
+		if handler, ok := extension.(IQHandler); ok && isIQ {
+			handled = handler.HandleIQ(iq, client) || handled
+		} else {
+			extension.Process(val, client)
+		}
+	}
+	if isMessage {
+		s.sendCarbons(client, message)
+	}
+	if isIQ && !handled && (iq.Type == "get" || iq.Type == "set") {
+		// every request has to be answered (RFC 6120 8.2.3)
+		client.replyError(iq, StanzaServiceUnavailable(""))
+	}
+}
+
+// deliver writes a message queued for the client. It returns
+// errStreamTerminated once a stream error has been sent.
+func deliver(c *Connection, client *Client, message interface{}) error {
+	var err error
+	switch msg := message.(type) {
+	case *StreamError:
+		// the server is terminating the session
+		c.sendStreamError(msg, client.jid.Domain())
+		return errStreamTerminated
+	case *smEnabled:
+		err = c.SendStanza(msg)
+		client.sm.lock.Lock()
+		client.sm.enabled = true
+		client.sm.lock.Unlock()
+	case *smAnswer, *smRequest, *smFailed:
+		err = c.SendStanza(msg)
+	default:
+		// queue before writing so a failed write can be resent
+		request, qerr := client.sm.queue(message)
+		if qerr != nil {
+			c.sendStreamError(StreamPolicyViolation(qerr.Error()), client.jid.Domain())
+			return errStreamTerminated
+		}
+		if text, ok := msg.(string); ok {
+			err = c.SendRaw(text)
+		} else {
+			err = c.SendStanza(msg)
 		}
+		if err == nil && request {
+			err = c.SendStanza(&smRequest{})
+		}
+	}
+	if err != nil {
+		//s.Log.Error(fmt.Sprintf("Connection Error: %s", err.Error()))
+		log.Printf("Connection Error: %v\n", err.Error())
+	}
+	return err
+}
+
+// flush writes the messages already queued for the client
+func flush(c *Connection, client *Client) error {
+	for {
+		select {
+		case message := <-client.messages:
+			if err := deliver(c, client, message); err != nil {
+				return err
+			}
+		default:
+			return nil
+		}
+	}
+}
+
+// awaitClose gives the client a moment to answer our closing tag before
+// the connection is dropped
+func awaitClose(errors <-chan error) {
+	select {
+	case <-errors:
+	case <-time.After(closeTimeout):
 	}
 }
@@ -0,0 +1,340 @@
+package xmpp
+
+import (
+	"encoding/xml"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// xmlNamespace is the namespace bound to the reserved xml prefix
+const xmlNamespace = "http://www.w3.org/XML/1998/namespace"
+
+// NewStreamError returns a stream error with the given defined condition
+// (RFC 6120 section 4.9.3) and optional descriptive text
+func NewStreamError(condition, text string) *StreamError {
+	return &StreamError{Any: xml.Name{Space: NsStreams, Local: condition}, Text: text}
+}
+
+// Error implements the error interface so states can return stream errors
+func (e *StreamError) Error() string {
+	if e.Text != "" {
+		return "stream error: " + e.Any.Local + ": " + e.Text
+	}
+	return "stream error: " + e.Any.Local
+}
+
+// Condition returns the defined condition of the error
+func (e *StreamError) Condition() string {
+	return e.Any.Local
+}
+
+// raw returns the <stream:error/> element as sent on the wire
+func (e *StreamError) raw() string {
+	var b strings.Builder
+	b.WriteString("<stream:error>")
+	if e.Any.Local == "see-other-host" && e.Host != "" {
+		fmt.Fprintf(&b, "<see-other-host xmlns='%s'>%s</see-other-host>", NsStreams, xmlEscape(e.Host))
+	} else {
+		fmt.Fprintf(&b, "<%s xmlns='%s'/>", e.Any.Local, NsStreams)
+	}
+	if e.Text != "" {
+		fmt.Fprintf(&b, "<text xmlns='%s' xml:lang='en'>%s</text>", NsStreams, xmlEscape(e.Text))
+	}
+	b.WriteString("</stream:error>")
+	return b.String()
+}
+
+// Stream error conditions, RFC 6120 section 4.9.3
+
+// StreamBadFormat reports XML that cannot be processed
+func StreamBadFormat(text string) *StreamError { return NewStreamError("bad-format", text) }
+
+// StreamBadNamespacePrefix reports an unsupported namespace prefix
+func StreamBadNamespacePrefix(text string) *StreamError {
+	return NewStreamError("bad-namespace-prefix", text)
+}
+
+// StreamConflict reports a new stream that conflicts with an existing one
+func StreamConflict(text string) *StreamError { return NewStreamError("conflict", text) }
+
+// StreamConnectionTimeout reports a peer that has been silent too long
+func StreamConnectionTimeout(text string) *StreamError {
+	return NewStreamError("connection-timeout", text)
+}
+
+// StreamHostGone reports a 'to' domain that is no longer served
+func StreamHostGone(text string) *StreamError { return NewStreamError("host-gone", text) }
+
+// StreamHostUnknown reports a 'to' domain that is not served
+func StreamHostUnknown(text string) *StreamError { return NewStreamError("host-unknown", text) }
+
+// StreamImproperAddressing reports a missing or invalid 'to' or 'from'
+func StreamImproperAddressing(text string) *StreamError {
+	return NewStreamError("improper-addressing", text)
+}
+
+// StreamInternalServerError reports a server misconfiguration or failure
+func StreamInternalServerError(text string) *StreamError {
+	return NewStreamError("internal-server-error", text)
+}
+
+// StreamInvalidFrom reports a 'from' address the peer may not use
+func StreamInvalidFrom(text string) *StreamError { return NewStreamError("invalid-from", text) }
+
+// StreamInvalidNamespace reports a wrong stream or content namespace
+func StreamInvalidNamespace(text string) *StreamError {
+	return NewStreamError("invalid-namespace", text)
+}
+
+// StreamInvalidXML reports XML that fails validation
+func StreamInvalidXML(text string) *StreamError { return NewStreamError("invalid-xml", text) }
+
+// StreamNotAuthorized reports data sent before the stream was authenticated
+func StreamNotAuthorized(text string) *StreamError {
+	return NewStreamError("not-authorized", text)
+}
+
+// StreamNotWellFormed reports XML that is not well-formed
+func StreamNotWellFormed(text string) *StreamError {
+	return NewStreamError("not-well-formed", text)
+}
+
+// StreamPolicyViolation reports a violation of local service policy
+func StreamPolicyViolation(text string) *StreamError {
+	return NewStreamError("policy-violation", text)
+}
+
+// StreamRemoteConnectionFailed reports a failed connection to a remote entity
+func StreamRemoteConnectionFailed(text string) *StreamError {
+	return NewStreamError("remote-connection-failed", text)
+}
+
+// StreamReset reports that the server is closing the stream to reset it
+func StreamReset(text string) *StreamError { return NewStreamError("reset", text) }
+
+// StreamResourceConstraint reports a server without resources for the stream
+func StreamResourceConstraint(text string) *StreamError {
+	return NewStreamError("resource-constraint", text)
+}
+
+// StreamRestrictedXML reports comments, processing instructions, DTDs or
+// entity references
+func StreamRestrictedXML(text string) *StreamError {
+	return NewStreamError("restricted-xml", text)
+}
+
+// StreamSeeOtherHost redirects the peer to host, a domain or host:port
+func StreamSeeOtherHost(host, text string) *StreamError {
+	e := NewStreamError("see-other-host", text)
+	e.Host = host
+	return e
+}
+
+// StreamSystemShutdown reports that the server is being shut down
+func StreamSystemShutdown(text string) *StreamError {
+	return NewStreamError("system-shutdown", text)
+}
+
+// StreamUndefinedCondition reports a condition not defined by RFC 6120
+func StreamUndefinedCondition(text string) *StreamError {
+	return NewStreamError("undefined-condition", text)
+}
+
+// StreamUnsupportedEncoding reports an encoding other than UTF-8
+func StreamUnsupportedEncoding(text string) *StreamError {
+	return NewStreamError("unsupported-encoding", text)
+}
+
+// StreamUnsupportedFeature reports a mandatory feature the server lacks
+func StreamUnsupportedFeature(text string) *StreamError {
+	return NewStreamError("unsupported-feature", text)
+}
+
+// StreamUnsupportedStanzaType reports an unknown first-level child element
+func StreamUnsupportedStanzaType(text string) *StreamError {
+	return NewStreamError("unsupported-stanza-type", text)
+}
+
+// StreamUnsupportedVersion reports a stream version the server cannot speak
+func StreamUnsupportedVersion(text string) *StreamError {
+	return NewStreamError("unsupported-version", text)
+}
+
+// xmlEscape escapes s for use as character data or an attribute value
+func xmlEscape(s string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(s))
+	return b.String()
+}
+
+// startStream reads the client's stream header, validates it and answers
+// with our own. The first header of a connection picks the domain the
+// client talks to; later headers have to keep it.
+func startStream(c *Connection, client *Client, s *Server) error {
+	se, err := c.Next()
+	if err != nil {
+		return err
+	}
+	domain, lang, preXMPP, streamErr := checkStreamHeader(se, client, s)
+	if lang != "" {
+		c.lang = lang
+	}
+	if _, tcp := c.transport.(tcpTransport); preXMPP && streamErr == nil && !tcp {
+		streamErr = StreamUnsupportedVersion("version 1.0 is required")
+	}
+	if streamErr != nil {
+		return streamErr
+	}
+	c.preXMPP = preXMPP
+	client.jid = domain
+	return c.openStream(domain.Domain())
+}
+
+// checkStreamHeader validates a <stream:stream> start element (RFC 6120
+// section 4.7) and returns the domain it is addressed to, its language and
+// whether it comes from a client older than XMPP 1.0
+func checkStreamHeader(se xml.StartElement, client *Client, s *Server) (JID, string, bool, *StreamError) {
+	var to, version, lang, content string
+	hasContent, hasVersion := false, false
+	for _, attr := range se.Attr {
+		switch {
+		case attr.Name.Space == "" && attr.Name.Local == "to":
+			to = attr.Value
+		case attr.Name.Space == "" && attr.Name.Local == "version":
+			version, hasVersion = attr.Value, true
+		case attr.Name.Space == xmlNamespace && attr.Name.Local == "lang":
+			lang = attr.Value
+		case attr.Name.Space == "" && attr.Name.Local == "xmlns":
+			content, hasContent = attr.Value, true
+		}
+	}
+	if !validLanguageTag(lang) {
+		lang = ""
+	}
+
+	if se.Name.Space != NsStream {
+		return JID{}, lang, false, StreamInvalidNamespace("stream namespace must be " + NsStream)
+	}
+	if se.Name.Local != "stream" {
+		return JID{}, lang, false, StreamBadFormat("expected a stream header")
+	}
+	if !hasContent || content != NsClient {
+		return JID{}, lang, false, StreamInvalidNamespace("content namespace must be " + NsClient)
+	}
+	// old clients that log in with jabber:iq:auth send no version
+	preXMPP := !hasVersion && s.AllowLegacyAuth
+	if !preXMPP && !supportedStreamVersion(version) {
+		return JID{}, lang, false, StreamUnsupportedVersion("version 1.0 is required")
+	}
+
+	domain := client.jid.Bare()
+	if to != "" {
+		requested, err := NewJID("", to, "")
+		if err != nil {
+			return JID{}, lang, false, StreamHostUnknown("")
+		}
+		if client.jid.Local() != "" {
+			// the stream is authenticated, the domain cannot change anymore
+			if requested.Domain() != client.jid.Domain() {
+				return JID{}, lang, false, StreamHostUnknown("")
+			}
+		} else if !s.servesDomain(requested.Domain()) {
+			return JID{}, lang, false, StreamHostUnknown("")
+		}
+		domain = JID{local: client.jid.Local(), domain: requested.Domain()}
+	}
+	return domain, lang, preXMPP, nil
+}
+
+// supportedStreamVersion reports whether version is 1.x. A missing version
+// means a pre-RFC 3920 stream, which is only accepted from old clients
+// when Server.AllowLegacyAuth is set, see Connection.preXMPP.
+func supportedStreamVersion(version string) bool {
+	parts := strings.Split(version, ".")
+	if len(parts) != 2 {
+		return false
+	}
+	major, err := strconv.Atoi(parts[0])
+	if err != nil || major < 0 {
+		return false
+	}
+	minor, err := strconv.Atoi(parts[1])
+	if err != nil || minor < 0 {
+		return false
+	}
+	return major == 1
+}
+
+// validLanguageTag does a loose syntax check of a BCP 47 language tag
+func validLanguageTag(tag string) bool {
+	if tag == "" || len(tag) > 35 {
+		return false
+	}
+	for _, sub := range strings.Split(tag, "-") {
+		if sub == "" || len(sub) > 8 {
+			return false
+		}
+		for _, r := range sub {
+			if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// servesDomain reports whether domain is s.Domain or one of s.Domains
+func (s *Server) servesDomain(domain string) bool {
+	if jid, err := NewJID("", s.Domain, ""); err == nil && jid.Domain() == domain {
+		return true
+	}
+	for name := range s.Domains {
+		if jid, err := NewJID("", name, ""); err == nil && jid.Domain() == domain {
+			return true
+		}
+	}
+	return false
+}
+
+// openStream sends our stream header with a fresh stream id
+func (c *Connection) openStream(domain string) error {
+	c.streamID = fmt.Sprintf("%x", createCookie())
+	lang := c.lang
+	if lang == "" {
+		lang = "en"
+	}
+	c.streamOpen = true
+	version := "1.0"
+	if c.preXMPP {
+		// answer without a version too (RFC 6120 4.7.5)
+		version = ""
+	}
+	err := c.transport.openStream(domain, c.streamID, lang, version)
+	if err != nil {
+		log.Printf("openStream Write err: %v\n", err.Error())
+	}
+	log.Printf("openStream from %v id %v\n", domain, c.streamID)
+	return err
+}
+
+// closeStream sends our closing tag if the stream is open
+func (c *Connection) closeStream() error {
+	if !c.streamOpen {
+		return nil
+	}
+	c.streamOpen = false
+	return c.transport.closeStream("")
+}
+
+// sendStreamError sends e and closes the stream, opening it first if we
+// have not sent a header yet (RFC 6120 section 4.9.1.1)
+func (c *Connection) sendStreamError(e *StreamError, domain string) error {
+	log.Printf("Sending stream error: %v\n", e)
+	if !c.streamOpen {
+		c.openStream(domain)
+	}
+	c.streamOpen = false
+	return c.transport.closeStream(e.raw())
+}
@@ -0,0 +1,142 @@
+package xmpp
+
+import (
+	"crypto"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+)
+
+const (
+	// NsSASLChannelBinding XEP-0440 xml namespace
+	NsSASLChannelBinding = "urn:xmpp:sasl-cb:0"
+
+	// ChannelBindingTLSExporter is the RFC 9266 channel binding type
+	ChannelBindingTLSExporter = "tls-exporter"
+	// ChannelBindingTLSServerEndPoint is the RFC 5929 channel binding type
+	ChannelBindingTLSServerEndPoint = "tls-server-end-point"
+
+	// ALPNXMPPClient is the ALPN protocol id for direct TLS client
+	// connections (XEP-0368)
+	ALPNXMPPClient = "xmpp-client"
+)
+
+// tlsHandshake performs the server side TLS handshake on raw and returns the
+// secured connection along with the certificate that was presented.
+func tlsHandshake(raw net.Conn, config *tls.Config) (*tls.Conn, *x509.Certificate, error) {
+	var chosen *tls.Certificate
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	// crypto/tls skips GetCertificate when Certificates is set and the client
+	// sent no SNI, so take over certificate selection entirely
+	certificates := config.Certificates
+	getCertificate := config.GetCertificate
+	config.Certificates = nil
+	config.GetCertificate = func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+		// remember the certificate so tls-server-end-point can be computed
+		if getCertificate != nil {
+			cert, err := getCertificate(hello)
+			if cert != nil || err != nil {
+				chosen = cert
+				return cert, err
+			}
+		}
+		for i := range certificates {
+			if hello.SupportsCertificate(&certificates[i]) == nil {
+				chosen = &certificates[i]
+				return chosen, nil
+			}
+		}
+		if len(certificates) > 0 {
+			chosen = &certificates[0]
+			return chosen, nil
+		}
+		return nil, errors.New("no TLS certificate configured")
+	}
+
+	tlsConn := tls.Server(raw, config)
+	if err := tlsConn.Handshake(); err != nil {
+		return nil, nil, err
+	}
+
+	var leaf *x509.Certificate
+	if chosen != nil && len(chosen.Certificate) > 0 {
+		leaf = chosen.Leaf
+		if leaf == nil {
+			var err error
+			if leaf, err = x509.ParseCertificate(chosen.Certificate[0]); err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	return tlsConn, leaf, nil
+}
+
+// channelBindingTypes lists the channel binding types supported by the stream
+func (c *Connection) channelBindingTypes() []string {
+	state := c.tlsState()
+	if state == nil {
+		return nil
+	}
+	var types []string
+	if state.Version >= tls.VersionTLS13 {
+		types = append(types, ChannelBindingTLSExporter)
+	}
+	if c.serverCert != nil {
+		types = append(types, ChannelBindingTLSServerEndPoint)
+	}
+	return types
+}
+
+// channelBinding returns the channel binding data of the given type
+func (c *Connection) channelBinding(cbType string) ([]byte, error) {
+	state := c.tlsState()
+	if state == nil {
+		return nil, errors.New("channel binding requires TLS")
+	}
+	switch cbType {
+	case ChannelBindingTLSExporter:
+		if state.Version < tls.VersionTLS13 {
+			return nil, errors.New("tls-exporter requires TLS 1.3")
+		}
+		return state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+	case ChannelBindingTLSServerEndPoint:
+		if c.serverCert == nil {
+			return nil, errors.New("no server certificate")
+		}
+		// RFC 5929 4.1: use the certificate's signature hash, but never
+		// anything weaker than SHA-256
+		h := crypto.SHA256
+		switch c.serverCert.SignatureAlgorithm {
+		case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+			h = crypto.SHA384
+		case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+			h = crypto.SHA512
+		}
+		hash := h.New()
+		hash.Write(c.serverCert.Raw)
+		return hash.Sum(nil), nil
+	}
+	return nil, errors.New("unsupported channel binding type " + cbType)
+}
+
+// directTLSConfig returns config with xmpp-client added to the ALPN
+// protocols
+func directTLSConfig(config *tls.Config) *tls.Config {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	for _, proto := range config.NextProtos {
+		if proto == ALPNXMPPClient {
+			return config
+		}
+	}
+	config.NextProtos = append([]string{ALPNXMPPClient}, config.NextProtos...)
+	return config
+}
@@ -0,0 +1,122 @@
+package xmpp
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net"
+)
+
+// transport carries the XML of a Connection. TCP carries one continuous
+// stream, framed transports such as WebSocket map the stream header and
+// closing tag to their own framing.
+type transport interface {
+	// Read returns the XML sent by the client as one continuous stream
+	io.Reader
+	// openStream sends our stream header, closeStream the elements in
+	// final, such as a stream error, followed by our closing tag. version
+	// is empty for pre-XMPP 1.0 streams, which only TCP carries.
+	openStream(from, id, lang, version string) error
+	closeStream(final string) error
+	// write sends one or more complete top-level elements
+	write(data []byte) (int, error)
+	// tlsState returns the state of the TLS connection underneath, or nil
+	tlsState() *tls.ConnectionState
+}
+
+// tcpTransport is the transport of RFC 6120 over a net.Conn
+type tcpTransport struct {
+	net.Conn
+}
+
+func (t tcpTransport) openStream(from, id, lang, version string) error {
+	if version != "" {
+		version = " version='" + version + "'"
+	}
+	_, err := fmt.Fprintf(t.Conn, "<?xml version='1.0'?><stream:stream from='%s' id='%s'%s xml:lang='%s' xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'>",
+		xmlEscape(from), id, version, xmlEscape(lang))
+	return err
+}
+
+func (t tcpTransport) closeStream(final string) error {
+	_, err := io.WriteString(t.Conn, final+"</stream:stream>")
+	return err
+}
+
+func (t tcpTransport) write(data []byte) (int, error) {
+	return t.Conn.Write(data)
+}
+
+func (t tcpTransport) tlsState() *tls.ConnectionState {
+	tlsConn, ok := t.Conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	return &state
+}
+
+// splitElements cuts data into its top-level elements for framed
+// transports. Without the stream header around them, each element gets the
+// jabber:client or stream namespace declaration it relies on (RFC 7395
+// section 3.3.3, XEP-0206 section 6).
+func splitElements(data []byte) []string {
+	var frames []string
+	d := xml.NewDecoder(bytes.NewReader(data))
+	depth := 0
+	var start int64
+	var root xml.StartElement
+	for {
+		offset := d.InputOffset()
+		token, err := d.RawToken()
+		if err == io.EOF {
+			return frames
+		}
+		if err != nil {
+			// not ours to fix, send it as it is
+			return []string{string(data)}
+		}
+		switch v := token.(type) {
+		case xml.StartElement:
+			if depth == 0 {
+				start, root = offset, v.Copy()
+			}
+			depth++
+		case xml.EndElement:
+			depth--
+		default:
+			continue
+		}
+		if depth == 0 {
+			frames = append(frames, declareNamespace(string(data[start:d.InputOffset()]), root))
+		}
+	}
+}
+
+// declareNamespace adds the namespace declaration the root of element
+// needs outside of a stream
+func declareNamespace(element string, root xml.StartElement) string {
+	var declaration string
+	switch root.Name.Space {
+	case "stream":
+		declaration = " xmlns:stream='" + NsStream + "'"
+	case "":
+		declaration = " xmlns='jabber:client'"
+	default:
+		return element
+	}
+	for _, attr := range root.Attr {
+		if (root.Name.Space == "" && attr.Name.Space == "" && attr.Name.Local == "xmlns") ||
+			(attr.Name.Space == "xmlns" && attr.Name.Local == root.Name.Space) {
+			return element
+		}
+	}
+	name := root.Name.Local
+	if root.Name.Space != "" {
+		name = root.Name.Space + ":" + name
+	}
+	at := len("<" + name)
+	return element[:at] + declaration + element[at:]
+}
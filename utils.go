@@ -3,7 +3,7 @@ package xmpp
 import (
 	"crypto/rand"
 	"encoding/binary"
-	//"fmt"
+	"fmt"
 )
 
 // Cookie is used to give a unique identifier to each request.
@@ -17,10 +17,18 @@ func createCookie() Cookie {
 	return Cookie(binary.LittleEndian.Uint64(buf[:]))
 }
 
-// func makeResource() string {
-// 	var buf [16]byte
-// 	if _, err := rand.Reader.Read(buf[:]); err != nil {
-// 		panic("Failed to read random bytes: " + err.Error())
-// 	}
-// 	return fmt.Sprintf("%x", buf)
-// }
+func randomBytes(n int) []byte {
+	buf := make([]byte, n)
+	if _, err := rand.Reader.Read(buf); err != nil {
+		panic("Failed to read random bytes: " + err.Error())
+	}
+	return buf
+}
+
+func makeResource() string {
+	var buf [16]byte
+	if _, err := rand.Reader.Read(buf[:]); err != nil {
+		panic("Failed to read random bytes: " + err.Error())
+	}
+	return fmt.Sprintf("%x", buf)
+}
@@ -0,0 +1,150 @@
+package xmpp
+
+import (
+	"crypto/tls"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// NsFraming RFC 7395 WebSocket framing namespace
+	NsFraming = "urn:ietf:params:xml:ns:xmpp-framing"
+	// wsProtocol is the WebSocket subprotocol of XMPP
+	wsProtocol = "xmpp"
+)
+
+// WebSocketHandler returns an http.Handler serving XMPP over WebSocket
+// (RFC 7395), to be mounted on a path such as "/xmpp-websocket". The
+// connections go through the same states and extensions as TCP ones,
+// except STARTTLS: serve the handler over https to get TLS. Plain http
+// connections are refused unless Server.SkipTLS is set.
+func (s *Server) WebSocketHandler() http.Handler {
+	return websocket.Server{
+		Handshake: s.wsHandshake,
+		Handler:   s.serveWebSocket,
+	}
+}
+
+// wsHandshake accepts only clients asking for the xmpp subprotocol, over
+// TLS unless the server skips TLS
+func (s *Server) wsHandshake(config *websocket.Config, r *http.Request) error {
+	if r.TLS == nil && !s.SkipTLS {
+		log.Printf("Refusing WebSocket connection without TLS from: %v\n", r.RemoteAddr)
+		return errors.New("xmpp: TLS is required")
+	}
+	for _, protocol := range config.Protocol {
+		if protocol == wsProtocol {
+			config.Protocol = []string{wsProtocol}
+			return nil
+		}
+	}
+	return errors.New("xmpp: websocket client does not speak the xmpp subprotocol")
+}
+
+// serveWebSocket runs the XMPP session on ws
+func (s *Server) serveWebSocket(ws *websocket.Conn) {
+	defer ws.Close()
+	ws.PayloadType = websocket.TextFrame
+	log.Printf("Accepting WebSocket connection from: %v\n", ws.Request().RemoteAddr)
+
+	s.serveClient(ws, ws.Request().RemoteAddr, func() (*Connection, State) {
+		return newTransportConn(ws, &wsTransport{ws: ws}, MessageTypes), newStateMachine(true, nil)
+	})
+}
+
+// wsTransport carries a stream in WebSocket text frames, one top-level
+// element per frame, with <open/> and <close/> in place of the stream
+// header and closing tag
+type wsTransport struct {
+	ws *websocket.Conn
+	// unread is what is left of the last frame received
+	unread []byte
+}
+
+// Read returns the frames of the client as a continuous stream, turning
+// <open/> into a stream header and <close/> into a closing tag
+func (t *wsTransport) Read(p []byte) (int, error) {
+	for len(t.unread) == 0 {
+		var frame string
+		if err := websocket.Message.Receive(t.ws, &frame); err != nil {
+			return 0, err
+		}
+		t.unread = []byte(unframe(frame))
+	}
+	n := copy(p, t.unread)
+	t.unread = t.unread[n:]
+	return n, nil
+}
+
+// unframe converts a frame received from the client into stream XML
+func unframe(frame string) string {
+	d := xml.NewDecoder(strings.NewReader(frame))
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return frame
+		}
+		se, ok := token.(xml.StartElement)
+		if !ok {
+			continue
+		}
+		switch se.Name {
+		case xml.Name{Space: NsFraming, Local: "open"}:
+			var b strings.Builder
+			b.WriteString("<stream:stream xmlns='jabber:client' xmlns:stream='" + NsStream + "'")
+			for _, attr := range se.Attr {
+				if attr.Name.Space == "xmlns" || attr.Name.Local == "xmlns" {
+					continue
+				}
+				name := attr.Name.Local
+				if attr.Name.Space == xmlNamespace {
+					name = "xml:" + name
+				}
+				fmt.Fprintf(&b, " %s='%s'", name, xmlEscape(attr.Value))
+			}
+			b.WriteString(">")
+			return b.String()
+		case xml.Name{Space: NsFraming, Local: "close"}:
+			return "</stream:stream>"
+		}
+		return frame
+	}
+}
+
+func (t *wsTransport) openStream(from, id, lang, version string) error {
+	return t.send(fmt.Sprintf("<open xmlns='%s' from='%s' id='%s' version='1.0' xml:lang='%s'/>",
+		NsFraming, xmlEscape(from), id, xmlEscape(lang)))
+}
+
+func (t *wsTransport) closeStream(final string) error {
+	if final != "" {
+		if _, err := t.write([]byte(final)); err != nil {
+			return err
+		}
+	}
+	return t.send("<close xmlns='" + NsFraming + "'/>")
+}
+
+// write sends each top-level element of data in a frame of its own
+func (t *wsTransport) write(data []byte) (int, error) {
+	for _, frame := range splitElements(data) {
+		if err := t.send(frame); err != nil {
+			return 0, err
+		}
+	}
+	return len(data), nil
+}
+
+func (t *wsTransport) send(frame string) error {
+	return websocket.Message.Send(t.ws, frame)
+}
+
+func (t *wsTransport) tlsState() *tls.ConnectionState {
+	return t.ws.Request().TLS
+}
@@ -8,22 +8,50 @@ package xmpp
 
 import (
 	"crypto/tls"
+	"encoding/xml"
+	"io"
 	"log"
 	"net"
+	"sync"
+	"time"
 )
 
 // Client xmpp connection
 type Client struct {
-	jid          string
-	localpart    string
-	domainpart   string
-	resourcepart string
-	messages     chan interface{}
+	// server is the Server the session belongs to
+	server *Server
+	// jid holds the domain the client connected to, the bare JID once
+	// authenticated and the full JID once a resource is bound
+	jid      JID
+	messages chan interface{}
+	// done is closed once the session has ended
+	done chan struct{}
+	// anonymous is set for temporary guest sessions (SASL ANONYMOUS)
+	anonymous bool
+	// sm is the XEP-0198 state of the session
+	sm *streamManagement
+	// carbons is set once the session enabled XEP-0280 message carbons,
+	// guarded by the Server's session table lock
+	carbons bool
+	// interested is set once the session requested the roster and gets
+	// roster pushes, guarded by the Server's session table lock
+	interested bool
+	// presence is the last presence the session broadcast, nil while it is
+	// unavailable, and directed holds where it sent directed presence
+	// (RFC 6121 4.6). Both are guarded by the session table lock.
+	presence *ClientPresence
+	directed map[JID]bool
+	// outbox orders what other sessions push to this one
+	outbox outbox
 }
 
 // AccountManager performs roster management and authentication
 type AccountManager interface {
 	Authenticate(username, password string) (success bool, err error)
+	// ScramKeys returns the stored SCRAM credentials of username for the
+	// given mechanism (SCRAM-SHA-1 or SCRAM-SHA-256), or nil if the account
+	// does not exist. See NewScramKeys.
+	ScramKeys(username, mechanism string) (keys *ScramKeys, err error)
 	CreateAccount(username, password string) (success bool, err error)
 	OnlineRoster(jid string) (online []string, err error)
 }
@@ -36,11 +64,21 @@ type Logging interface {
 	Error(format string, args ...interface{})
 }
 
+// DomainConfig holds the settings of a single served domain
+type DomainConfig struct {
+	// AllowAnonymous enables SASL ANONYMOUS logins, which are given a
+	// random localpart and forgotten when they disconnect
+	AllowAnonymous bool
+}
+
 // Server contains options for an XMPP connection.
 type Server struct {
 	// what domain to use?
 	Domain string
 
+	// Domains holds per-domain settings keyed by domain name
+	Domains map[string]DomainConfig
+
 	// SkipTLS, if true, causes the TLS handshake to be skipped.
 	// WARNING: this should only be used if Conn is already secure.
 	SkipTLS bool
@@ -48,10 +86,48 @@ type Server struct {
 	// handshake. If nil, sensible defaults will be used.
 	TLSConfig *tls.Config
 
+	// CertificateMapper, if set, enables SASL EXTERNAL for clients that
+	// present a verified certificate. TLSConfig.ClientAuth and ClientCAs must
+	// be set up to request and verify client certificates.
+	CertificateMapper CertificateMapper
+
+	// TokenValidator, if set, enables the OAUTHBEARER and X-OAUTH2
+	// mechanisms. See JWTValidator.
+	TokenValidator TokenValidator
+
 	// AccountManager handles messages that the server must respond to
 	// such as authentication and roster management
 	Accounts AccountManager
 
+	// Registration, if set, enables in-band registration (XEP-0077) and
+	// decides who may create an account. See RegistrationOpen and
+	// RegistrationAllowlist.
+	Registration RegistrationPolicy
+
+	// AllowLegacyAuth enables legacy jabber:iq:auth logins (XEP-0078) for
+	// old clients, also on streams without a version, which get no stream
+	// features. They are only accepted on TLS streams unless
+	// AllowInsecureLegacyAuth is set too.
+	AllowLegacyAuth         bool
+	AllowInsecureLegacyAuth bool
+
+	// DisableStreamManagement turns off XEP-0198 stream management
+	DisableStreamManagement bool
+	// ResumeTimeout is how long a session whose connection dropped can be
+	// resumed with XEP-0198, 5 minutes by default
+	ResumeTimeout time.Duration
+	// OfflineStore, if set, receives messages that were routed to a
+	// session that went away before acknowledging them. Without it they
+	// bounce back to the sender.
+	OfflineStore OfflineStore
+
+	// Rosters keeps the rosters of the users, in memory if nil
+	Rosters RosterStore
+
+	// ResourceConflict is the policy used when a client binds a resource
+	// that is already in use. The default kicks the old session.
+	ResourceConflict ResourceConflict
+
 	// Extensions are injectable handlers that process messages
 	Extensions []Extension
 
@@ -64,29 +140,63 @@ type Server struct {
 
 	// Injectable logging interface
 	Log Logging
+
+	// bound sessions by full JID
+	sessions sessionTable
+	// live connections, for Shutdown
+	conns connTracker
+	// sessions waiting for a stream management resumption
+	resumable smTable
+	// roster store used when Rosters is nil
+	defaultRosters     RosterStore
+	defaultRostersOnce sync.Once
+	// serializes roster changes, which read an item and write it back
+	rosterLock sync.Mutex
+	// secret the made up SCRAM salts of unknown users are derived from
+	scramSecret     []byte
+	scramSecretOnce sync.Once
 }
 
 // Message is a generic XMPP message to send to the To Jid
 type Message struct {
-	To   string
+	To   JID
 	Data interface{}
 }
 
 // Connect holds a channel where the server can send messages to the specific Jid
 type Connect struct {
-	Jid      string
+	Jid      JID
 	Receiver chan<- interface{}
+	// Anonymous is set for temporary guest sessions
+	Anonymous bool
 }
 
 // Disconnect notifies when a jid disconnects
 type Disconnect struct {
-	Jid string
+	Jid JID
+	// Anonymous is set for guest sessions, whose state should be deleted
+	Anonymous bool
+}
+
+// JID returns the client's address
+func (c *Client) JID() JID {
+	return c.jid
+}
+
+// domainConfig returns the settings for domain
+func (s *Server) domainConfig(domain string) DomainConfig {
+	return s.Domains[domain]
 }
 
 // TCPAnswer sends connection through the TSLStateMachine
 func (s *Server) TCPAnswer(conn net.Conn) {
+	s.serveConn(conn, ListenerOptions{})
+}
+
+// serveConn runs the XMPP session on conn with the options of the listener
+// it was accepted on
+func (s *Server) serveConn(conn net.Conn, opts ListenerOptions) {
 	defer conn.Close()
-	var err error
 
 	s.Log.Error("Error LEVEL")
 	s.Log.Waring("Waring LEVEL")
@@ -96,31 +206,134 @@ func (s *Server) TCPAnswer(conn net.Conn) {
 	//s.Log.Info(fmt.Sprintf("Accepting TCP connection from: %s", conn.RemoteAddr()))
 	log.Printf("Accepting TCP connection from: %v\n", conn.RemoteAddr())
 
-	state := NewTLSStateMachine(s.SkipTLS)
+	s.serveClient(conn, conn.RemoteAddr().String(), func() (*Connection, State) {
+		if !opts.DirectTLS {
+			return NewConn(conn, MessageTypes), newStateMachine(s.SkipTLS && !opts.RequireTLS, opts.TLSConfig)
+		}
+		config := opts.TLSConfig
+		if config == nil {
+			config = s.TLSConfig
+		}
+		tlsConn, cert, err := tlsHandshake(conn, directTLSConfig(config))
+		if err != nil {
+			log.Printf("TLS handshake with %v failed: %v\n", conn.RemoteAddr(), err.Error())
+			return nil, nil
+		}
+		clientConnection := NewConn(tlsConn, MessageTypes)
+		clientConnection.serverCert = cert
+		return clientConnection, newDirectTLSStateMachine()
+	})
+}
+
+// serveClient runs a session through the state chain. conn is what
+// Shutdown closes to drop the client, which is not necessarily a single
+// net.Conn, and remote names the client in logs. start prepares the
+// Connection and the first state once conn is tracked for Shutdown; it
+// returns a nil Connection to drop conn.
+func (s *Server) serveClient(conn io.Closer, remote string, start func() (*Connection, State)) {
+	domain, err := NewJID("", s.Domain, "")
+	if err != nil {
+		log.Printf("Invalid server domain %v: %v\n", s.Domain, err.Error())
+		return
+	}
+
 	client := &Client{
-		messages:     make(chan interface{}),
-		domainpart:   s.Domain,
-		resourcepart: "XMPPConn1",
+		server:   s,
+		jid:      domain,
+		messages: make(chan interface{}),
+		done:     make(chan struct{}),
+		sm:       &streamManagement{},
 	}
-	defer close(client.messages)
+	detached := false
+	defer func() {
+		if !detached {
+			close(client.done)
+		}
+	}()
 
-	clientConnection := NewConn(conn, MessageTypes)
+	if err := s.trackConn(client, conn); err != nil {
+		log.Printf("Refusing connection from %v: %v\n", remote, err.Error())
+		return
+	}
+	defer func() {
+		s.untrackConn(client)
+		// only now may a resumption take the session over
+		s.releaseResumable(client)
+	}()
+
+	clientConnection, state := start()
+	if clientConnection == nil {
+		return
+	}
 
 	for {
 		state, clientConnection, err = state.Process(clientConnection, client, s)
 		//s.Log.Debug(fmt.Sprintf("[state] %s", state))
 		log.Printf("[state] %v\n", state)
+		if clientConnection != nil && clientConnection.resumed != nil {
+			// serve the resumed session, the new one was never bound
+			close(client.done)
+			client, clientConnection.resumed = clientConnection.resumed, nil
+		}
 
 		if err != nil {
 			//s.Log.Error(fmt.Sprintf("[%s] State Error: %s", client.jid, err.Error()))
+			if err == errSessionDetached {
+				// the session lives on until it is resumed or expires
+				log.Printf("[%v] Connection lost, session kept for resumption\n", client.jid)
+				detached = true
+				return
+			}
+			if err == ErrStreamClosed {
+				// the client gave up during negotiation
+				log.Printf("[%v] Stream closed by client\n", client.jid)
+				clientConnection.closeStream()
+				s.disconnect(client)
+				return
+			}
 			log.Printf("[%v] State Error: %v\n", client.jid, err.Error())
+			switch e := err.(type) {
+			case *StreamError:
+				clientConnection.sendStreamError(e, client.jid.Domain())
+			case *xml.SyntaxError:
+				clientConnection.sendStreamError(StreamNotWellFormed(""), client.jid.Domain())
+			}
+			s.disconnect(client)
 			return
 		}
 		if state == nil {
 			//s.Log.Info(fmt.Sprintf("Client Disconnected: %s", client.jid))
 			log.Printf("Client Disconnected:  %v\n", client.jid)
-			s.DisconnectBus <- Disconnect{Jid: client.jid}
+			s.disconnect(client)
 			return
 		}
 	}
 }
+
+// disconnect removes a bound client and notifies the DisconnectBus
+func (s *Server) disconnect(client *Client) {
+	if client.jid.IsBare() {
+		// never bound, nobody knows about it
+		return
+	}
+	s.endPresence(client)
+	if client.anonymous {
+		// guests leave nothing behind
+		s.dropAccount(client.jid.Bare())
+	}
+	s.unbindResource(client)
+	// keep the session's queue moving until the router has seen the
+	// Disconnect, anything still routed to it is dropped
+	draining := make(chan struct{})
+	go func() {
+		for {
+			select {
+			case <-client.messages:
+			case <-draining:
+				return
+			}
+		}
+	}()
+	s.DisconnectBus <- Disconnect{Jid: client.jid, Anonymous: client.anonymous}
+	close(draining)
+}